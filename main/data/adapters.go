@@ -4,8 +4,13 @@ import (
 	"echsylon/fudpucker/entity"
 	"echsylon/fudpucker/entity/utils"
 	"errors"
+	"fmt"
 )
 
+// Extra device attributes, which this build doesn't know how to interpret,
+// are stored under one attribute id per tag.
+var extraAttributeTags = buildExtraAttributeTags()
+
 func NewGetDeviceIdsDataAdapter(
 	getData func(entity.Id, entity.Id) (map[entity.Id][]byte, error),
 ) func() ([]entity.Id, error) {
@@ -72,6 +77,7 @@ func NewGetDeviceDataAdapter(
 			var deviceType entity.DeviceType = entity.DeviceTypeUnknown
 			var deviceState entity.DeviceState = entity.DeviceStateOff
 			var stateVersion int = 0
+			var extras map[byte][]byte = nil
 
 			for attr := range data {
 				if attr == ownerAttr {
@@ -87,13 +93,18 @@ func NewGetDeviceDataAdapter(
 				} else if attr == versionAttr {
 					value := utils.BytesToInt64(data[attr])
 					stateVersion = int(value)
+				} else if tag, ok := extraAttributeTags[attr]; ok {
+					if extras == nil {
+						extras = make(map[byte][]byte)
+					}
+					extras[tag] = data[attr]
 				}
 			}
 
 			if deviceType == entity.DeviceTypeUnknown {
 				return nil, errors.New("data format error")
 			} else {
-				return entity.NewDevice(deviceId, ownerId, deviceType, deviceState, stateVersion), nil
+				return entity.NewExtendedDevice(deviceId, ownerId, deviceType, deviceState, stateVersion, extras), nil
 			}
 		}
 	}
@@ -109,6 +120,9 @@ func NewCreateDeviceDataAdapter(
 		data[entity.NewStringId("state")] = utils.ByteToBytes(byte(device.GetState()))
 		data[entity.NewStringId("version")] = utils.Int64ToBytes(int64(device.GetVersion()))
 		data[entity.NewStringId("owner")] = device.GetOwner().Bytes()
+		for tag, value := range device.GetExtraAttributes() {
+			data[extraAttributeId(tag)] = value
+		}
 
 		return saveData(device.GetId(), data)
 	}
@@ -125,3 +139,16 @@ func NewPatchStateDataAdapter(
 		return saveData(deviceId, data)
 	}
 }
+
+// Private helper functions
+func extraAttributeId(tag byte) entity.Id {
+	return entity.NewStringId(fmt.Sprintf("extra-%d", tag))
+}
+
+func buildExtraAttributeTags() map[entity.Id]byte {
+	result := make(map[entity.Id]byte)
+	for tag := 0; tag <= 0xff; tag++ {
+		result[extraAttributeId(byte(tag))] = byte(tag)
+	}
+	return result
+}
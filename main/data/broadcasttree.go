@@ -0,0 +1,183 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"sync"
+	"time"
+)
+
+type BroadcastTree interface {
+	IsLazy(entity.Id) bool
+	Graft(entity.Id) bool
+	Prune(entity.Id) bool
+	Keep(entity.Message)
+	GetMessage(entity.Id) (entity.Message, bool)
+	Announce(entity.Id, entity.Peer)
+	GetAnnouncements() map[entity.Peer][]entity.Id
+	ExpectMessage(entity.Id, entity.Peer)
+	Received(entity.Id)
+	GetMissing(time.Duration) map[entity.Id]entity.Peer
+	Reset()
+}
+
+type keptMessage struct {
+	message  entity.Message
+	deadline time.Time
+}
+
+// A missing message is one we've heard of from the announcers, but haven't
+// received yet. Since tells when we last asked for it, or first heard of
+// it.
+type missingMessage struct {
+	announcers []entity.Peer
+	since      time.Time
+}
+
+// All peers are eager push peers until pruned, so that the tree starts
+// out as a flood and is cut down to a spanning tree by the duplicates it
+// causes.
+type broadcastTree struct {
+	lock          sync.Mutex
+	lazyPeers     map[entity.Id]struct{}
+	kept          map[entity.Id]keptMessage
+	announcements map[entity.Peer][]entity.Id
+	missing       map[entity.Id]*missingMessage
+}
+
+const (
+	keptMessageRetention = 30 * time.Second
+)
+
+func NewBroadcastTree() BroadcastTree {
+	return &broadcastTree{
+		lazyPeers:     make(map[entity.Id]struct{}),
+		kept:          make(map[entity.Id]keptMessage),
+		announcements: make(map[entity.Peer][]entity.Id),
+		missing:       make(map[entity.Id]*missingMessage),
+	}
+}
+
+func (t *broadcastTree) IsLazy(peerId entity.Id) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, isLazy := t.lazyPeers[peerId]
+	return isLazy
+}
+
+// Graft makes the given peer an eager push peer. Returns true if it was a
+// lazy push peer.
+func (t *broadcastTree) Graft(peerId entity.Id) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, isLazy := t.lazyPeers[peerId]
+	delete(t.lazyPeers, peerId)
+	return isLazy
+}
+
+// Prune makes the given peer a lazy push peer. Returns true if it was an
+// eager push peer.
+func (t *broadcastTree) Prune(peerId entity.Id) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, isLazy := t.lazyPeers[peerId]
+	t.lazyPeers[peerId] = struct{}{}
+	return !isLazy
+}
+
+// Keep holds on to the given message for a while, for lazy push peers to
+// ask for.
+func (t *broadcastTree) Keep(message entity.Message) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	for messageId, kept := range t.kept {
+		if now.After(kept.deadline) {
+			delete(t.kept, messageId)
+		}
+	}
+	t.kept[message.GetId()] = keptMessage{message: message, deadline: now.Add(keptMessageRetention)}
+}
+
+func (t *broadcastTree) GetMessage(messageId entity.Id) (entity.Message, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if kept, ok := t.kept[messageId]; !ok || time.Now().After(kept.deadline) {
+		return nil, false
+	} else {
+		return kept.message, true
+	}
+}
+
+// Announce queues the id of the given message for the given lazy push
+// peer.
+func (t *broadcastTree) Announce(messageId entity.Id, peer entity.Peer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.announcements[peer] = append(t.announcements[peer], messageId)
+}
+
+// GetAnnouncements returns, and forgets, the message ids queued for each
+// lazy push peer.
+func (t *broadcastTree) GetAnnouncements() map[entity.Peer][]entity.Id {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := t.announcements
+	t.announcements = make(map[entity.Peer][]entity.Id)
+	return result
+}
+
+// ExpectMessage notes that the given peer has announced a message we
+// haven't received.
+func (t *broadcastTree) ExpectMessage(messageId entity.Id, announcer entity.Peer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	missing, ok := t.missing[messageId]
+	if !ok {
+		missing = &missingMessage{since: time.Now()}
+		t.missing[messageId] = missing
+	}
+	for _, peer := range missing.announcers {
+		if peer.GetId() == announcer.GetId() {
+			return
+		}
+	}
+	missing.announcers = append(missing.announcers, announcer)
+}
+
+func (t *broadcastTree) Received(messageId entity.Id) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.missing, messageId)
+}
+
+// GetMissing returns the messages that haven't been received within the
+// given timeout since we heard of them, or since we last asked for them,
+// along with the next announcer to ask. Messages are forgotten when there
+// are no more announcers to ask.
+func (t *broadcastTree) GetMissing(timeout time.Duration) map[entity.Id]entity.Peer {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make(map[entity.Id]entity.Peer)
+	now := time.Now()
+	for messageId, missing := range t.missing {
+		if now.Sub(missing.since) < timeout {
+			continue
+		} else if len(missing.announcers) == 0 {
+			delete(t.missing, messageId)
+		} else {
+			result[messageId] = missing.announcers[0]
+			missing.announcers = missing.announcers[1:]
+			missing.since = now
+		}
+	}
+	return result
+}
+
+func (t *broadcastTree) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	clear(t.lazyPeers)
+	clear(t.kept)
+	clear(t.announcements)
+	clear(t.missing)
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"echsylon/fudpucker/entity"
+	"errors"
+	"sync"
+)
+
+type KeyCache interface {
+	GetKey(entity.Id) (ed25519.PublicKey, error)
+	PinKey(entity.Id, ed25519.PublicKey) bool
+	Reset()
+}
+
+type keyCache struct {
+	lock sync.Mutex
+	keys map[entity.Id]ed25519.PublicKey
+}
+
+func NewKeyCache() KeyCache {
+	return &keyCache{keys: make(map[entity.Id]ed25519.PublicKey)}
+}
+
+func (c *keyCache) GetKey(id entity.Id) (ed25519.PublicKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key, ok := c.keys[id]; !ok {
+		return nil, errors.New("no such key error")
+	} else {
+		return key, nil
+	}
+}
+
+// PinKey associates the given public key with the given host id, unless
+// another key is already associated with it. The first key we see for a
+// host is trusted from there on (trust on first use). Returns true if the
+// given key is the pinned key for the host.
+func (c *keyCache) PinKey(id entity.Id, key ed25519.PublicKey) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pinned, ok := c.keys[id]; ok {
+		return bytes.Equal(pinned, key)
+	} else if len(key) != ed25519.PublicKeySize {
+		return false
+	} else {
+		c.keys[id] = bytes.Clone(key)
+		return true
+	}
+}
+
+func (c *keyCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	clear(c.keys)
+}
@@ -0,0 +1,270 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"sync"
+	"time"
+)
+
+type MemberList interface {
+	GetIncarnation() int
+	Refute(int) int
+	GetMember(entity.Id) (entity.Member, bool)
+	Update(entity.Member) bool
+	Suspect(entity.Peer) (entity.Member, bool)
+	ConfirmSuspects(time.Duration) []entity.Member
+	NextProbeTarget([]entity.Peer) (entity.Peer, bool)
+	ExpectAck(entity.Id, entity.Peer, entity.Id)
+	Acknowledge(entity.Id) (entity.Peer, entity.Id, bool)
+	AwaitAck(entity.Id, time.Duration) bool
+	Reset()
+}
+
+type memberRecord struct {
+	member         entity.Member
+	suspectedSince time.Time
+}
+
+// A pending probe is either our own, awaited by the prober, or one we're
+// sending on behalf of another host, in which case the ack is relayed to
+// that host with the id of its ping request.
+type pendingProbe struct {
+	relayTo  entity.Peer
+	relayId  entity.Id
+	deadline time.Time
+	acked    bool
+	done     chan struct{}
+}
+
+type memberList struct {
+	lock        sync.Mutex
+	incarnation int
+	members     map[entity.Id]*memberRecord
+	probes      map[entity.Id]*pendingProbe
+	probeQueue  []entity.Peer
+}
+
+const (
+	pendingProbeRetention = 10 * time.Second
+)
+
+// NewMemberList returns an empty member list. Our own incarnation starts
+// at the current time, so that it's higher than any incarnation we may
+// have been declared dead with before a restart.
+func NewMemberList() MemberList {
+	return &memberList{
+		incarnation: int(time.Now().Unix()),
+		members:     make(map[entity.Id]*memberRecord),
+		probes:      make(map[entity.Id]*pendingProbe),
+	}
+}
+
+func (l *memberList) GetIncarnation() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.incarnation
+}
+
+// Refute raises our own incarnation above the given one, which another
+// host has suspected, or declared us dead, with. Returns the new
+// incarnation.
+func (l *memberList) Refute(incarnation int) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if incarnation >= l.incarnation {
+		l.incarnation = incarnation + 1
+	}
+	return l.incarnation
+}
+
+func (l *memberList) GetMember(id entity.Id) (entity.Member, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if record, ok := l.members[id]; !ok {
+		return nil, false
+	} else {
+		return record.member, true
+	}
+}
+
+// Update applies the given member state, if it overrides what we know
+// about the member. An alive state overrides any state with a lower
+// incarnation, a suspect state overrides an alive state with the same or
+// a lower incarnation and a dead state overrides anything but an alive
+// state with a higher incarnation. Returns true if the state was applied.
+func (l *memberList) Update(member entity.Member) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	record, ok := l.members[member.GetId()]
+	if ok {
+		current := record.member
+		switch member.GetState() {
+		case entity.MemberStateAlive:
+			ok = member.GetIncarnation() > current.GetIncarnation()
+		case entity.MemberStateSuspect:
+			ok = member.GetIncarnation() > current.GetIncarnation() ||
+				member.GetIncarnation() == current.GetIncarnation() && current.GetState() == entity.MemberStateAlive
+		case entity.MemberStateDead:
+			ok = current.GetState() != entity.MemberStateDead && member.GetIncarnation() >= current.GetIncarnation()
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	// Keep the address we know the member by, if the update doesn't say.
+	if member.GetAddress() == "" && record != nil {
+		member = entity.NewMember(member.GetId(), record.member.GetAddress(), member.GetState(), member.GetIncarnation())
+	}
+
+	l.set(member)
+	return true
+}
+
+// Suspect marks the given peer as suspected of having failed, after it
+// didn't answer our probes. Returns the suspect state, or false if the
+// peer was already suspected.
+func (l *memberList) Suspect(peer entity.Peer) (entity.Member, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	incarnation := 0
+	if record, ok := l.members[peer.GetId()]; ok {
+		if record.member.GetState() == entity.MemberStateSuspect {
+			return nil, false
+		}
+		incarnation = record.member.GetIncarnation()
+	}
+
+	member := entity.NewMember(peer.GetId(), peer.GetAddress(), entity.MemberStateSuspect, incarnation)
+	l.set(member)
+	return member, true
+}
+
+// ConfirmSuspects declares all members that have been suspected for
+// longer than the given timeout dead, and returns them.
+func (l *memberList) ConfirmSuspects(timeout time.Duration) []entity.Member {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	result := make([]entity.Member, 0)
+	now := time.Now()
+	for _, record := range l.members {
+		current := record.member
+		if current.GetState() == entity.MemberStateSuspect && now.Sub(record.suspectedSince) > timeout {
+			member := entity.NewMember(current.GetId(), current.GetAddress(), entity.MemberStateDead, current.GetIncarnation())
+			l.set(member)
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// NextProbeTarget returns the next of the given peers to probe. Peers are
+// probed in a random order, one full round at a time, so that a failed
+// peer is found within a bounded number of probes.
+func (l *memberList) NextProbeTarget(peers []entity.Peer) (entity.Peer, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	known := make(map[entity.Id]entity.Peer)
+	for _, peer := range peers {
+		known[peer.GetId()] = peer
+	}
+
+	for {
+		if len(l.probeQueue) == 0 {
+			if len(known) == 0 {
+				return nil, false
+			}
+			// Map key order is random when iterating.
+			for _, peer := range known {
+				l.probeQueue = append(l.probeQueue, peer)
+			}
+		}
+
+		next := l.probeQueue[0]
+		l.probeQueue = l.probeQueue[1:]
+		if peer, ok := known[next.GetId()]; ok {
+			return peer, true
+		}
+	}
+}
+
+// ExpectAck registers a sent ping. If a peer is given, the ack is to be
+// relayed to it with the given id.
+func (l *memberList) ExpectAck(probeId entity.Id, relayTo entity.Peer, relayId entity.Id) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for id, probe := range l.probes {
+		if now.After(probe.deadline) {
+			delete(l.probes, id)
+		}
+	}
+
+	l.probes[probeId] = &pendingProbe{
+		relayTo:  relayTo,
+		relayId:  relayId,
+		deadline: now.Add(pendingProbeRetention),
+		done:     make(chan struct{}),
+	}
+}
+
+// Acknowledge marks the ping with the given id as answered. Returns the
+// peer, and ping request id, to relay the ack to, if any, and false if we
+// weren't expecting the ack. Our own probes are kept until awaited, as the
+// ack may well arrive before the prober starts waiting for it.
+func (l *memberList) Acknowledge(probeId entity.Id) (entity.Peer, entity.Id, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if probe, ok := l.probes[probeId]; !ok || probe.acked {
+		return nil, entity.ZeroId, false
+	} else {
+		probe.acked = true
+		close(probe.done)
+		if probe.relayTo != nil {
+			delete(l.probes, probeId)
+		}
+		return probe.relayTo, probe.relayId, true
+	}
+}
+
+// AwaitAck blocks until the ping with the given id is answered, or until
+// the timeout expires. Returns true if the ping was answered.
+func (l *memberList) AwaitAck(probeId entity.Id, timeout time.Duration) bool {
+	l.lock.Lock()
+	probe, ok := l.probes[probeId]
+	l.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	defer func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.probes, probeId)
+	}()
+
+	select {
+	case <-probe.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (l *memberList) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	clear(l.members)
+	clear(l.probes)
+	l.probeQueue = nil
+}
+
+// Private helper functions
+func (l *memberList) set(member entity.Member) {
+	record := &memberRecord{member: member}
+	if member.GetState() == entity.MemberStateSuspect {
+		record.suspectedSince = time.Now()
+	}
+	l.members[member.GetId()] = record
+}
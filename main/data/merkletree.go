@@ -0,0 +1,181 @@
+package data
+
+import (
+	"crypto/sha256"
+	"echsylon/fudpucker/entity"
+	"echsylon/fudpucker/entity/utils"
+	"sync"
+
+	"github.com/echsylon/go-log"
+)
+
+type MerkleTree interface {
+	Update(entity.Id, int)
+	Remove(entity.Id)
+	GetHash(int, int) []byte
+	GetBucket(int) map[entity.Id]int
+	Reset()
+}
+
+// The hash of a bucket is the XOR of the hashes of its (device id, version)
+// pairs, so that it can be updated without rehashing the whole bucket. The
+// hash of any other node is the SHA-256 hash of its children's hashes, and
+// is only computed when asked for after a change.
+type merkleTree struct {
+	lock    sync.Mutex
+	buckets []map[entity.Id]int
+	levels  [][][]byte
+	dirty   bool
+}
+
+func NewMerkleTree() MerkleTree {
+	tree := &merkleTree{
+		buckets: make([]map[entity.Id]int, entity.MerkleTreeBucketCount),
+		levels:  make([][][]byte, entity.MerkleTreeDepth+1),
+	}
+	tree.Reset()
+	return tree
+}
+
+// Update sets the version of the given device, adding the device to the
+// tree if it's not already there.
+func (t *merkleTree) Update(deviceId entity.Id, version int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	bucket := entity.MerkleBucket(deviceId)
+	leaf := t.levels[entity.MerkleTreeDepth][bucket]
+	if current, ok := t.buckets[bucket][deviceId]; ok {
+		xorHash(leaf, hashEntry(deviceId, current))
+	}
+	xorHash(leaf, hashEntry(deviceId, version))
+	t.buckets[bucket][deviceId] = version
+	t.dirty = true
+}
+
+func (t *merkleTree) Remove(deviceId entity.Id) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	bucket := entity.MerkleBucket(deviceId)
+	if current, ok := t.buckets[bucket][deviceId]; ok {
+		xorHash(t.levels[entity.MerkleTreeDepth][bucket], hashEntry(deviceId, current))
+		delete(t.buckets[bucket], deviceId)
+		t.dirty = true
+	}
+}
+
+// GetHash returns the hash of the node with the given index on the given
+// level, or nil if there is no such node.
+func (t *merkleTree) GetHash(level int, index int) []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if level < 0 || level > entity.MerkleTreeDepth || index < 0 || index >= entity.MerkleNodeCount(level) {
+		return nil
+	}
+
+	if t.dirty {
+		t.rehash()
+	}
+	return append([]byte{}, t.levels[level][index]...)
+}
+
+// GetBucket returns the devices, and their versions, in the bucket with
+// the given index.
+func (t *merkleTree) GetBucket(index int) map[entity.Id]int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make(map[entity.Id]int)
+	if index >= 0 && index < entity.MerkleTreeBucketCount {
+		for deviceId, version := range t.buckets[index] {
+			result[deviceId] = version
+		}
+	}
+	return result
+}
+
+func (t *merkleTree) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for index := range t.buckets {
+		t.buckets[index] = make(map[entity.Id]int)
+	}
+	for level := range t.levels {
+		t.levels[level] = make([][]byte, entity.MerkleNodeCount(level))
+		for index := range t.levels[level] {
+			t.levels[level][index] = make([]byte, entity.MerkleHashLength)
+		}
+	}
+	t.dirty = true
+}
+
+// rehash computes the hashes of all inner nodes from the bucket hashes.
+func (t *merkleTree) rehash() {
+	for level := entity.MerkleTreeDepth - 1; level >= 0; level-- {
+		children := t.levels[level+1]
+		for index := range t.levels[level] {
+			hash := sha256.New()
+			for _, child := range children[index*entity.MerkleTreeFanout : (index+1)*entity.MerkleTreeFanout] {
+				hash.Write(child)
+			}
+			t.levels[level][index] = hash.Sum(nil)
+		}
+	}
+	t.dirty = false
+}
+
+// NewMerkleDatabase returns a database that keeps the given tree up to
+// date with the devices written to, and deleted from, the given database.
+// The tree is loaded with the devices already in the database.
+func NewMerkleDatabase(database Database, tree MerkleTree) Database {
+	getDeviceIds := NewGetDeviceIdsDataAdapter(database.Get)
+	getVersion := NewGetStateVersionAttributeAdapter(database.Get)
+	if deviceIds, err := getDeviceIds(); err != nil {
+		log.Warning("Failed loading devices into the Merkle tree")
+	} else {
+		for _, deviceId := range deviceIds {
+			if version, err := getVersion(deviceId); err == nil {
+				tree.Update(deviceId, version)
+			}
+		}
+	}
+	return &merkleDatabase{Database: database, tree: tree}
+}
+
+type merkleDatabase struct {
+	Database
+	tree MerkleTree
+}
+
+// Set writes the given attributes and updates the tree if the version of
+// the device is among them.
+func (d *merkleDatabase) Set(id entity.Id, data map[entity.Id][]byte) error {
+	if err := d.Database.Set(id, data); err != nil {
+		return err
+	} else if version, ok := data[versionAttributeId]; ok {
+		d.tree.Update(id, int(utils.BytesToInt64(version)))
+	}
+	return nil
+}
+
+func (d *merkleDatabase) Delete(id entity.Id) error {
+	if err := d.Database.Delete(id); err != nil {
+		return err
+	}
+	d.tree.Remove(id)
+	return nil
+}
+
+// Private helper functions
+var versionAttributeId = entity.NewStringId("version")
+
+func hashEntry(deviceId entity.Id, version int) []byte {
+	hash := sha256.New()
+	hash.Write(deviceId.Bytes())
+	hash.Write(utils.Int64ToBytes(int64(version)))
+	return hash.Sum(nil)
+}
+
+func xorHash(target []byte, source []byte) {
+	for index := range target {
+		target[index] ^= source[index]
+	}
+}
@@ -2,13 +2,19 @@ package data
 
 import (
 	"echsylon/fudpucker/entity"
+	"sync"
 	"time"
+
+	"github.com/echsylon/go-log"
 )
 
 type MessageCache interface {
 	ContainsMessageForPeer(entity.Id, entity.Id) bool
 	ContainsMessage(entity.Id) bool
 	Hold(entity.Id, entity.Id)
+	Spread(entity.Message)
+	CountFeedback(entity.Id, entity.Id)
+	GetHotRumors() []entity.Message
 	Reset()
 }
 
@@ -17,6 +23,7 @@ type entry struct {
 }
 
 type messageCache struct {
+	lock    sync.Mutex
 	entries map[entity.Id]entry
 }
 
@@ -27,6 +34,8 @@ func NewMessageCache() MessageCache {
 }
 
 func (c *messageCache) ContainsMessageForPeer(messageId entity.Id, peerId entity.Id) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.clearOutdated()
 	if entry, hasMessage := c.entries[messageId]; !hasMessage {
 		return false
@@ -38,12 +47,16 @@ func (c *messageCache) ContainsMessageForPeer(messageId entity.Id, peerId entity
 }
 
 func (c *messageCache) ContainsMessage(messageId entity.Id) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.clearOutdated()
 	_, hasMessage := c.entries[messageId]
 	return hasMessage
 }
 
 func (c *messageCache) Hold(messageId entity.Id, peerId entity.Id) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if item, hasMessage := c.entries[messageId]; !hasMessage {
 		d := time.Now().Add(timeToLive)
 		r := map[entity.Id]time.Time{peerId: d}
@@ -55,7 +68,19 @@ func (c *messageCache) Hold(messageId entity.Id, peerId entity.Id) {
 	}
 }
 
+// Messages are only forwarded once, when first seen, in the time to live
+// mode, hence there are no rumors to spread.
+func (c *messageCache) Spread(message entity.Message) {}
+
+func (c *messageCache) CountFeedback(messageId entity.Id, peerId entity.Id) {}
+
+func (c *messageCache) GetHotRumors() []entity.Message {
+	return nil
+}
+
 func (c *messageCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	clear(c.entries)
 }
 
@@ -72,3 +97,126 @@ func (c *messageCache) clearOutdated() {
 		}
 	}
 }
+
+// A rumor is hot while we keep spreading its message, and turns cold when
+// enough peers have told us it already, or when it has been spread for
+// enough rounds. Messages we merely know of, and don't spread, have no
+// message. They are only kept to tell which peers know them.
+type rumor struct {
+	receivers map[entity.Id]struct{}
+	message   entity.Message
+	cold      bool
+	feedback  int
+	rounds    int
+	lastHeard int
+}
+
+type rumorCache struct {
+	lock          sync.Mutex
+	feedbackLimit int
+	roundLimit    int
+	round         int
+	rumors        map[entity.Id]*rumor
+}
+
+// NewRumorCache returns a message cache for rumor mongering. A rumor is
+// spread until it has been heard from the given number of peers already
+// knowing it, or for the given number of rounds. Messages are forgotten
+// once cold and not heard of for as many rounds.
+func NewRumorCache(feedbackLimit int, roundLimit int) MessageCache {
+	return &rumorCache{
+		feedbackLimit: feedbackLimit,
+		roundLimit:    roundLimit,
+		rumors:        make(map[entity.Id]*rumor),
+	}
+}
+
+func (c *rumorCache) ContainsMessageForPeer(messageId entity.Id, peerId entity.Id) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if rumor, hasMessage := c.rumors[messageId]; !hasMessage {
+		return false
+	} else {
+		_, hasPeer := rumor.receivers[peerId]
+		return hasPeer
+	}
+}
+
+func (c *rumorCache) ContainsMessage(messageId entity.Id) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, hasMessage := c.rumors[messageId]
+	return hasMessage
+}
+
+func (c *rumorCache) Hold(messageId entity.Id, peerId entity.Id) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	rumor := c.get(messageId)
+	rumor.receivers[peerId] = struct{}{}
+}
+
+// Spread starts spreading the given message, unless its rumor has already
+// turned cold.
+func (c *rumorCache) Spread(message entity.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if rumor := c.get(message.GetId()); rumor.message == nil && !rumor.cold {
+		rumor.message = message
+	}
+}
+
+// CountFeedback notes that a message we already knew, sent by the given
+// peer, was received again, which cools the rumor down.
+func (c *rumorCache) CountFeedback(messageId entity.Id, peerId entity.Id) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if rumor, hasMessage := c.rumors[messageId]; hasMessage {
+		rumor.receivers[peerId] = struct{}{}
+		rumor.lastHeard = c.round
+		rumor.feedback++
+		if rumor.feedback >= c.feedbackLimit && !rumor.cold {
+			log.Debug("Rumor %s turned cold after %d rounds", messageId, rumor.rounds)
+			rumor.message = nil
+			rumor.cold = true
+		}
+	}
+}
+
+// GetHotRumors starts a new round of rumor mongering and returns the
+// messages to spread in it.
+func (c *rumorCache) GetHotRumors() []entity.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.round++
+	result := make([]entity.Message, 0)
+	for messageId, rumor := range c.rumors {
+		if rumor.message != nil && rumor.rounds < c.roundLimit {
+			rumor.rounds++
+			result = append(result, rumor.message)
+		} else if rumor.message != nil {
+			log.Debug("Rumor %s turned cold after %d rounds", messageId, rumor.rounds)
+			rumor.message = nil
+			rumor.cold = true
+		} else if c.round-rumor.lastHeard > c.roundLimit {
+			delete(c.rumors, messageId)
+		}
+	}
+	return result
+}
+
+func (c *rumorCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	clear(c.rumors)
+}
+
+func (c *rumorCache) get(messageId entity.Id) *rumor {
+	result, hasMessage := c.rumors[messageId]
+	if !hasMessage {
+		result = &rumor{receivers: make(map[entity.Id]struct{})}
+		c.rumors[messageId] = result
+	}
+	result.lastHeard = c.round
+	return result
+}
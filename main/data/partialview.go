@@ -0,0 +1,271 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"sync"
+	"time"
+)
+
+// PartialView is a peer cache that only keeps a small active view, of the
+// peers we gossip with, and a larger passive view, of peers to replace
+// failed active peers with (HyParView). All peers are still known to the
+// wrapped cache, but GetAllPeers and GetRandomPeers only return active
+// peers. Peers added to the cache go into the passive view, which, once
+// full, forgets a random peer for each new one.
+type PartialView interface {
+	PeerCache
+	GetKnownPeers() []entity.Peer
+	GetPassivePeers() []entity.Peer
+	IsActiveViewFull() bool
+	Activate(entity.Peer) entity.Peer
+	Deactivate(entity.Id) bool
+	AddPassivePeers([]entity.SignedPeer)
+	ExpectNeighborReply(entity.Id) bool
+	NeighborReplied(entity.Id)
+	DropUnresponsive(time.Duration) []entity.Id
+}
+
+type partialView struct {
+	PeerCache
+	lock        sync.Mutex
+	activeSize  int
+	passiveSize int
+	active      map[entity.Id]entity.Peer
+	passive     map[entity.Id]entity.Peer
+	pending     map[entity.Id]time.Time
+}
+
+// NewPartialView returns a partial view, with the given view sizes, over
+// the given peer cache. Peers already in the cache are added to the
+// passive view.
+func NewPartialView(peers PeerCache, activeSize int, passiveSize int) PartialView {
+	view := &partialView{
+		PeerCache:   peers,
+		activeSize:  activeSize,
+		passiveSize: passiveSize,
+		active:      make(map[entity.Id]entity.Peer),
+		passive:     make(map[entity.Id]entity.Peer),
+		pending:     make(map[entity.Id]time.Time),
+	}
+	for _, peer := range peers.GetAllPeers() {
+		view.addPassive(peer)
+	}
+	return view
+}
+
+func (v *partialView) AddPeer(peer entity.Peer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, isActive := v.active[peer.GetId()]; isActive {
+		v.active[peer.GetId()] = peer
+		v.PeerCache.AddPeer(peer)
+	} else {
+		delete(v.passive, peer.GetId())
+		v.addPassive(peer)
+	}
+}
+
+func (v *partialView) AddPeerRecord(record entity.SignedPeer) bool {
+	if !v.PeerCache.AddPeerRecord(record) {
+		return false
+	}
+	v.AddPeer(entity.NewPeer(record.GetId(), record.GetAddress()))
+	return true
+}
+
+func (v *partialView) RemovePeer(id entity.Id) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.active, id)
+	delete(v.passive, id)
+	delete(v.pending, id)
+	v.PeerCache.RemovePeer(id)
+}
+
+// GetAllPeers returns the active peers, in random order.
+func (v *partialView) GetAllPeers() []entity.Peer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return peersOf(v.active)
+}
+
+// GetRandomPeers returns up to the given number of active peers, picked at
+// random.
+func (v *partialView) GetRandomPeers(count int) []entity.Peer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	peers := peersOf(v.active)
+	return peers[:max(0, min(count, len(peers)))]
+}
+
+// GetSilentPeers returns the silent active peers. Passive peers aren't
+// talked to, and hence expected to be silent.
+func (v *partialView) GetSilentPeers(silence time.Duration) []entity.Peer {
+	silentPeers := v.PeerCache.GetSilentPeers(silence)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	result := make([]entity.Peer, 0, len(silentPeers))
+	for _, peer := range silentPeers {
+		if _, isActive := v.active[peer.GetId()]; isActive {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+// GetKnownPeers returns the active and the passive peers.
+func (v *partialView) GetKnownPeers() []entity.Peer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return append(peersOf(v.active), peersOf(v.passive)...)
+}
+
+// GetPassivePeers returns the passive peers, in random order.
+func (v *partialView) GetPassivePeers() []entity.Peer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return peersOf(v.passive)
+}
+
+func (v *partialView) IsActiveViewFull() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.active) >= v.activeSize
+}
+
+// Activate moves the given peer into the active view. If the active view
+// is full, a random active peer is moved to the passive view to make room
+// and returned, as it should be told about it.
+func (v *partialView) Activate(peer entity.Peer) entity.Peer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	id := peer.GetId()
+	v.PeerCache.AddPeer(peer)
+	delete(v.passive, id)
+	delete(v.pending, id)
+	if _, isActive := v.active[id]; isActive {
+		v.active[id] = peer
+		return nil
+	}
+
+	var dropped entity.Peer = nil
+	if len(v.active) >= v.activeSize {
+		// Map key order is random when iterating.
+		for droppedId, candidate := range v.active {
+			delete(v.active, droppedId)
+			v.addPassive(candidate)
+			dropped = candidate
+			break
+		}
+	}
+
+	v.active[id] = peer
+	return dropped
+}
+
+// Deactivate moves the given peer from the active view to the passive
+// view. Returns true if it was an active peer.
+func (v *partialView) Deactivate(id entity.Id) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if peer, isActive := v.active[id]; !isActive {
+		return false
+	} else {
+		delete(v.active, id)
+		v.addPassive(peer)
+		return true
+	}
+}
+
+// AddPassivePeers adds the peers described by the given signed records to
+// the passive view, keeping the records for sharing with other hosts. Peers
+// we already know of are kept as they are.
+func (v *partialView) AddPassivePeers(records []entity.SignedPeer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, record := range records {
+		if _, err := v.PeerCache.GetPeer(record.GetId()); err != nil {
+			v.addPassive(entity.NewPeer(record.GetId(), record.GetAddress()))
+			v.PeerCache.AddPeerRecord(record)
+		}
+	}
+}
+
+// ExpectNeighborReply notes that we've asked the given passive peer to
+// become an active peer. Returns false if we're already waiting for it to
+// answer.
+func (v *partialView) ExpectNeighborReply(id entity.Id) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, isPending := v.pending[id]; isPending {
+		return false
+	}
+	v.pending[id] = time.Now()
+	return true
+}
+
+func (v *partialView) NeighborReplied(id entity.Id) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.pending, id)
+}
+
+// DropUnresponsive forgets the passive peers that haven't answered our
+// neighbor requests within the given timeout, and returns their ids.
+func (v *partialView) DropUnresponsive(timeout time.Duration) []entity.Id {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	result := make([]entity.Id, 0)
+	now := time.Now()
+	for id, since := range v.pending {
+		if now.Sub(since) > timeout {
+			delete(v.pending, id)
+			if _, isPassive := v.passive[id]; isPassive {
+				delete(v.passive, id)
+				v.PeerCache.RemovePeer(id)
+				result = append(result, id)
+			}
+		}
+	}
+	return result
+}
+
+func (v *partialView) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	clear(v.active)
+	clear(v.passive)
+	clear(v.pending)
+	v.PeerCache.Reset()
+}
+
+// Private helper functions
+func (v *partialView) addPassive(peer entity.Peer) {
+	id := peer.GetId()
+	if _, isActive := v.active[id]; isActive {
+		return
+	} else if _, isPassive := v.passive[id]; isPassive {
+		return
+	}
+
+	if len(v.passive) >= v.passiveSize {
+		// Map key order is random when iterating.
+		for forgottenId := range v.passive {
+			delete(v.passive, forgottenId)
+			delete(v.pending, forgottenId)
+			v.PeerCache.RemovePeer(forgottenId)
+			break
+		}
+	}
+
+	v.passive[id] = peer
+	v.PeerCache.AddPeer(peer)
+}
+
+func peersOf(peers map[entity.Id]entity.Peer) []entity.Peer {
+	result := make([]entity.Peer, 0, len(peers))
+	for _, peer := range peers {
+		result = append(result, peer)
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"sync"
+	"time"
+)
+
+// PatchOutcomes remembers the outcomes of the patches we've handled as
+// device owner, so that retransmissions of a patch can be answered with the
+// reply we already sent instead of being applied again.
+type PatchOutcomes interface {
+	Put(entity.PatchOutcome)
+	Get(entity.Id) (entity.PatchOutcome, bool)
+	Reset()
+}
+
+type handledPatch struct {
+	outcome  entity.PatchOutcome
+	deadline time.Time
+}
+
+type patchOutcomes struct {
+	lock     sync.Mutex
+	outcomes map[entity.Id]handledPatch
+}
+
+// Patch senders give up after about half a minute of retransmissions.
+const patchOutcomeRetention = 2 * time.Minute
+
+func NewPatchOutcomes() PatchOutcomes {
+	return &patchOutcomes{outcomes: make(map[entity.Id]handledPatch)}
+}
+
+func (o *patchOutcomes) Put(outcome entity.PatchOutcome) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Now()
+	for id, handled := range o.outcomes {
+		if handled.deadline.Before(now) {
+			delete(o.outcomes, id)
+		}
+	}
+	o.outcomes[outcome.GetPatchId()] = handledPatch{
+		outcome:  outcome,
+		deadline: now.Add(patchOutcomeRetention),
+	}
+}
+
+// Get returns the outcome of the patch with the given id, if we've handled
+// it recently.
+func (o *patchOutcomes) Get(patchId entity.Id) (entity.PatchOutcome, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if handled, ok := o.outcomes[patchId]; !ok || handled.deadline.Before(time.Now()) {
+		return nil, false
+	} else {
+		return handled.outcome, true
+	}
+}
+
+func (o *patchOutcomes) Reset() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	clear(o.outcomes)
+}
@@ -0,0 +1,196 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/echsylon/go-log"
+)
+
+type PatchQueue interface {
+	Add(entity.Message, entity.Id, entity.DeviceState, int)
+	Supersede(entity.Id, int)
+	Resolve(entity.PatchOutcome) bool
+	AwaitPatch(entity.Id, time.Duration) (entity.Patch, error)
+	GetDuePatches() []entity.Patch
+	GetAllPatches() []entity.Patch
+	Reset()
+}
+
+type pendingPatch struct {
+	deviceId    entity.Id
+	state       entity.DeviceState
+	baseVersion int
+	attempts    int
+	status      entity.PatchStatus
+	deadline    time.Time
+	version     int
+	reason      string
+	done        chan struct{}
+}
+
+type patchQueue struct {
+	lock    sync.Mutex
+	patches map[entity.Id]*pendingPatch
+}
+
+const (
+	initialRetransmitDelay = 1 * time.Second
+	maxRetransmitAttempts  = 5
+	finishedPatchRetention = 1 * time.Minute
+)
+
+var (
+	ErrNoSuchPatch  = errors.New("no such patch error")
+	ErrPatchTimeout = errors.New("patch timeout error")
+)
+
+func NewPatchQueue() PatchQueue {
+	return &patchQueue{patches: make(map[entity.Id]*pendingPatch)}
+}
+
+// Add puts a sent patch message in the retransmission queue. The base
+// version is the version of the device at the time the patch was sent.
+func (q *patchQueue) Add(message entity.Message, deviceId entity.Id, state entity.DeviceState, baseVersion int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.patches[message.GetId()] = &pendingPatch{
+		deviceId:    deviceId,
+		state:       state,
+		baseVersion: baseVersion,
+		status:      entity.PatchStatusPending,
+		deadline:    time.Now().Add(initialRetransmitDelay),
+		done:        make(chan struct{}),
+	}
+}
+
+// Supersede marks all pending patches for the given device as superseded
+// if the given version is newer than the one the owner would give the
+// device when accepting them. A sync of that very version may well be our
+// own patch, accepted, and racing the reply.
+func (q *patchQueue) Supersede(deviceId entity.Id, version int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, patch := range q.patches {
+		if patch.status == entity.PatchStatusPending && patch.deviceId == deviceId && patch.baseVersion+1 < version {
+			q.finish(patch, entity.PatchStatusSuperseded)
+		}
+	}
+}
+
+// Resolve records the outcome of the patch, as reported by the device
+// owner. Returns true if the patch was sent by us. The owner knows best,
+// so the outcome replaces a guess that the patch was superseded.
+func (q *patchQueue) Resolve(outcome entity.PatchOutcome) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if patch, ok := q.patches[outcome.GetPatchId()]; !ok {
+		return false
+	} else {
+		if patch.status == entity.PatchStatusPending || patch.status == entity.PatchStatusSuperseded {
+			patch.version = outcome.GetVersion()
+			patch.reason = outcome.GetReason()
+			if outcome.IsAccepted() {
+				q.finish(patch, entity.PatchStatusAccepted)
+			} else {
+				q.finish(patch, entity.PatchStatusRejected)
+			}
+		}
+		return true
+	}
+}
+
+// AwaitPatch blocks until the patch with the given message id is no
+// longer pending, or until the timeout expires.
+func (q *patchQueue) AwaitPatch(messageId entity.Id, timeout time.Duration) (entity.Patch, error) {
+	q.lock.Lock()
+	patch, ok := q.patches[messageId]
+	q.lock.Unlock()
+
+	if !ok {
+		return nil, ErrNoSuchPatch
+	}
+
+	select {
+	case <-patch.done:
+	case <-time.After(timeout):
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if patch.status == entity.PatchStatusPending {
+		return nil, ErrPatchTimeout
+	} else {
+		return q.snapshot(messageId, patch), nil
+	}
+}
+
+// GetDuePatches returns the pending patches that are due for
+// retransmission and schedules their next attempt with exponential
+// backoff. Patches that have been retransmitted too many times are
+// abandoned.
+func (q *patchQueue) GetDuePatches() []entity.Patch {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.clearOutdated()
+
+	now := time.Now()
+	result := make([]entity.Patch, 0)
+	for id, patch := range q.patches {
+		if patch.status != entity.PatchStatusPending || patch.deadline.After(now) {
+			continue
+		} else if patch.attempts >= maxRetransmitAttempts {
+			log.Warning("Giving up on patch %s for device %s after %d retransmissions", id, patch.deviceId, patch.attempts)
+			q.finish(patch, entity.PatchStatusAbandoned)
+		} else {
+			patch.attempts++
+			patch.deadline = now.Add(initialRetransmitDelay << patch.attempts)
+			result = append(result, q.snapshot(id, patch))
+		}
+	}
+
+	return result
+}
+
+func (q *patchQueue) GetAllPatches() []entity.Patch {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.clearOutdated()
+
+	result := make([]entity.Patch, 0, len(q.patches))
+	for id, patch := range q.patches {
+		result = append(result, q.snapshot(id, patch))
+	}
+	return result
+}
+
+func (q *patchQueue) Reset() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	clear(q.patches)
+}
+
+// finish closes the patch with the given status. A superseded patch may
+// still be finished by a late reply.
+func (q *patchQueue) finish(patch *pendingPatch, status entity.PatchStatus) {
+	if patch.status == entity.PatchStatusPending {
+		close(patch.done)
+	}
+	patch.status = status
+	patch.deadline = time.Now().Add(finishedPatchRetention)
+}
+
+func (q *patchQueue) snapshot(id entity.Id, patch *pendingPatch) entity.Patch {
+	return entity.NewPatch(id, patch.deviceId, patch.state, patch.attempts, patch.status, patch.version, patch.reason)
+}
+
+func (q *patchQueue) clearOutdated() {
+	now := time.Now()
+	for id, patch := range q.patches {
+		if patch.status != entity.PatchStatusPending && patch.deadline.Before(now) {
+			delete(q.patches, id)
+		}
+	}
+}
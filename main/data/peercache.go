@@ -3,6 +3,8 @@ package data
 import (
 	"echsylon/fudpucker/entity"
 	"errors"
+	"sync"
+	"time"
 )
 
 type PeerCache interface {
@@ -11,26 +13,43 @@ type PeerCache interface {
 	RemovePeer(entity.Id)
 	GetAllPeers() []entity.Peer
 	GetRandomPeers(int) []entity.Peer
+	SetPeerVersion(entity.Id, byte)
+	GetPeerVersion(entity.Id) byte
+	NotePeerVersion(string, byte)
+	AddPeerRecord(entity.SignedPeer) bool
+	GetPeerRecord(entity.Id) (entity.SignedPeer, error)
+	GetPeerRecords(int) []entity.SignedPeer
+	MarkSeen(string)
+	GetSilentPeers(time.Duration) []entity.Peer
 	Reset()
 }
 
 type peerCache struct {
-	peers map[entity.Id]entity.Peer
+	lock     sync.Mutex
+	peers    map[entity.Id]entity.Peer
+	versions map[entity.Id]byte
+	records  map[entity.Id]entity.SignedPeer
+	lastSeen map[string]time.Time
 }
 
-const (
-	recommendedPeerCount = 5
-)
-
 func NewPeerCache() PeerCache {
-	return &peerCache{peers: make(map[entity.Id]entity.Peer)}
+	return &peerCache{
+		peers:    make(map[entity.Id]entity.Peer),
+		versions: make(map[entity.Id]byte),
+		records:  make(map[entity.Id]entity.SignedPeer),
+		lastSeen: make(map[string]time.Time),
+	}
 }
 
 func (r *peerCache) AddPeer(peer entity.Peer) {
-	r.peers[peer.GetId()] = peer
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.put(peer)
 }
 
 func (r *peerCache) GetPeer(id entity.Id) (entity.Peer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if peer, ok := r.peers[id]; !ok {
 		return nil, errors.New("no such peer error")
 	} else {
@@ -39,10 +58,19 @@ func (r *peerCache) GetPeer(id entity.Id) (entity.Peer, error) {
 }
 
 func (r *peerCache) RemovePeer(id entity.Id) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if peer, ok := r.peers[id]; ok {
+		delete(r.lastSeen, peer.GetAddress())
+	}
 	delete(r.peers, id)
+	delete(r.versions, id)
+	delete(r.records, id)
 }
 
 func (r *peerCache) GetAllPeers() []entity.Peer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	result := make([]entity.Peer, len(r.peers))
 	index := 0
 	for _, peer := range r.peers {
@@ -52,34 +80,142 @@ func (r *peerCache) GetAllPeers() []entity.Peer {
 	return result
 }
 
+// GetRandomPeers returns up to the given number of peers, picked at
+// random.
 func (r *peerCache) GetRandomPeers(count int) []entity.Peer {
-	peerCount := len(r.peers)
-	resultCount := count
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make([]entity.Peer, 0, max(0, min(count, len(r.peers))))
 
-	if count <= 0 {
-		resultCount = recommendedPeerCount
+	// Map key order is guaranteed to be random when iterating.
+	for _, peer := range r.peers {
+		if len(result) >= count {
+			break
+		}
+		result = append(result, peer)
 	}
 
-	if peerCount < resultCount {
-		count = resultCount
+	return result
+}
+
+// SetPeerVersion remembers the highest protocol version the given peer
+// has advertised.
+func (r *peerCache) SetPeerVersion(id entity.Id, version byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.versions[id] = version
+}
+
+// GetPeerVersion returns the highest protocol version the given peer has
+// advertised, or zero if it hasn't advertised any yet.
+func (r *peerCache) GetPeerVersion(id entity.Id) byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.versions[id]
+}
+
+// NotePeerVersion remembers the protocol version of a frame received from
+// the peer at the given address, unless the peer has advertised a version
+// already. Addresses of unknown peers are ignored.
+func (r *peerCache) NotePeerVersion(address string, version byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, peer := range r.peers {
+		if peer.GetAddress() == address && r.versions[id] == 0 {
+			r.versions[id] = version
+		}
 	}
+}
 
-	result := make([]entity.Peer, resultCount)
-	index := 0
+// AddPeerRecord adds the peer described by the given signed record, and
+// keeps the record for sharing with other hosts. Records older than the
+// one we already have for the peer are ignored. Returns true if the record
+// was added.
+func (r *peerCache) AddPeerRecord(record entity.SignedPeer) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := record.GetId()
+	if current, ok := r.records[id]; ok && !record.GetTimestamp().After(current.GetTimestamp()) {
+		return false
+	}
+	r.records[id] = record
+	r.put(entity.NewPeer(id, record.GetAddress()))
+	return true
+}
+
+func (r *peerCache) GetPeerRecord(id entity.Id) (entity.SignedPeer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if record, ok := r.records[id]; !ok {
+		return nil, errors.New("no such peer record error")
+	} else {
+		return record, nil
+	}
+}
+
+// GetPeerRecords returns up to the given number of signed peer records,
+// picked at random.
+func (r *peerCache) GetPeerRecords(count int) []entity.SignedPeer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make([]entity.SignedPeer, 0, max(0, min(count, len(r.records))))
 
 	// Map key order is guaranteed to be random when iterating.
-	for _, peer := range r.peers {
-		if index == resultCount {
+	for _, record := range r.records {
+		if len(result) >= count {
 			break
-		} else {
-			result[index] = peer
-			index++
 		}
+		result = append(result, record)
+	}
+	return result
+}
+
+// MarkSeen notes that a frame was just received from the peer at the
+// given address. Addresses of unknown peers are ignored.
+func (r *peerCache) MarkSeen(address string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.lastSeen[address]; ok {
+		r.lastSeen[address] = time.Now()
 	}
+}
 
+// GetSilentPeers returns the peers we haven't received a frame from for
+// longer than the given duration. Peers count as seen when added.
+func (r *peerCache) GetSilentPeers(silence time.Duration) []entity.Peer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make([]entity.Peer, 0)
+	now := time.Now()
+	for _, peer := range r.peers {
+		if now.Sub(r.lastSeen[peer.GetAddress()]) > silence {
+			result = append(result, peer)
+		}
+	}
 	return result
 }
 
 func (r *peerCache) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	clear(r.peers)
+	clear(r.versions)
+	clear(r.records)
+	clear(r.lastSeen)
+}
+
+// put adds, or updates, the given peer. The last seen time follows the
+// peer to its new address, if it has moved.
+func (r *peerCache) put(peer entity.Peer) {
+	address := peer.GetAddress()
+	seen, ok := r.lastSeen[address]
+	if current, exists := r.peers[peer.GetId()]; exists && current.GetAddress() != address {
+		seen, ok = r.lastSeen[current.GetAddress()]
+		delete(r.lastSeen, current.GetAddress())
+	}
+	if !ok {
+		seen = time.Now()
+	}
+	r.peers[peer.GetId()] = peer
+	r.lastSeen[address] = seen
 }
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"sync"
+)
+
+// PeerEvents lets components react to peers coming and going, without
+// knowing about the component that noticed it.
+type PeerEvents interface {
+	OnPeerExpired(func(entity.Peer))
+	PeerExpired(entity.Peer)
+}
+
+type peerEvents struct {
+	lock            sync.Mutex
+	expiredHandlers []func(entity.Peer)
+}
+
+func NewPeerEvents() PeerEvents {
+	return &peerEvents{expiredHandlers: make([]func(entity.Peer), 0)}
+}
+
+// OnPeerExpired adds a handler to call when a peer has been silent for
+// too long and has been removed.
+func (e *peerEvents) OnPeerExpired(handler func(entity.Peer)) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.expiredHandlers = append(e.expiredHandlers, handler)
+}
+
+// PeerExpired calls the expired peer handlers with the given peer. The
+// handlers are called outside the lock, so that they may add handlers of
+// their own.
+func (e *peerEvents) PeerExpired(peer entity.Peer) {
+	e.lock.Lock()
+	handlers := append([]func(entity.Peer){}, e.expiredHandlers...)
+	e.lock.Unlock()
+	for _, handler := range handlers {
+		handler(peer)
+	}
+}
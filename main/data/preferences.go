@@ -1,10 +1,14 @@
 package data
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"echsylon/fudpucker/entity"
 	"echsylon/fudpucker/entity/utils"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 
 	"github.com/denisbrodbeck/machineid"
 	"github.com/google/uuid"
@@ -12,22 +16,25 @@ import (
 
 type Preferences interface {
 	GetHostId() (entity.Id, error)
-	GetBroadcastAddress() (string, error)
 	GetLocalAddress() (string, error)
+	GetBroadcastAddresses() ([]string, error)
+	GetKeyPair() (ed25519.PublicKey, ed25519.PrivateKey, error)
 }
 
 type preferences struct {
-	cachedBroadcastAddress string
-	cachedLocalAddress     string
-	cachedMachineId        entity.Id
-	httpPort               int
-	udpPort                int
+	cachedLocalAddress string
+	cachedMachineId    entity.Id
+	cachedPrivateKey   ed25519.PrivateKey
+	identityPath       string
+	httpPort           int
+	udpPort            int
 }
 
-func NewPreferences(requestPort int, messagePort int) Preferences {
+func NewPreferences(requestPort int, messagePort int, identityPath string) Preferences {
 	return &preferences{
-		httpPort: requestPort,
-		udpPort:  messagePort,
+		httpPort:     requestPort,
+		udpPort:      messagePort,
+		identityPath: identityPath,
 	}
 }
 
@@ -49,32 +56,56 @@ func (r *preferences) GetHostId() (entity.Id, error) {
 	}
 }
 
-func (r *preferences) GetBroadcastAddress() (string, error) {
-	if r.cachedBroadcastAddress == "" {
-		if broadcast, local, err := findLocalUdpAddresses(); err != nil {
+func (r *preferences) GetLocalAddress() (string, error) {
+	if r.cachedLocalAddress == "" {
+		if local, err := findLocalUdpAddress(); err != nil {
 			return "", err
 		} else {
-			r.cachedBroadcastAddress = fmt.Sprintf("%s:%d", broadcast, r.udpPort)
 			r.cachedLocalAddress = fmt.Sprintf("%s:%d", local, r.udpPort)
 		}
 	}
-	return r.cachedBroadcastAddress, nil
+	return r.cachedLocalAddress, nil
 }
 
-func (r *preferences) GetLocalAddress() (string, error) {
-	if r.cachedLocalAddress == "" {
-		broadcast, local, err := findLocalUdpAddresses()
-		if err != nil {
-			return "", err
+// GetBroadcastAddresses returns the directed broadcast address, including
+// our port, of the subnet of each of our IPv4 interfaces. Interfaces are
+// looked up every time, as they may come and go while we're running.
+func (r *preferences) GetBroadcastAddresses() ([]string, error) {
+	if broadcasts, err := findSubnetBroadcastAddresses(); err != nil {
+		return nil, err
+	} else {
+		result := make([]string, len(broadcasts))
+		for index, broadcast := range broadcasts {
+			result[index] = fmt.Sprintf("%s:%d", broadcast, r.udpPort)
+		}
+		return result, nil
+	}
+}
+
+// GetKeyPair returns the signing key pair of this host. The private key
+// seed is persisted at the identity path so that our peers, which pin the
+// first public key they see for us, will still trust us after a restart.
+func (r *preferences) GetKeyPair() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	if r.cachedPrivateKey == nil {
+		if seed, err := os.ReadFile(r.identityPath); err == nil && len(seed) == ed25519.SeedSize {
+			r.cachedPrivateKey = ed25519.NewKeyFromSeed(seed)
+		} else if _, private, err := ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, nil, err
+		} else if err := os.MkdirAll(filepath.Dir(r.identityPath), 0700); err != nil {
+			return nil, nil, err
+		} else if err := os.WriteFile(r.identityPath, private.Seed(), 0600); err != nil {
+			return nil, nil, err
 		} else {
-			r.cachedBroadcastAddress = fmt.Sprintf("%s:%d", broadcast, r.udpPort)
-			r.cachedLocalAddress = fmt.Sprintf("%s:%d", local, r.udpPort)
+			r.cachedPrivateKey = private
 		}
 	}
-	return r.cachedLocalAddress, nil
+	return r.cachedPrivateKey.Public().(ed25519.PublicKey), r.cachedPrivateKey, nil
 }
 
-func findLocalUdpAddresses() (broadcast string, local string, err error) {
+// findLocalUdpAddress returns the first private IPv4 address of our
+// interfaces. Interface addresses are never multicast addresses, those
+// are groups for the UDP server to join.
+func findLocalUdpAddress() (local string, err error) {
 	var interfaceAddresses []net.Addr
 	if interfaceAddresses, err = net.InterfaceAddrs(); err != nil {
 		return
@@ -87,14 +118,41 @@ func findLocalUdpAddresses() (broadcast string, local string, err error) {
 			continue
 		} else if ip4.IsLoopback() {
 			continue
-		} else if ip4.IsMulticast() && broadcast == "" {
-			broadcast = ip4.String()
-		} else if ip4.IsPrivate() && local == "" {
+		} else if ip4.IsPrivate() {
 			local = ip4.String()
+			break
 		}
+	}
 
-		if broadcast != "" && local != "" {
-			break
+	return
+}
+
+// findSubnetBroadcastAddresses returns the directed broadcast address of
+// the subnet of each IPv4 interface address, being the address with all
+// host bits set. Point to point links (/31 and /32) have no broadcast
+// address and are skipped.
+func findSubnetBroadcastAddresses() (broadcasts []string, err error) {
+	var interfaceAddresses []net.Addr
+	if interfaceAddresses, err = net.InterfaceAddrs(); err != nil {
+		return
+	}
+
+	for _, address := range interfaceAddresses {
+		if ip, ok := address.(*net.IPNet); !ok {
+			continue
+		} else if ip4 := ip.IP.To4(); ip4 == nil {
+			continue
+		} else if ip4.IsLoopback() {
+			continue
+		} else if ones, bits := ip.Mask.Size(); bits != 8*net.IPv4len || ones > bits-2 {
+			continue
+		} else {
+			mask := net.IP(ip.Mask).To4()
+			broadcast := make(net.IP, net.IPv4len)
+			for index := range broadcast {
+				broadcast[index] = ip4[index] | ^mask[index]
+			}
+			broadcasts = append(broadcasts, broadcast.String())
 		}
 	}
 
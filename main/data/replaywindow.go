@@ -0,0 +1,65 @@
+package data
+
+import (
+	"echsylon/fudpucker/entity"
+	"sync"
+)
+
+type ReplayWindow interface {
+	Admit(entity.Id, entity.Id) bool
+	Reset()
+}
+
+// senderWindow holds the most recently seen message ids from one sender,
+// with the oldest one first.
+type senderWindow struct {
+	order []entity.Id
+	seen  map[entity.Id]struct{}
+}
+
+type replayWindow struct {
+	lock    sync.Mutex
+	size    int
+	senders map[entity.Id]*senderWindow
+}
+
+const replayWindowSize = 1024
+
+func NewReplayWindow() ReplayWindow {
+	return &replayWindow{
+		size:    replayWindowSize,
+		senders: make(map[entity.Id]*senderWindow),
+	}
+}
+
+// Admit remembers the given message id for the given sender. Returns false
+// if the id is already among the ids most recently seen from the sender.
+// Unlike the message cache, the window doesn't forget ids over time, only
+// when the sender has sent enough newer messages.
+func (w *replayWindow) Admit(senderId entity.Id, messageId entity.Id) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	window, ok := w.senders[senderId]
+	if !ok {
+		window = &senderWindow{seen: make(map[entity.Id]struct{})}
+		w.senders[senderId] = window
+	}
+
+	if _, seen := window.seen[messageId]; seen {
+		return false
+	}
+
+	if len(window.order) >= w.size {
+		delete(window.seen, window.order[0])
+		window.order = window.order[1:]
+	}
+	window.order = append(window.order, messageId)
+	window.seen[messageId] = struct{}{}
+	return true
+}
+
+func (w *replayWindow) Reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	clear(w.senders)
+}
@@ -4,6 +4,7 @@ import (
 	"echsylon/fudpucker/entity"
 	"echsylon/fudpucker/entity/unit"
 	"errors"
+	"math"
 )
 
 func NewCreateDeviceUseCase(
@@ -58,7 +59,7 @@ func NewCheckIfNewerUseCase(
 func NewGetHostInfoUseCase(
 	getHostId func() (entity.Id, error),
 	getLocalAddress func() (string, error),
-	getBroadcastAddress func() (string, error),
+	getGroupAddress func() string,
 ) func() (entity.Host, error) {
 
 	return func() (entity.Host, error) {
@@ -66,77 +67,118 @@ func NewGetHostInfoUseCase(
 			return nil, err
 		} else if address, err := getLocalAddress(); err != nil {
 			return nil, err
-		} else if broadcast, err := getBroadcastAddress(); err != nil {
-			return nil, err
 		} else {
-			return entity.NewHost(id, address, broadcast), err
+			return entity.NewHost(id, address, getGroupAddress()), err
 		}
 	}
 }
 
+// NewPatchStateUseCase returns a function that changes the state of a
+// device. If we own the device the state is changed immediately, otherwise
+// a patch is sent to the owner and the id of the patch message is returned.
 func NewPatchStateUseCase(
 	checkIfOwner func(entity.Id) (bool, error),
 	getDevice func(entity.Id) (entity.Device, error),
 	saveData func(entity.Id, entity.DeviceState, int) error,
 	createSyncMessage func(entity.Device) (entity.Message, error),
 	createPatchMessage func(entity.Id, entity.DeviceState) (entity.Message, error),
+	getVersion func(entity.Id) (int, error),
+	queuePatch func(entity.Message, entity.Id, entity.DeviceState, int),
+	getFanout func(entity.MessageType) int,
 	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	getSyncPeers func(entity.Id, int) ([]entity.Peer, error),
 	sendMessage func(entity.Peer, entity.Message) error,
-) func(entity.Id, entity.DeviceState) error {
+) func(entity.Id, entity.DeviceState) (entity.Id, error) {
 
-	return func(deviceId entity.Id, newState entity.DeviceState) error {
+	return func(deviceId entity.Id, newState entity.DeviceState) (entity.Id, error) {
 		var message entity.Message = nil
+		var patchId entity.Id = entity.ZeroId
+		var getPeers = getRandomPeers
 		var isOwner, err = checkIfOwner(deviceId)
 		if err != nil || !isOwner {
 			// Not our device. Create a message requesting the owner to update it.
 			if message, err = createPatchMessage(deviceId, newState); err != nil {
-				return err
+				return entity.ZeroId, err
+			}
+
+			// Keep retransmitting the patch until the owner replies to
+			// it or we see a newer version of the device.
+			version, err := getVersion(deviceId)
+			if err != nil {
+				version = -1
 			}
+			queuePatch(message, deviceId, newState, version)
+			patchId = message.GetId()
 		} else {
 			// This is our device. Update it and create a sync message.
 			if device, err := getDevice(deviceId); err != nil {
-				return err
+				return entity.ZeroId, err
 			} else if err := saveData(deviceId, newState, device.GetVersion()+1); err != nil {
-				return err
+				return entity.ZeroId, err
 			} else if updatedDevice, err := getDevice(deviceId); err != nil {
-				return err
+				return entity.ZeroId, err
 			} else if message, err = createSyncMessage(updatedDevice); err != nil {
-				return err
+				return entity.ZeroId, err
 			}
+			getPeers = getSyncPeers
 		}
 
-		// Propagate the message (whichever it is) to a random set of peers.
-		peers, err := getRandomPeers(entity.ZeroId, unit.MinInt)
+		// Propagate the message (whichever it is) to a set of peers.
+		peers, err := getPeers(message.GetId(), getFanout(message.GetType()))
 		if err != nil {
-			return err
+			return entity.ZeroId, err
 		}
 
 		for _, peer := range peers {
 			sendMessage(peer, message)
 		}
 
-		return nil
+		return patchId, nil
 	}
 }
 
-const defaultRandomPeerCount = 5
+// FanoutAll is the fanout of message types sent to all our peers.
+const FanoutAll = unit.MaxInt
+
+// NewGetFanoutUseCase returns a function that tells how many random peers
+// to send messages of a given type to. Patch replies are sent like
+// patches, and types without a fanout of their own like syncs. In
+// adaptive mode the fanout is ln(N) + c, rounded up, N being the number of
+// peers we know of, for all types but those sent to all peers.
+func NewGetFanoutUseCase(
+	fanouts map[entity.MessageType]int,
+	isAdaptive bool,
+	adaptiveConstant int,
+	getAllPeers func() []entity.Peer,
+) func(entity.MessageType) int {
+
+	return func(messageType entity.MessageType) int {
+		switch messageType {
+		case entity.MessageTypeEventPatchReply:
+			messageType = entity.MessageTypeCommandPatch
+		}
+
+		fanout, ok := fanouts[messageType]
+		if !ok {
+			fanout = fanouts[entity.MessageTypeEventSync]
+		}
+
+		if !isAdaptive || fanout == FanoutAll {
+			return fanout
+		} else if peerCount := len(getAllPeers()); peerCount == 0 {
+			return 0
+		} else {
+			return max(1, int(math.Ceil(math.Log(float64(peerCount))))+adaptiveConstant)
+		}
+	}
+}
 
 func NewRandomSafePeersForMessageUseCase(
-	getHostId func() (entity.Id, error),
-	getBroadcastAddress func() (string, error),
 	getAllPeers func() []entity.Peer,
 	isPeerInQuarantine func(entity.Id, entity.Id) bool,
 ) func(entity.Id, int) ([]entity.Peer, error) {
 
 	return func(messageId entity.Id, peerCount int) ([]entity.Peer, error) {
-		// If the network supports multicast UDP protocol, and we can
-		// successfully get the broadcast address, then return it alone.
-		if address, err := getBroadcastAddress(); err != nil && address != "" {
-			if hostId, err := getHostId(); err != nil {
-				return []entity.Peer{entity.NewPeer(hostId, address)}, nil
-			}
-		}
-
 		// We're (ab)using the map implementation in Go here. The runtime
 		// will take active measures to distort the insertion order when
 		// iterating over the keys, hence they will be returned in random
@@ -155,7 +197,7 @@ func NewRandomSafePeersForMessageUseCase(
 		resultCount := peerCount
 
 		if peerCount <= 0 {
-			resultCount = defaultRandomPeerCount
+			resultCount = 0
 		}
 
 		if safePeerCount < resultCount {
@@ -177,3 +219,50 @@ func NewRandomSafePeersForMessageUseCase(
 		return result, nil
 	}
 }
+
+// NewGroupOrRandomPeersForMessageUseCase returns a function that picks
+// the multicast group, if we have joined one, as the receiver of a message,
+// reaching all peers listening to it at once. Peers that can't read what's
+// sent to the group are picked as well, to be sent their own copy.
+// Otherwise the receivers are picked by the given function. The group goes
+// by the zero id, as it's no peer of its own.
+func NewGroupOrRandomPeersForMessageUseCase(
+	getGroupAddress func() string,
+	getGroupDeafPeers func() []entity.Peer,
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+) func(entity.Id, int) ([]entity.Peer, error) {
+
+	return func(messageId entity.Id, peerCount int) ([]entity.Peer, error) {
+		if address := getGroupAddress(); address != "" {
+			return append([]entity.Peer{entity.NewPeer(entity.ZeroId, address)}, getGroupDeafPeers()...), nil
+		} else {
+			return getRandomPeers(messageId, peerCount)
+		}
+	}
+}
+
+// NewEagerPeersForMessageUseCase returns a function that picks the peers
+// to push a message to along the broadcast tree. The message is pushed to
+// the eager push peers not known to have it already, and announced to the
+// lazy push peers. The fanout doesn't apply, as the tree decides.
+func NewEagerPeersForMessageUseCase(
+	getAllPeers func() []entity.Peer,
+	isLazy func(entity.Id) bool,
+	isPeerInQuarantine func(entity.Id, entity.Id) bool,
+	announce func(entity.Id, entity.Peer),
+) func(entity.Id, int) ([]entity.Peer, error) {
+
+	return func(messageId entity.Id, _ int) ([]entity.Peer, error) {
+		result := make([]entity.Peer, 0)
+		for _, peer := range getAllPeers() {
+			if isPeerInQuarantine(messageId, peer.GetId()) {
+				continue
+			} else if isLazy(peer.GetId()) {
+				announce(messageId, peer)
+			} else {
+				result = append(result, peer)
+			}
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"echsylon/fudpucker/entity"
+	"echsylon/fudpucker/message"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/echsylon/go-args"
+)
+
+const decodeCommand = "decode"
+
+// runDecodeCommand reads a raw datagram, as hex or binary, from a file or
+// stdin and prints what it holds as JSON.
+func runDecodeCommand() int {
+	args.SetApplicationDescription("Decodes a raw message datagram, given as hex or binary, and prints it as JSON.")
+	args.DefineOptionStrict("f", "file", "The file to read the datagram from. Default: stdin", "")
+	args.DefineOptionStrict("k", "network-key", "The pre-shared key the datagram is encrypted with. Default: none", "")
+	args.DefineOptionHelp("h", "help", "Prints this help text.")
+
+	args.Parse()
+
+	path := args.GetOptionValue("f", "")
+	networkKey := args.GetOptionValue("k", "")
+
+	input, err := readDecodeInput(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed reading datagram: %s\n", err)
+		return 1
+	}
+
+	var networkCipher cipher.AEAD = nil
+	if networkKey != "" {
+		if networkCipher, err = message.NewNetworkCipher(networkKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed setting up network encryption: %s\n", err)
+			return 1
+		}
+	}
+
+	// Keys can't be pinned here, so any key that verifies the signature will do.
+	acceptAnyKey := func(entity.Id, ed25519.PublicKey) bool { return true }
+	describeFrame := message.NewFrameDescriber(
+		networkCipher,
+		message.NewMessageVerifier(acceptAnyKey),
+		message.NewHailMessageReader(),
+		message.NewPatchMessageReader(),
+		message.NewSyncMessageReader(),
+		message.NewPeerMessageReader(),
+		message.NewPatchReplyMessageReader(),
+		message.NewDigestMessageReader(),
+		message.NewTreeNodesMessageReader(),
+		message.NewTreeLeavesMessageReader(),
+		message.NewPingMessageReader(),
+		message.NewPingRequestMessageReader(),
+		message.NewPingAckMessageReader(),
+		message.NewMembershipMessageReader(),
+		message.NewIHaveMessageReader(),
+		message.NewGraftMessageReader(),
+		message.NewJoinMessageReader(),
+		message.NewForwardJoinMessageReader(),
+		message.NewNeighborMessageReader(),
+		message.NewNeighborReplyMessageReader(),
+		message.NewShuffleMessageReader(),
+		message.NewShuffleReplyMessageReader(),
+	)
+
+	description, err := describeFrame(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed decoding datagram: %s\n", err)
+		return 1
+	}
+
+	output, err := json.MarshalIndent(description, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed rendering datagram: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(string(output))
+	return 0
+}
+
+// readDecodeInput reads all of the given file, or stdin if no file is
+// given. Input consisting of hex digits only, whitespace aside, is hex
+// decoded.
+func readDecodeInput(path string) ([]byte, error) {
+	var input []byte
+	var err error
+	if path == "" || path == "-" {
+		input, err = io.ReadAll(os.Stdin)
+	} else {
+		input, err = os.ReadFile(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	digits := bytes.Join(bytes.Fields(input), nil)
+	if decoded, err := hex.DecodeString(string(digits)); err == nil && len(decoded) > 0 {
+		return decoded, nil
+	} else {
+		return input, nil
+	}
+}
@@ -13,12 +13,17 @@ const (
 	DeviceStateOn
 )
 
+func (s DeviceState) IsValid() bool {
+	return s == DeviceStateOff || s == DeviceStateOn
+}
+
 type Device interface {
 	GetId() Id
 	GetOwner() Id
 	GetType() DeviceType
 	GetState() DeviceState
 	GetVersion() int
+	GetExtraAttributes() map[byte][]byte
 }
 
 type device struct {
@@ -27,6 +32,7 @@ type device struct {
 	deviceType   DeviceType
 	deviceState  DeviceState
 	stateVersion int
+	extras       map[byte][]byte
 }
 
 func NewDevice(id Id, owner Id, deviceType DeviceType, deviceState DeviceState, version int) Device {
@@ -39,8 +45,23 @@ func NewDevice(id Id, owner Id, deviceType DeviceType, deviceState DeviceState,
 	}
 }
 
+// NewExtendedDevice creates a device which also carries attributes this
+// build doesn't know how to interpret, but which should be kept anyway.
+func NewExtendedDevice(id Id, owner Id, deviceType DeviceType, deviceState DeviceState, version int, extras map[byte][]byte) Device {
+	return &device{
+		id:           id,
+		deviceType:   deviceType,
+		deviceState:  deviceState,
+		stateVersion: version,
+		owner:        owner,
+		extras:       extras,
+	}
+}
+
 func (d *device) GetId() Id             { return d.id }
 func (d *device) GetOwner() Id          { return d.owner }
 func (d *device) GetType() DeviceType   { return d.deviceType }
 func (d *device) GetState() DeviceState { return d.deviceState }
 func (d *device) GetVersion() int       { return d.stateVersion }
+
+func (d *device) GetExtraAttributes() map[byte][]byte { return d.extras }
@@ -3,23 +3,23 @@ package entity
 type Host interface {
 	GetId() Id
 	GetLocalAddress() string
-	GetBroadcastAddress() string
+	GetMulticastAddress() string
 }
 
 type host struct {
 	id        Id
 	address   string
-	broadcast string
+	multicast string
 }
 
-func NewHost(id Id, address string, broadcast string) Host {
+func NewHost(id Id, address string, multicast string) Host {
 	return &host{
 		id:        id,
 		address:   address,
-		broadcast: broadcast,
+		multicast: multicast,
 	}
 }
 
 func (h *host) GetId() Id                   { return h.id }
 func (h *host) GetLocalAddress() string     { return h.address }
-func (h *host) GetBroadcastAddress() string { return h.broadcast }
+func (h *host) GetMulticastAddress() string { return h.multicast }
@@ -0,0 +1,57 @@
+package entity
+
+type MemberState byte
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberStateAlive:
+		return "alive"
+	case MemberStateSuspect:
+		return "suspect"
+	case MemberStateDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	MemberStateUnknown MemberState = iota
+	MemberStateAlive
+	MemberStateSuspect
+	MemberStateDead
+)
+
+func (s MemberState) IsValid() bool {
+	return s == MemberStateAlive || s == MemberStateSuspect || s == MemberStateDead
+}
+
+// A member is a peer as seen by the failure detector. The incarnation is
+// only ever increased by the member itself, to refute suspicions about it.
+type Member interface {
+	GetId() Id
+	GetAddress() string
+	GetState() MemberState
+	GetIncarnation() int
+}
+
+type member struct {
+	id          Id
+	address     string
+	state       MemberState
+	incarnation int
+}
+
+func NewMember(id Id, address string, state MemberState, incarnation int) Member {
+	return &member{
+		id:          id,
+		address:     address,
+		state:       state,
+		incarnation: incarnation,
+	}
+}
+
+func (m *member) GetId() Id             { return m.id }
+func (m *member) GetAddress() string    { return m.address }
+func (m *member) GetState() MemberState { return m.state }
+func (m *member) GetIncarnation() int   { return m.incarnation }
@@ -0,0 +1,27 @@
+package entity
+
+// The Merkle tree over the device keyspace has a fixed shape, known by all
+// hosts. Each node has MerkleTreeFanout children and the leaves, or
+// buckets, are found MerkleTreeDepth levels below the root. A device lives
+// in the bucket given by the leading bits of its id.
+const (
+	MerkleTreeFanout      = 16
+	MerkleTreeDepth       = 3
+	MerkleTreeBucketCount = MerkleTreeFanout * MerkleTreeFanout * MerkleTreeFanout
+	MerkleHashLength      = 32
+)
+
+// MerkleBucket returns the index of the bucket the given device lives in.
+func MerkleBucket(deviceId Id) int {
+	return int(deviceId[0])<<4 | int(deviceId[1])>>4
+}
+
+// MerkleNodeCount returns the number of nodes on the given level of the
+// tree, the root being on level 0.
+func MerkleNodeCount(level int) int {
+	count := 1
+	for ; level > 0; level-- {
+		count *= MerkleTreeFanout
+	}
+	return count
+}
@@ -1,11 +1,14 @@
 package entity
 
 import (
+	"crypto/ed25519"
 	"echsylon/fudpucker/entity/unit"
 	"echsylon/fudpucker/entity/utils"
+	"time"
 )
 
 type MessageType byte
+type MessageEncoding byte
 
 func (t MessageType) String() string {
 	switch t {
@@ -19,6 +22,46 @@ func (t MessageType) String() string {
 		return "EventPeer"
 	case MessageTypeEventFarewell:
 		return "EventFarewell"
+	case MessageTypeEventPatchReply:
+		return "EventPatchReply"
+	case MessageTypeEventDigest:
+		return "EventDigest"
+	case MessageTypeEventTreeNodes:
+		return "EventTreeNodes"
+	case MessageTypeEventTreeLeaves:
+		return "EventTreeLeaves"
+	case MessageTypeEventPing:
+		return "EventPing"
+	case MessageTypeEventPingRequest:
+		return "EventPingRequest"
+	case MessageTypeEventPingAck:
+		return "EventPingAck"
+	case MessageTypeEventMembership:
+		return "EventMembership"
+	case MessageTypeEventIHave:
+		return "EventIHave"
+	case MessageTypeEventGraft:
+		return "EventGraft"
+	case MessageTypeEventPrune:
+		return "EventPrune"
+	case MessageTypeEventJoin:
+		return "EventJoin"
+	case MessageTypeEventForwardJoin:
+		return "EventForwardJoin"
+	case MessageTypeEventDisconnect:
+		return "EventDisconnect"
+	case MessageTypeEventNeighbor:
+		return "EventNeighbor"
+	case MessageTypeEventNeighborReply:
+		return "EventNeighborReply"
+	case MessageTypeEventShuffle:
+		return "EventShuffle"
+	case MessageTypeEventShuffleReply:
+		return "EventShuffleReply"
+	case MessageTypeEventHeartbeat:
+		return "EventHeartbeat"
+	case MessageTypeEventBeacon:
+		return "EventBeacon"
 	default:
 		return "unknown"
 	}
@@ -31,26 +74,76 @@ const (
 	MessageTypeEventSync
 	MessageTypeEventPeer
 	MessageTypeEventFarewell
+	MessageTypeEventPatchReply
+	MessageTypeEventDigest
+	MessageTypeEventTreeNodes
+	MessageTypeEventTreeLeaves
+	MessageTypeEventPing
+	MessageTypeEventPingRequest
+	MessageTypeEventPingAck
+	MessageTypeEventMembership
+	MessageTypeEventIHave
+	MessageTypeEventGraft
+	MessageTypeEventPrune
+	MessageTypeEventJoin
+	MessageTypeEventForwardJoin
+	MessageTypeEventDisconnect
+	MessageTypeEventNeighbor
+	MessageTypeEventNeighborReply
+	MessageTypeEventShuffle
+	MessageTypeEventShuffleReply
+	MessageTypeEventHeartbeat
+	MessageTypeEventBeacon
+)
+
+func (e MessageEncoding) String() string {
+	switch e {
+	case MessageEncodingBinary:
+		return "binary"
+	case MessageEncodingProtobuf:
+		return "protobuf"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	MessageEncodingBinary MessageEncoding = iota
+	MessageEncodingProtobuf
 )
 
 const (
-	SignatureLength  = 0
+	PublicKeyLength  = ed25519.PublicKeySize
+	SignatureLength  = ed25519.SignatureSize
 	MaxMessageLength = 1 * unit.MiB
+
+	// Messages from hosts that don't count hops are relayed as if they
+	// had all hops in the world left.
+	UnlimitedHops byte = 0xff
 )
 
 type Message interface {
 	GetId() Id
 	GetSender() Id
 	GetType() MessageType
+	GetEncoding() MessageEncoding
 	GetData() []byte
+	GetPublicKey() []byte
 	GetSignature() []byte
+	GetHops() byte
+	GetTimestamp() time.Time
 }
 
 type message struct {
 	id          Id
 	sender      Id
 	messageType MessageType
+	encoding    MessageEncoding
 	data        []byte
+	publicKey   []byte
+	signature   []byte
+	hops        byte
+	timestamp   time.Time
 }
 
 func NewMessage(id Id, sender Id, messageType MessageType, bytes []byte) Message {
@@ -62,10 +155,58 @@ func NewMessage(id Id, sender Id, messageType MessageType, bytes []byte) Message
 	}
 }
 
+func NewEncodedMessage(id Id, sender Id, messageType MessageType, encoding MessageEncoding, bytes []byte) Message {
+	return &message{
+		id:          id,
+		sender:      sender,
+		messageType: messageType,
+		encoding:    encoding,
+		data:        bytes,
+	}
+}
+
+func NewSignedMessage(id Id, sender Id, messageType MessageType, encoding MessageEncoding, bytes []byte, publicKey []byte, signature []byte, hops byte, timestamp time.Time) Message {
+	return &message{
+		id:          id,
+		sender:      sender,
+		messageType: messageType,
+		encoding:    encoding,
+		data:        bytes,
+		publicKey:   publicKey,
+		signature:   signature,
+		hops:        hops,
+		timestamp:   timestamp,
+	}
+}
+
+// NewRelayedMessage returns a copy of the given message with one hop less
+// left to travel. Messages without hops left are returned as they are.
+func NewRelayedMessage(source Message) Message {
+	hops := source.GetHops()
+	if hops > 0 {
+		hops--
+	}
+	return NewSignedMessage(
+		source.GetId(),
+		source.GetSender(),
+		source.GetType(),
+		source.GetEncoding(),
+		source.GetData(),
+		source.GetPublicKey(),
+		source.GetSignature(),
+		hops,
+		source.GetTimestamp(),
+	)
+}
+
 func (t MessageType) Bytes() []byte { return utils.ByteToBytes(byte(t)) }
 
-func (m *message) GetId() Id            { return m.id }
-func (m *message) GetSender() Id        { return m.sender }
-func (m *message) GetType() MessageType { return m.messageType }
-func (m *message) GetData() []byte      { return m.data[:len(m.data)-SignatureLength] }
-func (m *message) GetSignature() []byte { return m.data[len(m.data)-SignatureLength:] }
+func (m *message) GetId() Id                    { return m.id }
+func (m *message) GetSender() Id                { return m.sender }
+func (m *message) GetType() MessageType         { return m.messageType }
+func (m *message) GetEncoding() MessageEncoding { return m.encoding }
+func (m *message) GetData() []byte              { return m.data }
+func (m *message) GetPublicKey() []byte         { return m.publicKey }
+func (m *message) GetSignature() []byte         { return m.signature }
+func (m *message) GetHops() byte                { return m.hops }
+func (m *message) GetTimestamp() time.Time      { return m.timestamp }
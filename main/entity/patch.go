@@ -0,0 +1,97 @@
+package entity
+
+type PatchStatus byte
+
+func (s PatchStatus) String() string {
+	switch s {
+	case PatchStatusPending:
+		return "pending"
+	case PatchStatusSuperseded:
+		return "superseded"
+	case PatchStatusAbandoned:
+		return "abandoned"
+	case PatchStatusAccepted:
+		return "accepted"
+	case PatchStatusRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	PatchStatusPending PatchStatus = iota
+	PatchStatusSuperseded
+	PatchStatusAbandoned
+	PatchStatusAccepted
+	PatchStatusRejected
+)
+
+type Patch interface {
+	GetId() Id
+	GetDeviceId() Id
+	GetState() DeviceState
+	GetAttempts() int
+	GetStatus() PatchStatus
+	GetVersion() int
+	GetReason() string
+}
+
+type patch struct {
+	id       Id
+	deviceId Id
+	state    DeviceState
+	attempts int
+	status   PatchStatus
+	version  int
+	reason   string
+}
+
+func NewPatch(id Id, deviceId Id, state DeviceState, attempts int, status PatchStatus, version int, reason string) Patch {
+	return &patch{
+		id:       id,
+		deviceId: deviceId,
+		state:    state,
+		attempts: attempts,
+		status:   status,
+		version:  version,
+		reason:   reason,
+	}
+}
+
+func (p *patch) GetId() Id              { return p.id }
+func (p *patch) GetDeviceId() Id        { return p.deviceId }
+func (p *patch) GetState() DeviceState  { return p.state }
+func (p *patch) GetAttempts() int       { return p.attempts }
+func (p *patch) GetStatus() PatchStatus { return p.status }
+func (p *patch) GetVersion() int        { return p.version }
+func (p *patch) GetReason() string      { return p.reason }
+
+// The outcome of a patch, as reported by the device owner.
+type PatchOutcome interface {
+	GetPatchId() Id
+	IsAccepted() bool
+	GetVersion() int
+	GetReason() string
+}
+
+type patchOutcome struct {
+	patchId  Id
+	accepted bool
+	version  int
+	reason   string
+}
+
+func NewPatchOutcome(patchId Id, accepted bool, version int, reason string) PatchOutcome {
+	return &patchOutcome{
+		patchId:  patchId,
+		accepted: accepted,
+		version:  version,
+		reason:   reason,
+	}
+}
+
+func (o *patchOutcome) GetPatchId() Id    { return o.patchId }
+func (o *patchOutcome) IsAccepted() bool  { return o.accepted }
+func (o *patchOutcome) GetVersion() int   { return o.version }
+func (o *patchOutcome) GetReason() string { return o.reason }
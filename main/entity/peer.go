@@ -1,5 +1,7 @@
 package entity
 
+import "time"
+
 type Peer interface {
 	GetId() Id
 	GetAddress() string
@@ -19,3 +21,32 @@ func NewPeer(id Id, address string) Peer {
 
 func (p *peer) GetId() Id          { return p.id }
 func (p *peer) GetAddress() string { return p.address }
+
+// A signed peer is a peer record signed by the peer it describes, so that
+// it can be shared by other hosts without having to trust them about it.
+type SignedPeer interface {
+	Peer
+	GetTimestamp() time.Time
+	GetPublicKey() []byte
+	GetSignature() []byte
+}
+
+type signedPeer struct {
+	peer
+	timestamp time.Time
+	publicKey []byte
+	signature []byte
+}
+
+func NewSignedPeer(id Id, address string, timestamp time.Time, publicKey []byte, signature []byte) SignedPeer {
+	return &signedPeer{
+		peer:      peer{id: id, address: address},
+		timestamp: timestamp,
+		publicKey: publicKey,
+		signature: signature,
+	}
+}
+
+func (p *signedPeer) GetTimestamp() time.Time { return p.timestamp }
+func (p *signedPeer) GetPublicKey() []byte    { return p.publicKey }
+func (p *signedPeer) GetSignature() []byte    { return p.signature }
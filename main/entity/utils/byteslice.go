@@ -25,11 +25,12 @@ func StringToBytes(value string) []byte {
 }
 
 func BytesToBool(data []byte) bool {
-	if len(data) == 0 { // handles nil too
-		return false
-	} else {
-		return binary.BigEndian.Uint64(data) != uint64(0)
+	for _, value := range data { // handles nil too
+		if value != 0 {
+			return true
+		}
 	}
+	return false
 }
 
 func BytesToByte(data []byte) byte {
@@ -43,6 +44,10 @@ func BytesToByte(data []byte) byte {
 func BytesToInt64(data []byte) int64 {
 	if len(data) == 0 { // handles nil too
 		return int64(0)
+	} else if len(data) < 8 { // pads short data rather than panicking
+		padded := make([]byte, 8)
+		copy(padded[8-len(data):], data)
+		return int64(binary.BigEndian.Uint64(padded))
 	} else {
 		value := binary.BigEndian.Uint64(data)
 		return int64(value)
@@ -8,6 +8,9 @@ require (
 	github.com/echsylon/go-args v1.0.0
 	github.com/echsylon/go-log v0.1.0
 	github.com/google/uuid v1.6.0
+	golang.org/x/crypto v0.27.0
+	golang.org/x/net v0.29.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
@@ -21,8 +24,6 @@ require (
 	github.com/klauspost/compress v1.17.10 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	go.opencensus.io v0.24.0 // indirect
-	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 	golang.org/x/term v0.24.0 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -2,27 +2,96 @@ package main
 
 import (
 	context "context"
+	cipher "crypto/cipher"
 	data "echsylon/fudpucker/data"
+	entity "echsylon/fudpucker/entity"
 	message "echsylon/fudpucker/message"
 	request "echsylon/fudpucker/request"
 	signal "os/signal"
+	atomic "sync/atomic"
 	syscall "syscall"
+	time "time"
 
 	"github.com/echsylon/go-log"
 )
 
 type Controller interface {
-	SetupInfrastructure(apiServerPort int, messageServerPort int)
+	SetupInfrastructure(settings Settings)
 	StartApiServer()
 }
 
+type Settings struct {
+	ApiServerPort     int
+	MessageServerPort int
+	MaxDatagramSize   int
+	NetworkKey        string
+	InitialHopCount   int
+	MessageEncoding   entity.MessageEncoding
+	MaxClockSkew      time.Duration
+	CapturePath       string
+	ReplayPath        string
+	ReplaySpeed       float64
+	ReplayLive        bool
+	DigestInterval    time.Duration
+	UseMerkleTree     bool
+	ProbeInterval     time.Duration
+	SuspicionTimeout  time.Duration
+	Fanouts           map[entity.MessageType]int
+	AdaptiveFanout    bool
+	FanoutConstant    int
+	RumorMongering    bool
+	RumorFeedback     int
+	RumorRounds       int
+	UsePlumtree       bool
+	UsePartialView    bool
+	ActiveViewSize    int
+	PassiveViewSize   int
+	HeartbeatInterval time.Duration
+	PeerExpiry        time.Duration
+	MulticastGroup    string
+	BeaconInterval    time.Duration
+}
+
+const (
+	retransmitInterval = 250 * time.Millisecond
+	rumorInterval      = time.Second
+	announceInterval   = 200 * time.Millisecond
+	graftTimeout       = time.Second
+	maxAnnouncedIds    = 64
+	pingAckTimeout     = 300 * time.Millisecond
+	indirectProbeCount = 3
+	sharedPeerCount    = 8
+	repairInterval     = time.Second
+	neighborTimeout    = 2 * time.Second
+	shuffleInterval    = 10 * time.Second
+	activeWalkLength   = 6
+	passiveWalkLength  = 3
+	activeShuffleSize  = 3
+	passiveShuffleSize = 4
+	expiryInterval     = time.Second
+)
+
 type controller struct {
 	mainContext      context.Context
 	shutdownFunction context.CancelFunc
+	networkContext   context.Context
+	leaveFunction    context.CancelFunc
 	properties       data.Preferences
 	database         data.Database
+	tree             data.MerkleTree
 	peers            data.PeerCache
+	view             data.PartialView
+	events           data.PeerEvents
+	members          data.MemberList
+	broadcastTree    data.BroadcastTree
+	keys             data.KeyCache
+	replays          data.ReplayWindow
 	cache            data.MessageCache
+	patches          data.PatchQueue
+	outcomes         data.PatchOutcomes
+	fragments        message.ReassemblyBuffer
+	capture          message.CaptureFile
+	replaying        atomic.Bool
 	udp              message.UdpServer
 	api              request.HttpServer
 }
@@ -35,13 +104,33 @@ func NewController() Controller {
 	}
 }
 
-func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort int) {
+func (c *controller) SetupInfrastructure(settings Settings) {
+	apiServerPort := settings.ApiServerPort
+	messageServerPort := settings.MessageServerPort
+
 	// Infrastructure
-	c.properties = data.NewPreferences(apiServerPort, messageServerPort)
-	c.database = data.NewDiskDatabase("./data/internal/database")
+	c.properties = data.NewPreferences(apiServerPort, messageServerPort, "./data/internal/identity")
+	c.tree = data.NewMerkleTree()
+	c.database = data.NewMerkleDatabase(data.NewDiskDatabase("./data/internal/database"), c.tree)
 	c.peers = data.NewPeerCache()
-	c.cache = data.NewMessageCache()
-	c.udp = message.NewUdpServer(messageServerPort)
+	if settings.UsePartialView {
+		c.view = data.NewPartialView(c.peers, settings.ActiveViewSize, settings.PassiveViewSize)
+		c.peers = c.view
+	}
+	c.events = data.NewPeerEvents()
+	c.members = data.NewMemberList()
+	c.broadcastTree = data.NewBroadcastTree()
+	c.keys = data.NewKeyCache()
+	c.replays = data.NewReplayWindow()
+	if settings.RumorMongering {
+		c.cache = data.NewRumorCache(settings.RumorFeedback, settings.RumorRounds)
+	} else {
+		c.cache = data.NewMessageCache()
+	}
+	c.patches = data.NewPatchQueue()
+	c.outcomes = data.NewPatchOutcomes()
+	c.fragments = message.NewReassemblyBuffer()
+	c.udp = message.NewUdpServer(messageServerPort, settings.MulticastGroup)
 	c.api = request.NewHttpServer(c.mainContext, apiServerPort)
 
 	// Adapters and handlers
@@ -52,15 +141,118 @@ func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort in
 	devicePersister := data.NewCreateDeviceDataAdapter(c.database.Set)
 	statePersister := data.NewPatchStateDataAdapter(c.database.Set)
 
-	patchMessageProvider := message.NewPatchMessageProvider(c.properties.GetHostId)
+	messageEncoding := settings.MessageEncoding
+	patchMessageProvider := message.NewPatchMessageProvider(c.properties.GetHostId, messageEncoding)
+	patchRetransmissionMessageProvider := message.NewPatchRetransmissionMessageProvider(c.properties.GetHostId, messageEncoding)
 	patchMessageReader := message.NewPatchMessageReader()
-	syncMessageProvider := message.NewSyncMessageProvider(c.properties.GetHostId)
+	syncMessageProvider := message.NewSyncMessageProvider(c.properties.GetHostId, messageEncoding)
 	syncMessageReader := message.NewSyncMessageReader()
-	peerMessageProvider := message.NewPeerMessageProvider(c.properties.GetHostId)
+	peerMessageProvider := message.NewPeerMessageProvider(c.properties.GetHostId, messageEncoding)
 	peerMessageReader := message.NewPeerMessageReader()
-	hailMessageProvider := message.NewHailMessageProvider(c.properties.GetHostId)
-	farewellMessageProvider := message.NewFarewellMessageProvider(c.properties.GetHostId)
-	sendMessageHandler := message.NewSendMessageHandler(c.udp.Send, c.cache.Hold)
+	patchReplyMessageProvider := message.NewPatchReplyMessageProvider(c.properties.GetHostId, messageEncoding)
+	patchReplyMessageReader := message.NewPatchReplyMessageReader()
+	hailMessageProvider := message.NewHailMessageProvider(c.properties.GetHostId, messageEncoding)
+	digestMessageProvider := message.NewDigestMessageProvider(c.properties.GetHostId, messageEncoding)
+	digestMessageReader := message.NewDigestMessageReader()
+	treeNodesMessageProvider := message.NewTreeNodesMessageProvider(c.properties.GetHostId, messageEncoding)
+	treeNodesMessageReader := message.NewTreeNodesMessageReader()
+	treeLeavesMessageProvider := message.NewTreeLeavesMessageProvider(c.properties.GetHostId, messageEncoding)
+	treeLeavesMessageReader := message.NewTreeLeavesMessageReader()
+	pingMessageProvider := message.NewPingMessageProvider(c.properties.GetHostId, messageEncoding)
+	pingMessageReader := message.NewPingMessageReader()
+	pingRequestMessageProvider := message.NewPingRequestMessageProvider(c.properties.GetHostId, messageEncoding)
+	pingRequestMessageReader := message.NewPingRequestMessageReader()
+	pingAckMessageProvider := message.NewPingAckMessageProvider(c.properties.GetHostId, messageEncoding)
+	pingAckMessageReader := message.NewPingAckMessageReader()
+	membershipMessageProvider := message.NewMembershipMessageProvider(c.properties.GetHostId, messageEncoding)
+	membershipMessageReader := message.NewMembershipMessageReader()
+	iHaveMessageProvider := message.NewIHaveMessageProvider(c.properties.GetHostId, messageEncoding)
+	iHaveMessageReader := message.NewIHaveMessageReader()
+	graftMessageProvider := message.NewGraftMessageProvider(c.properties.GetHostId, messageEncoding)
+	graftMessageReader := message.NewGraftMessageReader()
+	pruneMessageProvider := message.NewPruneMessageProvider(c.properties.GetHostId, messageEncoding)
+	joinMessageProvider := message.NewJoinMessageProvider(c.properties.GetHostId, messageEncoding)
+	joinMessageReader := message.NewJoinMessageReader()
+	forwardJoinMessageProvider := message.NewForwardJoinMessageProvider(c.properties.GetHostId, messageEncoding)
+	forwardJoinMessageReader := message.NewForwardJoinMessageReader()
+	disconnectMessageProvider := message.NewDisconnectMessageProvider(c.properties.GetHostId, messageEncoding)
+	neighborMessageProvider := message.NewNeighborMessageProvider(c.properties.GetHostId, messageEncoding)
+	neighborMessageReader := message.NewNeighborMessageReader()
+	neighborReplyMessageProvider := message.NewNeighborReplyMessageProvider(c.properties.GetHostId, messageEncoding)
+	neighborReplyMessageReader := message.NewNeighborReplyMessageReader()
+	shuffleMessageProvider := message.NewShuffleMessageProvider(c.properties.GetHostId, messageEncoding)
+	shuffleMessageReader := message.NewShuffleMessageReader()
+	shuffleReplyMessageProvider := message.NewShuffleReplyMessageProvider(c.properties.GetHostId, messageEncoding)
+	shuffleReplyMessageReader := message.NewShuffleReplyMessageReader()
+	heartbeatMessageProvider := message.NewHeartbeatMessageProvider(c.properties.GetHostId, messageEncoding)
+	beaconMessageProvider := message.NewBeaconMessageProvider(c.properties.GetHostId, messageEncoding)
+	farewellMessageProvider := message.NewFarewellMessageProvider(c.properties.GetHostId, messageEncoding)
+	messageSigner := message.NewMessageSigner(c.properties.GetKeyPair, byte(settings.InitialHopCount))
+	messageVerifier := message.NewMessageVerifier(c.keys.PinKey)
+	peerRecordSigner := message.NewPeerRecordSigner(c.properties.GetHostId, c.properties.GetLocalAddress, c.properties.GetKeyPair)
+	peerRecordVerifier := message.NewPeerRecordVerifier(c.keys.PinKey, settings.MaxClockSkew)
+	replayChecker := message.NewReplayChecker(c.replays.Admit, c.peers.GetPeerVersion, settings.MaxClockSkew)
+	hailMessageReader := message.NewHailMessageReader()
+	datagramSender := c.udp.Send
+	if settings.CapturePath != "" {
+		if capture, err := message.NewCaptureFile(settings.CapturePath); err != nil {
+			log.Critical("Failed creating capture file %s", settings.CapturePath)
+			panic(err)
+		} else {
+			c.capture = capture
+			datagramSender = message.NewCapturingSender(c.capture.Record, c.udp.Send)
+		}
+	}
+
+	// Replayed messages run through the live use cases, so unless asked
+	// otherwise, whatever they would send is dropped until the replay ends.
+	// Dropped datagrams are never sent, so they aren't captured either.
+	if settings.ReplayPath != "" && !settings.ReplayLive {
+		datagramSender = message.NewDryRunSender(c.replaying.Load, datagramSender)
+	}
+
+	// Encryption, when enabled, wraps each datagram as the outermost layer
+	// so that hosts without the network key can't read or inject anything.
+	maxDatagramSize := settings.MaxDatagramSize
+	var networkCipher cipher.AEAD = nil
+	if settings.NetworkKey != "" {
+		if aead, err := message.NewNetworkCipher(settings.NetworkKey); err != nil {
+			log.Critical("Failed setting up network encryption")
+			panic(err)
+		} else {
+			networkCipher = aead
+			datagramSender = message.NewEncryptingSender(networkCipher, datagramSender)
+			maxDatagramSize -= message.EncryptionOverhead
+		}
+	}
+
+	// With partial views, gossip only goes to the active view, but we say
+	// hello and goodbye to every peer we know of.
+	getKnownPeers := c.peers.GetAllPeers
+	if settings.UsePartialView {
+		getKnownPeers = c.view.GetKnownPeers
+	}
+	getPeerVersion := message.NewPeerVersionProvider(c.peers.GetPeerVersion, getKnownPeers)
+	fragmentingSender := message.NewFragmentingSender(datagramSender, maxDatagramSize)
+	sendMessageHandler := message.NewSendMessageHandler(messageSigner, getPeerVersion, fragmentingSender, c.cache.Hold)
+	sendMessagesHandler := message.NewSendMessagesHandler(
+		messageSigner,
+		getPeerVersion,
+		fragmentingSender,
+		c.cache.Hold,
+		maxDatagramSize,
+	)
+	hailSender := message.NewSendMessageHandler(
+		messageSigner,
+		message.NewHailVersionProvider(getPeerVersion, messageEncoding),
+		fragmentingSender,
+		c.cache.Hold,
+	)
+	rumorSender := message.NewRumorSender(c.cache.Spread, sendMessageHandler)
+	syncSender := rumorSender
+	if settings.UsePlumtree {
+		syncSender = message.NewEagerPushSender(c.broadcastTree.Keep, rumorSender)
+	}
 
 	// Usecases
 	createDeviceUseCase := data.NewCreateDeviceUseCase(c.properties.GetHostId, devicePersister)
@@ -69,22 +261,50 @@ func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort in
 	composeInfoUseCase := data.NewGetHostInfoUseCase(
 		c.properties.GetHostId,
 		c.properties.GetLocalAddress,
-		c.properties.GetBroadcastAddress,
+		c.udp.GetGroupAddress,
 	)
 	getRandomPeersUseCase := data.NewRandomSafePeersForMessageUseCase(
-		c.properties.GetHostId,
-		c.properties.GetBroadcastAddress,
 		c.peers.GetAllPeers,
 		c.cache.ContainsMessageForPeer,
 	)
+	getKnownPeersUseCase := data.NewRandomSafePeersForMessageUseCase(
+		getKnownPeers,
+		c.cache.ContainsMessageForPeer,
+	)
+	getSyncPeersUseCase := getRandomPeersUseCase
+	if settings.UsePlumtree {
+		getSyncPeersUseCase = data.NewEagerPeersForMessageUseCase(
+			c.peers.GetAllPeers,
+			c.broadcastTree.IsLazy,
+			c.cache.ContainsMessageForPeer,
+			c.broadcastTree.Announce,
+		)
+	}
+	// Hails and our own syncs go to the multicast group, if we have joined
+	// one, and to the peers too old to read what's sent to it. Relayed
+	// syncs go to random peers, which reaches the peers that aren't
+	// listening to the group.
+	getGroupDeafPeers := message.NewGroupDeafPeersProvider(c.peers.GetPeerVersion, getKnownPeers)
+	getHailPeersUseCase := data.NewGroupOrRandomPeersForMessageUseCase(c.udp.GetGroupAddress, getGroupDeafPeers, getKnownPeersUseCase)
+	getOwnSyncPeersUseCase := data.NewGroupOrRandomPeersForMessageUseCase(c.udp.GetGroupAddress, getGroupDeafPeers, getSyncPeersUseCase)
+	getFanoutUseCase := data.NewGetFanoutUseCase(
+		settings.Fanouts,
+		settings.AdaptiveFanout,
+		settings.FanoutConstant,
+		c.peers.GetAllPeers,
+	)
 	patchStateUseCase := data.NewPatchStateUseCase(
 		checkIfOwnerUseCase,
 		deviceProvider,
 		statePersister,
 		syncMessageProvider,
 		patchMessageProvider,
+		stateVersionProvider,
+		c.patches.Add,
+		getFanoutUseCase,
 		getRandomPeersUseCase,
-		sendMessageHandler,
+		getOwnSyncPeersUseCase,
+		syncSender,
 	)
 	updateStateUseCase := message.NewSaveStateUseCase(
 		patchMessageReader,
@@ -92,8 +312,13 @@ func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort in
 		deviceProvider,
 		statePersister,
 		syncMessageProvider,
+		patchReplyMessageProvider,
+		c.outcomes.Get,
+		c.outcomes.Put,
+		c.peers.GetPeer,
+		getFanoutUseCase,
 		getRandomPeersUseCase,
-		sendMessageHandler,
+		rumorSender,
 	)
 	updateDeviceUseCase := message.NewSaveDeviceUseCase(
 		checkIfOwnerUseCase,
@@ -101,71 +326,465 @@ func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort in
 		syncMessageReader,
 		devicePersister,
 		deviceProvider,
-		getRandomPeersUseCase,
+		getFanoutUseCase,
+		getSyncPeersUseCase,
 		syncMessageProvider,
-		sendMessageHandler,
+		c.patches.Supersede,
+		syncSender,
 	)
 	updatePeerUseCase := message.NewSavePeerUseCase(
 		peerMessageReader,
+		peerRecordVerifier,
+		c.properties.GetHostId,
 		c.peers.AddPeer,
+		c.peers.AddPeerRecord,
 	)
 	deletePeerUseCase := message.NewDeletePeerUseCase(
 		c.peers.RemovePeer,
 	)
-	saluteOnHailUseCase := message.NewSaluteOnHailUseCase(
+	resolvePatchUseCase := message.NewResolvePatchUseCase(
+		patchReplyMessageReader,
+		c.patches.Resolve,
+		getFanoutUseCase,
+		getRandomPeersUseCase,
+		rumorSender,
+	)
+	retransmitPatchesUseCase := message.NewRetransmitPatchesUseCase(
+		c.patches.GetDuePatches,
+		patchRetransmissionMessageProvider,
+		getFanoutUseCase,
+		getRandomPeersUseCase,
+		sendMessageHandler,
+	)
+	spreadRumorsUseCase := message.NewSpreadRumorsUseCase(
+		c.cache.GetHotRumors,
+		getFanoutUseCase,
+		getRandomPeersUseCase,
+		sendMessageHandler,
+	)
+	sendDigestUseCase := message.NewSendDigestUseCase(
 		deviceIdsProvider,
+		stateVersionProvider,
+		getRandomPeersUseCase,
+		digestMessageProvider,
+		sendMessageHandler,
+	)
+	reconcileDigestUseCase := message.NewReconcileDigestUseCase(
+		digestMessageReader,
+		deviceIdsProvider,
+		stateVersionProvider,
+		checkIfNewerUseCase,
 		deviceProvider,
+		digestMessageProvider,
+		syncMessageProvider,
+		sendMessagesHandler,
+	)
+	sendTreeRootUseCase := message.NewSendTreeRootUseCase(
+		c.tree.GetHash,
+		getRandomPeersUseCase,
+		treeNodesMessageProvider,
+		sendMessageHandler,
+	)
+	reconcileTreeNodesUseCase := message.NewReconcileTreeNodesUseCase(
+		treeNodesMessageReader,
+		c.tree.GetHash,
+		c.tree.GetBucket,
+		treeNodesMessageProvider,
+		treeLeavesMessageProvider,
+		sendMessageHandler,
+	)
+	reconcileTreeLeavesUseCase := message.NewReconcileTreeLeavesUseCase(
+		treeLeavesMessageReader,
+		c.tree.GetBucket,
+		checkIfNewerUseCase,
+		deviceProvider,
+		treeLeavesMessageProvider,
+		syncMessageProvider,
+		sendMessagesHandler,
+	)
+	spreadMembershipUseCase := message.NewSpreadMembershipUseCase(
+		membershipMessageProvider,
+		getFanoutUseCase,
+		getRandomPeersUseCase,
+		rumorSender,
+	)
+	// Indirect probes are given at least as long as direct ones, even if
+	// that makes a round outlast a short probe interval. The ticker then
+	// skips the rounds that are due while one is still running.
+	probeTimeout := max(settings.ProbeInterval*9/10, 2*pingAckTimeout)
+	probePeerUseCase := message.NewProbePeerUseCase(
+		c.peers.GetAllPeers,
+		c.peers.GetPeerVersion,
+		c.members.NextProbeTarget,
+		pingMessageProvider,
+		pingRequestMessageProvider,
+		c.members.ExpectAck,
+		c.members.AwaitAck,
+		c.members.Suspect,
+		spreadMembershipUseCase,
+		sendMessageHandler,
+		pingAckTimeout,
+		probeTimeout,
+		indirectProbeCount,
+	)
+	confirmSuspectsUseCase := message.NewConfirmSuspectsUseCase(
+		c.members.ConfirmSuspects,
+		c.peers.RemovePeer,
+		spreadMembershipUseCase,
+		settings.SuspicionTimeout,
+	)
+	sendHeartbeatsUseCase := message.NewSendHeartbeatsUseCase(
+		c.peers.GetAllPeers,
+		c.peers.GetPeerVersion,
+		heartbeatMessageProvider,
+		sendMessageHandler,
+	)
+	expireSilentPeersUseCase := message.NewExpireSilentPeersUseCase(
+		c.peers.GetSilentPeers,
+		c.peers.GetPeerVersion,
+		c.peers.RemovePeer,
+		c.events.PeerExpired,
+		settings.PeerExpiry,
+	)
+	answerPingUseCase := message.NewAnswerPingUseCase(
+		pingMessageReader,
+		c.properties.GetHostId,
+		pingAckMessageProvider,
+		sendMessageHandler,
+	)
+	relayPingUseCase := message.NewRelayPingUseCase(
+		pingRequestMessageReader,
+		pingMessageProvider,
+		c.members.ExpectAck,
+		sendMessageHandler,
+	)
+	acknowledgePingUseCase := message.NewAcknowledgePingUseCase(
+		pingAckMessageReader,
+		c.members.Acknowledge,
+		pingAckMessageProvider,
+		sendMessageHandler,
+	)
+	updateMembershipUseCase := message.NewUpdateMembershipUseCase(
+		membershipMessageReader,
+		c.properties.GetHostId,
+		c.properties.GetLocalAddress,
+		c.members.Refute,
+		c.members.Update,
+		c.peers.GetPeer,
+		c.peers.RemovePeer,
+		spreadMembershipUseCase,
+	)
+	shapeBroadcastTreeUseCase := message.NewShapeBroadcastTreeUseCase(
 		c.peers.GetAllPeers,
+		c.peers.GetPeerVersion,
+		c.cache.Hold,
+		c.broadcastTree.Received,
+		c.broadcastTree.Graft,
+		c.broadcastTree.Prune,
+		pruneMessageProvider,
+		sendMessageHandler,
+	)
+	if !settings.UsePlumtree {
+		shapeBroadcastTreeUseCase = func(string, entity.Message, bool) error { return nil }
+	}
+	announceMessagesUseCase := message.NewAnnounceMessagesUseCase(
+		c.broadcastTree.GetAnnouncements,
+		iHaveMessageProvider,
+		sendMessageHandler,
+		maxAnnouncedIds,
+	)
+	expectAnnouncedMessagesUseCase := message.NewExpectAnnouncedMessagesUseCase(
+		iHaveMessageReader,
+		c.cache.ContainsMessage,
+		c.broadcastTree.ExpectMessage,
+	)
+	requestMissingMessagesUseCase := message.NewRequestMissingMessagesUseCase(
+		c.broadcastTree.GetMissing,
+		c.broadcastTree.Graft,
+		graftMessageProvider,
+		sendMessageHandler,
+		graftTimeout,
+	)
+	answerGraftUseCase := message.NewAnswerGraftUseCase(
+		graftMessageReader,
+		c.broadcastTree.Graft,
+		c.broadcastTree.GetMessage,
+		sendMessageHandler,
+	)
+	acceptPruneUseCase := message.NewAcceptPruneUseCase(
+		c.broadcastTree.Prune,
+	)
+	var sendJoinUseCase, repairActiveViewUseCase, shufflePeersUseCase func() error
+	var acceptJoinUseCase, forwardJoinUseCase, acceptDisconnectUseCase func(string, entity.Message) error
+	var answerNeighborUseCase, acceptNeighborReplyUseCase func(string, entity.Message) error
+	var answerShuffleUseCase, acceptShuffleReplyUseCase func(string, entity.Message) error
+	if settings.UsePartialView {
+		sendJoinUseCase = message.NewSendJoinUseCase(
+			c.view.GetPassivePeers,
+			peerRecordSigner,
+			joinMessageProvider,
+			sendMessageHandler,
+		)
+		acceptJoinUseCase = message.NewAcceptJoinUseCase(
+			joinMessageReader,
+			peerRecordVerifier,
+			c.view.GetAllPeers,
+			c.view.Activate,
+			disconnectMessageProvider,
+			neighborReplyMessageProvider,
+			forwardJoinMessageProvider,
+			sendMessageHandler,
+			activeWalkLength,
+		)
+		forwardJoinUseCase = message.NewForwardJoinUseCase(
+			forwardJoinMessageReader,
+			peerRecordVerifier,
+			c.properties.GetHostId,
+			c.view.GetAllPeers,
+			c.view.Activate,
+			c.view.AddPassivePeers,
+			disconnectMessageProvider,
+			neighborReplyMessageProvider,
+			forwardJoinMessageProvider,
+			sendMessageHandler,
+			passiveWalkLength,
+		)
+		acceptDisconnectUseCase = message.NewAcceptDisconnectUseCase(
+			c.view.Deactivate,
+		)
+		answerNeighborUseCase = message.NewAnswerNeighborUseCase(
+			neighborMessageReader,
+			c.view.IsActiveViewFull,
+			c.view.Activate,
+			disconnectMessageProvider,
+			neighborReplyMessageProvider,
+			sendMessageHandler,
+		)
+		acceptNeighborReplyUseCase = message.NewAcceptNeighborReplyUseCase(
+			neighborReplyMessageReader,
+			c.view.NeighborReplied,
+			c.view.Activate,
+			disconnectMessageProvider,
+			sendMessageHandler,
+		)
+		repairActiveViewUseCase = message.NewRepairActiveViewUseCase(
+			c.view.DropUnresponsive,
+			c.view.IsActiveViewFull,
+			c.view.GetAllPeers,
+			c.view.GetPassivePeers,
+			c.view.ExpectNeighborReply,
+			neighborMessageProvider,
+			sendMessageHandler,
+			neighborTimeout,
+		)
+		shufflePeersUseCase = message.NewShufflePeersUseCase(
+			peerRecordSigner,
+			c.view.GetPeerRecord,
+			c.view.GetAllPeers,
+			c.view.GetPassivePeers,
+			shuffleMessageProvider,
+			sendMessageHandler,
+			activeShuffleSize,
+			passiveShuffleSize,
+			activeWalkLength,
+		)
+		answerShuffleUseCase = message.NewAnswerShuffleUseCase(
+			shuffleMessageReader,
+			peerRecordVerifier,
+			c.properties.GetHostId,
+			c.view.GetAllPeers,
+			c.view.GetPassivePeers,
+			c.view.GetPeerRecord,
+			c.view.AddPassivePeers,
+			shuffleMessageProvider,
+			shuffleReplyMessageProvider,
+			sendMessageHandler,
+		)
+		acceptShuffleReplyUseCase = message.NewAcceptShuffleReplyUseCase(
+			shuffleReplyMessageReader,
+			peerRecordVerifier,
+			c.properties.GetHostId,
+			c.view.AddPassivePeers,
+		)
+	} else {
+		// Hosts keeping full membership have no views to maintain.
+		ignoreMessage := func(string, entity.Message) error { return nil }
+		acceptJoinUseCase, forwardJoinUseCase, acceptDisconnectUseCase = ignoreMessage, ignoreMessage, ignoreMessage
+		answerNeighborUseCase, acceptNeighborReplyUseCase = ignoreMessage, ignoreMessage
+		answerShuffleUseCase, acceptShuffleReplyUseCase = ignoreMessage, ignoreMessage
+	}
+	saluteOnHailUseCase := message.NewSaluteOnHailUseCase(
+		hailMessageReader,
+		c.peers.SetPeerVersion,
+		deviceIdsProvider,
+		deviceProvider,
+		peerRecordSigner,
+		c.peers.GetPeerRecords,
 		c.peers.AddPeer,
 		syncMessageProvider,
 		peerMessageProvider,
-		sendMessageHandler,
+		sendMessagesHandler,
+		sharedPeerCount,
 	)
 	sendHailMessage := message.NewSendHailCommandUseCase(
-		getRandomPeersUseCase,
+		getFanoutUseCase,
+		getHailPeersUseCase,
 		hailMessageProvider,
 		deviceIdsProvider,
 		deviceProvider,
+		peerRecordSigner,
 		syncMessageProvider,
+		peerMessageProvider,
+		hailSender,
+		sendMessagesHandler,
+	)
+	sendBeaconsUseCase := message.NewSendBeaconsUseCase(
+		c.properties.GetBroadcastAddresses,
+		beaconMessageProvider,
+		sendMessageHandler,
+	)
+	answerBeaconUseCase := message.NewAnswerBeaconUseCase(
+		c.properties.GetHostId,
+		c.peers.AddPeer,
+		peerRecordSigner,
+		peerMessageProvider,
 		sendMessageHandler,
 	)
 	sendFarewellMessage := message.NewSendFarewellEventUseCase(
-		getRandomPeersUseCase,
+		getFanoutUseCase,
+		getKnownPeersUseCase,
 		farewellMessageProvider,
 		sendMessageHandler,
 	)
 
-	receivedMessageHandler := message.NewReceiveMessageHandler(
-		saluteOnHailUseCase,
-		updateStateUseCase,
-		updateDeviceUseCase,
-		updatePeerUseCase,
-		deletePeerUseCase,
-		c.cache.ContainsMessage,
-		c.cache.Hold,
-	)
+	// Replayed messages were signed when captured, so they would all fail
+	// the clock skew check, and they don't replay any better for passing
+	// through the replay window either.
+	newReceiveMessageHandler := func(checkReplay func(entity.Message) error) func(string, []byte) error {
+		return message.NewReceiveMessageHandler(
+			saluteOnHailUseCase,
+			updateStateUseCase,
+			updateDeviceUseCase,
+			updatePeerUseCase,
+			deletePeerUseCase,
+			resolvePatchUseCase,
+			reconcileDigestUseCase,
+			reconcileTreeNodesUseCase,
+			reconcileTreeLeavesUseCase,
+			answerPingUseCase,
+			relayPingUseCase,
+			acknowledgePingUseCase,
+			updateMembershipUseCase,
+			expectAnnouncedMessagesUseCase,
+			answerGraftUseCase,
+			acceptPruneUseCase,
+			acceptJoinUseCase,
+			forwardJoinUseCase,
+			acceptDisconnectUseCase,
+			answerNeighborUseCase,
+			acceptNeighborReplyUseCase,
+			answerShuffleUseCase,
+			acceptShuffleReplyUseCase,
+			answerBeaconUseCase,
+			messageVerifier,
+			checkReplay,
+			c.cache.ContainsMessage,
+			c.cache.Hold,
+			c.peers.MarkSeen,
+			c.peers.NotePeerVersion,
+			c.cache.CountFeedback,
+			shapeBroadcastTreeUseCase,
+		)
+	}
+	receivedMessageHandler := newReceiveMessageHandler(replayChecker)
+	replayedMessageHandler := newReceiveMessageHandler(func(entity.Message) error { return nil })
+
+	// An expired peer coming back starts out as an eager push peer, like
+	// any peer we haven't heard of before.
+	c.events.OnPeerExpired(func(peer entity.Peer) {
+		c.broadcastTree.Graft(peer.GetId())
+	})
+
+	datagramReceiver := message.NewReassemblingReceiver(c.fragments, receivedMessageHandler)
+	replayedDatagramReceiver := message.NewReassemblingReceiver(c.fragments, replayedMessageHandler)
+	if networkCipher != nil {
+		datagramReceiver = message.NewDecryptingReceiver(networkCipher, datagramReceiver)
+		replayedDatagramReceiver = message.NewDecryptingReceiver(networkCipher, replayedDatagramReceiver)
+	}
+
+	// Replayed datagrams skip the capture, they are in one already.
+	replayCaptureUseCase := message.NewReplayCaptureUseCase(message.ReadCaptureFile, replayedDatagramReceiver)
+	observedReceiver := datagramReceiver
+	if c.capture != nil {
+		observedReceiver = message.NewCapturingReceiver(c.capture.Record, datagramReceiver)
+	}
 
 	// Request components
 	renderApiDocUseCase := request.NewGetApiDocUseCase()
-	shutdownHandler := request.NewShutdownUseCase(c.peers.Reset, c.cache.Reset, c.shutdownFunction)
+	shutdownHandler := request.NewShutdownUseCase(c.peers.Reset, c.cache.Reset, c.patches.Reset, c.shutdownFunction)
 	deleteDeviceUseCase := request.NewDeleteDeviceUseCase(checkIfOwnerUseCase, c.database.Delete)
 	getApiHandler := request.NewGetApiRequestHandler(renderApiDocUseCase)
 	getInfoHandler := request.NewGetHostInfoRequestHandler(composeInfoUseCase)
 	getDeviceIdsHandler := request.NewGetDeviceIdsRequestHandler(deviceIdsProvider)
 	getDeviceHandler := request.NewGetDeviceRequestHandler(deviceProvider)
-	patchStateHandler := request.NewPatchStateRequestHandler(patchStateUseCase)
+	patchStateHandler := request.NewPatchStateRequestHandler(patchStateUseCase, c.patches.AwaitPatch)
 	createDeviceHandler := request.NewCreateDeviceRequestHandler(createDeviceUseCase)
 	deleteDeviceHandler := request.NewDeleteDeviceRequestHandler(deleteDeviceUseCase)
-	getPeersRequestHandler := request.NewGetPeersRequestHandler(c.peers.GetAllPeers)
+	getPeersRequestHandler := request.NewGetPeersRequestHandler(getKnownPeers)
 	addPeerRequestHandler := request.NewAddPeerRequestHandler(c.peers.AddPeer)
+	getPatchesRequestHandler := request.NewGetPatchesRequestHandler(c.patches.GetAllPatches)
 	shutdownRequestHandler := request.NewShutdownRequestHandler(shutdownHandler)
 	joinNetworkRequestHandler := request.NewJoinNetworkRequestHandler(func() error {
-		c.udp.Observe(receivedMessageHandler)
+		if err := c.udp.Observe(observedReceiver); err == nil {
+			c.networkContext, c.leaveFunction = context.WithCancel(c.mainContext)
+			c.schedule(retransmitInterval, retransmitPatchesUseCase)
+			if settings.RumorMongering {
+				c.schedule(rumorInterval, spreadRumorsUseCase)
+			}
+			if settings.UsePlumtree {
+				c.schedule(announceInterval, announceMessagesUseCase)
+				c.schedule(announceInterval, requestMissingMessagesUseCase)
+			}
+			if settings.DigestInterval > 0 && settings.UseMerkleTree {
+				c.schedule(settings.DigestInterval, sendTreeRootUseCase)
+			} else if settings.DigestInterval > 0 {
+				c.schedule(settings.DigestInterval, sendDigestUseCase)
+			}
+			if settings.ProbeInterval > 0 {
+				c.schedule(settings.ProbeInterval, probePeerUseCase)
+				c.schedule(settings.ProbeInterval, confirmSuspectsUseCase)
+			}
+			if settings.BeaconInterval > 0 {
+				c.schedule(settings.BeaconInterval, sendBeaconsUseCase)
+				sendBeaconsUseCase()
+			}
+			if settings.HeartbeatInterval > 0 {
+				c.schedule(settings.HeartbeatInterval, sendHeartbeatsUseCase)
+			}
+			if settings.PeerExpiry > 0 {
+				c.schedule(expiryInterval, expireSilentPeersUseCase)
+			}
+			if settings.UsePartialView {
+				c.schedule(repairInterval, repairActiveViewUseCase)
+				c.schedule(shuffleInterval, shufflePeersUseCase)
+				sendJoinUseCase()
+			}
+			if settings.ReplayPath != "" {
+				c.replaying.Store(true)
+				go func() {
+					defer c.replaying.Store(false)
+					replayCaptureUseCase(c.networkContext, settings.ReplayPath, settings.ReplaySpeed)
+				}()
+			}
+		}
 		sendHailMessage()
 		return nil
 	})
 	leaveNetworkRequestHandler := request.NewLeaveNetworkRequestHandler(func() error {
 		sendFarewellMessage()
+		if c.leaveFunction != nil {
+			c.leaveFunction()
+		}
 		c.udp.Stop()
 		return nil
 	})
@@ -179,6 +798,7 @@ func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort in
 	c.api.Handle("DELETE /device/{id}", deleteDeviceHandler)
 	c.api.Handle("GET /peer", getPeersRequestHandler)
 	c.api.Handle("POST /peer", addPeerRequestHandler)
+	c.api.Handle("GET /patch", getPatchesRequestHandler)
 	c.api.Handle("POST /network", joinNetworkRequestHandler)
 	c.api.Handle("DELETE /network", leaveNetworkRequestHandler)
 	c.api.Handle("POST /shutdown", shutdownRequestHandler)
@@ -187,6 +807,9 @@ func (c *controller) SetupInfrastructure(apiServerPort int, messageServerPort in
 func (c *controller) StartApiServer() {
 	defer c.api.Stop()
 	defer c.udp.Stop()
+	if c.capture != nil {
+		defer c.capture.Close()
+	}
 	go c.api.Serve()
 
 	if c.mainContext.Err() == nil {
@@ -198,3 +821,23 @@ func (c *controller) StartApiServer() {
 	// request to the /shutdown endpoin.
 	<-c.mainContext.Done()
 }
+
+// schedule runs the given task periodically, in the background, until we
+// leave the network.
+func (c *controller) schedule(interval time.Duration, task func() error) {
+	ctxt := c.networkContext
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctxt.Done():
+				return
+			case <-ticker.C:
+				if err := task(); err != nil {
+					log.Debug("Background task failed: %s", err.Error())
+				}
+			}
+		}
+	}()
+}
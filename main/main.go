@@ -1,6 +1,11 @@
 package main
 
 import (
+	"echsylon/fudpucker/data"
+	"echsylon/fudpucker/entity"
+	"os"
+	"time"
+
 	"github.com/echsylon/go-args"
 	"github.com/echsylon/go-log"
 )
@@ -15,17 +20,127 @@ func main() {
 		log.LOG_COLUMN_LEVEL,
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == decodeCommand {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		os.Exit(runDecodeCommand())
+	}
+
 	args.SetApplicationDescription("This application enables distributed store features in a network.")
 	args.DefineOptionStrict("m", "message-port", "The network messages port. Default: 8881", `^[0-9]{4,5}$`)
 	args.DefineOptionStrict("r", "request-port", "The REST API port. Default: 8880", `^[0-9]{4,5}$`)
+	args.DefineOptionStrict("u", "mtu", "The max UDP datagram size in bytes. Default: 1400", `^[0-9]{3,5}$`)
+	args.DefineOptionStrict("k", "network-key", "The pre-shared key used to encrypt all peer traffic. Default: none", "")
+	args.DefineOptionStrict("o", "hops", "The number of times a message may be relayed (0-254). Default: 8", `^([0-9]{1,2}|1[0-9]{2}|2[0-4][0-9]|25[0-4])$`)
+	args.DefineOptionStrict("c", "codec", "The message data encoding, binary or protobuf. Default: binary", `^(binary|protobuf)$`)
+	args.DefineOptionStrict("s", "clock-skew", "The max age, in seconds, of received messages. Default: 30", `^[0-9]{1,5}$`)
+	args.DefineOptionStrict("e", "anti-entropy", "The interval, in seconds, between anti-entropy rounds with random peers, 0 to disable. Default: 0", `^[0-9]{1,5}$`)
+	args.DefineOptionStrict("g", "reconcile", "The anti-entropy method, digest or merkle. Default: merkle", `^(digest|merkle)$`)
+	args.DefineOptionStrict("p", "probe-interval", "The interval, in milliseconds, between failure detector probes of peers, 0 to disable. Default: 0", `^[0-9]{1,6}$`)
+	args.DefineOptionStrict("", "suspicion-timeout", "The time, in seconds, a suspected peer has to refute it before being declared dead. Default: 5", `^[0-9]{1,5}$`)
+	args.DefineOptionStrict("", "multicast-group", "The IPv4 multicast group to join, and send hails and syncs to. Default: none", `^(22[4-9]|23[0-9])(\.[0-9]{1,3}){3}$`)
+	args.DefineOptionStrict("", "beacon-interval", "The interval, in seconds, between discovery beacons broadcast on each subnet, 0 to disable. Default: 0", `^[0-9]{1,5}$`)
+	args.DefineOptionStrict("", "heartbeat-interval", "The interval, in seconds, between heartbeats sent to all peers, 0 to disable. Default: 0", `^[0-9]{1,5}$`)
+	args.DefineOptionStrict("", "peer-expiry", "The time, in seconds, a peer may be silent before it's removed, 0 to never remove silent peers. Default: 0", `^[0-9]{1,5}$`)
+	args.DefineOptionStrict("", "fanout-sync", "The number of random peers to send sync events to, or all. Default: 5", `^([0-9]{1,3}|all)$`)
+	args.DefineOptionStrict("", "fanout-patch", "The number of random peers to send patch commands to, or all. Default: 5", `^([0-9]{1,3}|all)$`)
+	args.DefineOptionStrict("", "fanout-hail", "The number of random peers to hail when joining the network, or all. Default: 5", `^([0-9]{1,3}|all)$`)
+	args.DefineOptionStrict("", "fanout-farewell", "The number of random peers to say farewell to when leaving the network, or all. Default: all", `^([0-9]{1,3}|all)$`)
+	args.DefineOptionStrict("", "fanout-mode", "The fanout mode, fixed or adaptive to the number of known peers (ln(N) + c). Default: fixed", `^(fixed|adaptive)$`)
+	args.DefineOptionStrict("", "fanout-constant", "The constant c added to ln(N) in the adaptive fanout mode. Default: 2", `^[0-9]{1,2}$`)
+	args.DefineOptionStrict("", "dissemination", "The way messages are spread, ttl (forwarded once, remembered for 10 seconds), rumor (mongered until cold) or plumtree (syncs pushed along a broadcast tree). Default: ttl", `^(ttl|rumor|plumtree)$`)
+	args.DefineOptionStrict("", "rumor-feedback", "The number of times a rumor is heard again before it's no longer spread. Default: 3", `^[0-9]{1,3}$`)
+	args.DefineOptionStrict("", "rumor-rounds", "The max number of rounds, one per second, a rumor is spread for. Default: 10", `^[0-9]{1,3}$`)
+	args.DefineOptionStrict("", "membership", "The peers to gossip with, full (all known peers) or hyparview (a small active view, backed by a larger passive view). Default: full", `^(full|hyparview)$`)
+	args.DefineOptionStrict("", "active-view", "The number of peers in the HyParView active view. Default: 5", `^[0-9]{1,3}$`)
+	args.DefineOptionStrict("", "passive-view", "The number of peers in the HyParView passive view. Default: 30", `^[0-9]{1,4}$`)
+	args.DefineOptionStrict("", "capture", "The file to record all sent and received datagrams in. Default: none", "")
+	args.DefineOptionStrict("", "replay", "The capture file to replay received datagrams from when joining the network. Default: none", "")
+	args.DefineOptionStrict("", "replay-speed", "The replay speed relative to the capture, 0 being as fast as possible. Default: 1", `^[0-9]+(\.[0-9]+)?$`)
+	args.DefineOptionStrict("", "replay-mode", "The replay mode, dry (nothing is sent until the replay ends) or live (replayed messages are answered as usual). Default: dry", `^(dry|live)$`)
 	args.DefineOptionHelp("h", "help", "Prints this help text.")
 
 	args.Parse()
 
 	httpPort := args.GetOptionIntValue("r", 8880)
 	udpPort := args.GetOptionIntValue("m", 8881)
+	mtu := args.GetOptionIntValue("u", 1400)
+	networkKey := args.GetOptionValue("k", "")
+	hopCount := args.GetOptionIntValue("o", 8)
+	clockSkew := args.GetOptionIntValue("s", 30)
+	digestInterval := args.GetOptionIntValue("e", 0)
+	useMerkleTree := args.GetOptionValue("g", "merkle") == "merkle"
+	probeInterval := args.GetOptionIntValue("p", 0)
+	suspicionTimeout := args.GetOptionIntValue("suspicion-timeout", 5)
+	multicastGroup := args.GetOptionValue("multicast-group", "")
+	beaconInterval := args.GetOptionIntValue("beacon-interval", 0)
+	heartbeatInterval := args.GetOptionIntValue("heartbeat-interval", 0)
+	peerExpiry := args.GetOptionIntValue("peer-expiry", 0)
+	fanouts := map[entity.MessageType]int{
+		entity.MessageTypeEventSync:     getFanoutOptionValue("fanout-sync", 5),
+		entity.MessageTypeCommandPatch:  getFanoutOptionValue("fanout-patch", 5),
+		entity.MessageTypeCommandHail:   getFanoutOptionValue("fanout-hail", 5),
+		entity.MessageTypeEventFarewell: getFanoutOptionValue("fanout-farewell", data.FanoutAll),
+	}
+	adaptiveFanout := args.GetOptionValue("fanout-mode", "fixed") == "adaptive"
+	fanoutConstant := args.GetOptionIntValue("fanout-constant", 2)
+	dissemination := args.GetOptionValue("dissemination", "ttl")
+	rumorMongering := dissemination == "rumor"
+	usePlumtree := dissemination == "plumtree"
+	rumorFeedback := args.GetOptionIntValue("rumor-feedback", 3)
+	rumorRounds := args.GetOptionIntValue("rumor-rounds", 10)
+	usePartialView := args.GetOptionValue("membership", "full") == "hyparview"
+	activeViewSize := args.GetOptionIntValue("active-view", 5)
+	passiveViewSize := args.GetOptionIntValue("passive-view", 30)
+	capturePath := args.GetOptionValue("capture", "")
+	replayPath := args.GetOptionValue("replay", "")
+	replaySpeed := args.GetOptionFloatValue("replay-speed", 1)
+	replayLive := args.GetOptionValue("replay-mode", "dry") == "live"
+	encoding := entity.MessageEncodingBinary
+	if args.GetOptionValue("c", "binary") == "protobuf" {
+		encoding = entity.MessageEncodingProtobuf
+	}
 
 	controller := NewController()
-	controller.SetupInfrastructure(int(httpPort), int(udpPort))
+	controller.SetupInfrastructure(Settings{
+		ApiServerPort:     int(httpPort),
+		MessageServerPort: int(udpPort),
+		MaxDatagramSize:   int(mtu),
+		NetworkKey:        networkKey,
+		InitialHopCount:   int(hopCount),
+		MessageEncoding:   encoding,
+		MaxClockSkew:      time.Duration(clockSkew) * time.Second,
+		CapturePath:       capturePath,
+		ReplayPath:        replayPath,
+		ReplaySpeed:       replaySpeed,
+		ReplayLive:        replayLive,
+		DigestInterval:    time.Duration(digestInterval) * time.Second,
+		UseMerkleTree:     useMerkleTree,
+		ProbeInterval:     time.Duration(probeInterval) * time.Millisecond,
+		SuspicionTimeout:  time.Duration(suspicionTimeout) * time.Second,
+		Fanouts:           fanouts,
+		AdaptiveFanout:    adaptiveFanout,
+		FanoutConstant:    int(fanoutConstant),
+		RumorMongering:    rumorMongering,
+		RumorFeedback:     int(rumorFeedback),
+		RumorRounds:       int(rumorRounds),
+		UsePlumtree:       usePlumtree,
+		UsePartialView:    usePartialView,
+		ActiveViewSize:    int(activeViewSize),
+		PassiveViewSize:   int(passiveViewSize),
+		HeartbeatInterval: time.Duration(heartbeatInterval) * time.Second,
+		PeerExpiry:        time.Duration(peerExpiry) * time.Second,
+		MulticastGroup:    multicastGroup,
+		BeaconInterval:    time.Duration(beaconInterval) * time.Second,
+	})
 	controller.StartApiServer()
 }
+
+// getFanoutOptionValue returns the fanout option with the given name, "all"
+// meaning all known peers.
+func getFanoutOptionValue(name string, defaultValue int) int {
+	if args.GetOptionValue(name, "") == "all" {
+		return data.FanoutAll
+	} else {
+		return int(args.GetOptionIntValue(name, int64(defaultValue)))
+	}
+}
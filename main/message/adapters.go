@@ -2,59 +2,124 @@ package message
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"echsylon/fudpucker/entity"
 	"echsylon/fudpucker/entity/unit"
 	"echsylon/fudpucker/entity/utils"
+	"encoding/binary"
 	"errors"
+	"net"
+	"time"
+	"unicode/utf8"
 
 	"github.com/echsylon/go-log"
 )
 
+var (
+	ErrPayloadFormat    = errors.New("payload format error")
+	ErrClockSkew        = errors.New("message timestamp outside clock skew window")
+	ErrMissingTimestamp = errors.New("message timestamp missing")
+	ErrReplayedMessage  = errors.New("replayed message error")
+)
+
 func NewReceiveMessageHandler(
 	saluteOnHail func(string, entity.Message) error,
 	updateState func(string, entity.Message) error,
 	updateDevice func(string, entity.Message) error,
 	updatePeer func(string, entity.Message) error,
 	deletePeer func(string, entity.Message) error,
+	resolvePatch func(string, entity.Message) error,
+	reconcileDigest func(string, entity.Message) error,
+	reconcileTreeNodes func(string, entity.Message) error,
+	reconcileTreeLeaves func(string, entity.Message) error,
+	answerPing func(string, entity.Message) error,
+	relayPing func(string, entity.Message) error,
+	acknowledgePing func(string, entity.Message) error,
+	updateMembership func(string, entity.Message) error,
+	expectAnnounced func(string, entity.Message) error,
+	answerGraft func(string, entity.Message) error,
+	acceptPrune func(string, entity.Message) error,
+	acceptJoin func(string, entity.Message) error,
+	forwardJoin func(string, entity.Message) error,
+	acceptDisconnect func(string, entity.Message) error,
+	answerNeighbor func(string, entity.Message) error,
+	acceptNeighborReply func(string, entity.Message) error,
+	answerShuffle func(string, entity.Message) error,
+	acceptShuffleReply func(string, entity.Message) error,
+	answerBeacon func(string, entity.Message) error,
+	verifyMessage func(entity.Message) error,
+	checkReplay func(entity.Message) error,
 	isMessageInQuarantine func(entity.Id) bool,
 	putMessageInQuarantine func(entity.Id, entity.Id),
+	markPeerSeen func(string),
+	notePeerVersion func(string, byte),
+	countRumorFeedback func(entity.Id, entity.Id),
+	shapeBroadcastTree func(string, entity.Message, bool) error,
 ) func(string, []byte) error {
-	return func(sender string, data []byte) (err error) {
-		reader := bytes.NewBuffer(data)
-		idLen := len(entity.ZeroId)
-
-		bytes := reader.Next(idLen)
-		messageId, err := entity.NewBytesId(bytes)
+	var handleFrame func(string, []byte) error
+	handleFrame = func(sender string, data []byte) (err error) {
+		header, body, err := readFrameHeader(data)
 		if err != nil {
-			log.Error("Failed reading incomming message")
+			log.Error("Failed reading incomming frame")
 			return
 		}
 
-		typeValue, err := reader.ReadByte()
-		messageType := entity.MessageType(typeValue)
+		if header.flags&FrameFlagBatch != 0 {
+			frames, err := unpackBatch(body)
+			if err != nil {
+				log.Error("Failed reading incomming batch, handling %d readable frames", len(frames))
+			}
+			for _, frame := range frames {
+				handleFrame(sender, frame)
+			}
+			return err
+		}
+
+		_, message, err := decodeFrame(data)
 		if err != nil {
-			log.Error("Failed reading incomming message %s", messageId)
+			log.Error("Failed reading incomming message")
 			return
 		}
 
+		messageId := message.GetId()
+		messageType := message.GetType()
 		if isMessageInQuarantine(messageId) {
+			// The sender already knew the message. Only genuine messages
+			// may cool down the rumor though, or anyone could stop it.
 			log.Notice("Already seen incomming message %s (type=%s), ignoring", messageId, messageType)
+			if verifyMessage(message) == nil {
+				markPeerSeen(sender)
+				countRumorFeedback(messageId, message.GetSender())
+				if err := shapeBroadcastTree(sender, message, true); err != nil {
+					log.Warning("Failed pruning the broadcast tree")
+				}
+			}
 			return nil
 		}
 
-		bytes = reader.Next(idLen)
-		senderId, err := entity.NewBytesId(bytes)
-		if err != nil {
-			log.Error("Failed reading incomming message %s (type=%s)", messageId, messageType)
+		if err = verifyMessage(message); err != nil {
+			log.Warning("Failed verifying message %s (type=%s) from %s, ignoring", messageId, messageType, message.GetSender())
 			return
 		}
 
-		log.Information("Successfully read message %s (type=%s)", messageId, messageType)
+		// The frame was put together by the host it came from, which may
+		// not be the sender of the message, so the frame version tells
+		// what the former speaks. Old builds never hail us, so this is how
+		// we learn to answer them in a version they understand.
+		notePeerVersion(sender, header.version)
 
-		bytes = reader.Next(unit.MaxInt)
-		message := entity.NewMessage(messageId, senderId, messageType, bytes)
+		if err = checkReplay(message); err != nil {
+			log.Warning("Rejected message %s (type=%s) from %s as a possible replay", messageId, messageType, message.GetSender())
+			return
+		}
 
-		putMessageInQuarantine(messageId, senderId)
+		markPeerSeen(sender)
+		log.Information("Successfully read message %s (type=%s, version=%d)", messageId, messageType, header.version)
+		log.Debug("Message %s has %d hops left", messageId, message.GetHops())
+		putMessageInQuarantine(messageId, message.GetSender())
+		if err := shapeBroadcastTree(sender, message, false); err != nil {
+			log.Warning("Failed grafting the broadcast tree")
+		}
 
 		switch message.GetType() {
 		case entity.MessageTypeCommandHail:
@@ -72,6 +137,68 @@ func NewReceiveMessageHandler(
 		case entity.MessageTypeEventFarewell:
 			err = deletePeer(sender, message)
 
+		case entity.MessageTypeEventPatchReply:
+			err = resolvePatch(sender, message)
+
+		case entity.MessageTypeEventDigest:
+			err = reconcileDigest(sender, message)
+
+		case entity.MessageTypeEventTreeNodes:
+			err = reconcileTreeNodes(sender, message)
+
+		case entity.MessageTypeEventTreeLeaves:
+			err = reconcileTreeLeaves(sender, message)
+
+		case entity.MessageTypeEventPing:
+			err = answerPing(sender, message)
+
+		case entity.MessageTypeEventPingRequest:
+			err = relayPing(sender, message)
+
+		case entity.MessageTypeEventPingAck:
+			err = acknowledgePing(sender, message)
+
+		case entity.MessageTypeEventMembership:
+			err = updateMembership(sender, message)
+
+		case entity.MessageTypeEventIHave:
+			err = expectAnnounced(sender, message)
+
+		case entity.MessageTypeEventGraft:
+			err = answerGraft(sender, message)
+
+		case entity.MessageTypeEventPrune:
+			err = acceptPrune(sender, message)
+
+		case entity.MessageTypeEventJoin:
+			err = acceptJoin(sender, message)
+
+		case entity.MessageTypeEventForwardJoin:
+			err = forwardJoin(sender, message)
+
+		case entity.MessageTypeEventDisconnect:
+			err = acceptDisconnect(sender, message)
+
+		case entity.MessageTypeEventNeighbor:
+			err = answerNeighbor(sender, message)
+
+		case entity.MessageTypeEventNeighborReply:
+			err = acceptNeighborReply(sender, message)
+
+		case entity.MessageTypeEventShuffle:
+			err = answerShuffle(sender, message)
+
+		case entity.MessageTypeEventShuffleReply:
+			err = acceptShuffleReply(sender, message)
+
+		case entity.MessageTypeEventBeacon:
+			err = answerBeacon(sender, message)
+
+		case entity.MessageTypeEventHeartbeat:
+			// The sender has already been marked as seen, which is
+			// all a heartbeat is for.
+			err = nil
+
 		default:
 			err = errors.New("unexpected message type")
 		}
@@ -82,22 +209,25 @@ func NewReceiveMessageHandler(
 
 		return err
 	}
+
+	return handleFrame
 }
 
 func NewSendMessageHandler(
+	signMessage func(entity.Message, byte) (entity.Message, error),
+	getPeerVersion func(entity.Id) byte,
 	sendMessage func(string, []byte) error,
 	putMessageInQuarantine func(entity.Id, entity.Id),
 ) func(entity.Peer, entity.Message) error {
 
 	return func(peer entity.Peer, message entity.Message) error {
-		writer := bytes.NewBuffer([]byte{})
-		writer.Write(message.GetId().Bytes())
-		writer.Write(message.GetType().Bytes())
-		writer.Write(message.GetSender().Bytes())
-		writer.Write(message.GetData())
-		writer.Write(message.GetSignature())
+		version := NegotiateVersion(getPeerVersion(peer.GetId()))
+		frame, err := frameMessage(signMessage, version, message)
+		if err != nil {
+			return err
+		}
 
-		err := sendMessage(peer.GetAddress(), writer.Bytes())
+		err = sendMessage(peer.GetAddress(), frame)
 		if err != nil {
 			log.Error("Failed sending message %s (type=%s)", message.GetId(), message.GetType())
 		} else {
@@ -109,8 +239,229 @@ func NewSendMessageHandler(
 	}
 }
 
+// NewRumorSender returns a function that sends a message like the given
+// sender does, and keeps spreading it as a rumor in later rounds.
+func NewRumorSender(
+	spreadRumor func(entity.Message),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(entity.Peer, entity.Message) error {
+
+	return func(peer entity.Peer, message entity.Message) error {
+		spreadRumor(message)
+		return sendMessage(peer, message)
+	}
+}
+
+// NewEagerPushSender returns a function that sends a message like the
+// given sender does, and keeps it for peers asking for it after having
+// only heard of it.
+func NewEagerPushSender(
+	keepMessage func(entity.Message),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(entity.Peer, entity.Message) error {
+
+	return func(peer entity.Peer, message entity.Message) error {
+		keepMessage(message)
+		return sendMessage(peer, message)
+	}
+}
+
+// NewSendMessagesHandler returns a function that sends a sequence of
+// messages to a peer, packing as many of them as possible into each UDP
+// datagram. Legacy peers, who don't understand batches, will receive one
+// datagram per message.
+func NewSendMessagesHandler(
+	signMessage func(entity.Message, byte) (entity.Message, error),
+	getPeerVersion func(entity.Id) byte,
+	sendMessage func(string, []byte) error,
+	putMessageInQuarantine func(entity.Id, entity.Id),
+	maxDatagramSize int,
+) func(entity.Peer, []entity.Message) error {
+
+	return func(peer entity.Peer, messages []entity.Message) error {
+		version := NegotiateVersion(getPeerVersion(peer.GetId()))
+		frames := make([][]byte, 0, len(messages))
+		framed := make([]entity.Message, 0, len(messages))
+		for _, message := range messages {
+			if frame, err := frameMessage(signMessage, version, message); err == nil {
+				frames = append(frames, frame)
+				framed = append(framed, message)
+			}
+		}
+
+		datagrams := frames
+		if version >= ProtocolVersionHeader {
+			datagrams = packBatches(version, frames, maxDatagramSize)
+		}
+
+		var result error
+		for _, datagram := range datagrams {
+			if err := sendMessage(peer.GetAddress(), datagram); err != nil {
+				log.Error("Failed sending %d bytes of messages to %s", len(datagram), peer.GetId())
+				result = err
+			}
+		}
+
+		if result == nil {
+			for _, message := range framed {
+				putMessageInQuarantine(message.GetId(), peer.GetId())
+			}
+			log.Information("Successfully sent %d messages in %d datagrams", len(framed), len(datagrams))
+		}
+
+		return result
+	}
+}
+
+// NewMessageSigner returns a function that signs messages originating from
+// this host and gives them the initial hop count. Messages sent with a
+// protocol version that carries timestamps are stamped with the current
+// time before being signed. Messages that already carry a signature, i.e.
+// messages we are relaying on behalf of other hosts, are returned untouched.
+func NewMessageSigner(
+	getKeyPair func() (ed25519.PublicKey, ed25519.PrivateKey, error),
+	initialHops byte,
+) func(entity.Message, byte) (entity.Message, error) {
+
+	return func(message entity.Message, version byte) (entity.Message, error) {
+		if len(message.GetSignature()) != 0 {
+			return message, nil
+		} else if publicKey, privateKey, err := getKeyPair(); err != nil {
+			return message, err
+		} else {
+			timestamp := time.Time{}
+			if version >= ProtocolVersionTimestamp {
+				timestamp = time.UnixMilli(time.Now().UnixMilli())
+			}
+			stamped := entity.NewSignedMessage(
+				message.GetId(),
+				message.GetSender(),
+				message.GetType(),
+				message.GetEncoding(),
+				message.GetData(),
+				nil,
+				nil,
+				initialHops,
+				timestamp,
+			)
+			signature := ed25519.Sign(privateKey, signedBytes(stamped))
+			return entity.NewSignedMessage(
+				message.GetId(),
+				message.GetSender(),
+				message.GetType(),
+				message.GetEncoding(),
+				message.GetData(),
+				publicKey,
+				signature,
+				initialHops,
+				timestamp,
+			), nil
+		}
+	}
+}
+
+// NewMessageVerifier returns a function that verifies the signature of a
+// received message against the known public key of the sender. The first
+// public key we see for a sender is pinned and any message with another
+// key claiming to be from the same sender is rejected.
+func NewMessageVerifier(
+	pinKey func(entity.Id, ed25519.PublicKey) bool,
+) func(entity.Message) error {
+
+	return func(message entity.Message) error {
+		publicKey := ed25519.PublicKey(message.GetPublicKey())
+		if len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("unexpected public key length")
+		} else if !ed25519.Verify(publicKey, signedBytes(message), message.GetSignature()) {
+			return errors.New("invalid signature")
+		} else if !pinKey(message.GetSender(), publicKey) {
+			return errors.New("unknown public key")
+		} else {
+			return nil
+		}
+	}
+}
+
+// NewReplayChecker returns a function that rejects messages which may have
+// been captured and sent again. Timestamped messages must have been signed
+// within the max clock skew from now, and no message id is accepted twice
+// from the same sender. Only hosts we've negotiated a protocol version
+// without timestamps with may send messages without one, and those are
+// only checked against the recently seen message ids. Hosts we don't know
+// the version of are held to our own version, except for their hails, which
+// are sent to hosts of unknown version in the legacy version. Replaying a
+// hail gains nothing that sending a new one wouldn't.
+func NewReplayChecker(
+	admitMessage func(entity.Id, entity.Id) bool,
+	getPeerVersion func(entity.Id) byte,
+	maxClockSkew time.Duration,
+) func(entity.Message) error {
+
+	return func(message entity.Message) error {
+		timestamp := message.GetTimestamp()
+		if timestamp.IsZero() && message.GetType() != entity.MessageTypeCommandHail && NegotiateVersion(getPeerVersion(message.GetSender())) >= ProtocolVersionTimestamp {
+			return ErrMissingTimestamp
+		} else if !timestamp.IsZero() && time.Since(timestamp).Abs() > maxClockSkew {
+			return ErrClockSkew
+		} else if !admitMessage(message.GetSender(), message.GetId()) {
+			return ErrReplayedMessage
+		} else {
+			return nil
+		}
+	}
+}
+
+// NewPeerRecordSigner returns a function that creates a record of our own
+// id and address, signed with our key, for other hosts to share.
+func NewPeerRecordSigner(
+	getHostId func() (entity.Id, error),
+	getLocalAddress func() (string, error),
+	getKeyPair func() (ed25519.PublicKey, ed25519.PrivateKey, error),
+) func() (entity.SignedPeer, error) {
+
+	return func() (entity.SignedPeer, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if address, err := getLocalAddress(); err != nil {
+			return nil, err
+		} else if publicKey, privateKey, err := getKeyPair(); err != nil {
+			return nil, err
+		} else {
+			timestamp := time.UnixMilli(time.Now().UnixMilli())
+			signature := ed25519.Sign(privateKey, peerRecordBytes(hostId, address, timestamp))
+			return entity.NewSignedPeer(hostId, address, timestamp, publicKey, signature), nil
+		}
+	}
+}
+
+// NewPeerRecordVerifier returns a function that checks that a peer record
+// is signed by the peer it describes, with the key we have pinned for it,
+// and that it isn't signed in the future.
+func NewPeerRecordVerifier(
+	pinKey func(entity.Id, ed25519.PublicKey) bool,
+	maxClockSkew time.Duration,
+) func(entity.SignedPeer) error {
+
+	return func(record entity.SignedPeer) error {
+		publicKey := ed25519.PublicKey(record.GetPublicKey())
+		signed := peerRecordBytes(record.GetId(), record.GetAddress(), record.GetTimestamp())
+		if len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("unexpected public key length")
+		} else if !ed25519.Verify(publicKey, signed, record.GetSignature()) {
+			return errors.New("invalid signature")
+		} else if time.Until(record.GetTimestamp()) > maxClockSkew {
+			return ErrClockSkew
+		} else if !pinKey(record.GetId(), publicKey) {
+			return errors.New("unknown public key")
+		} else {
+			return nil
+		}
+	}
+}
+
 func NewHailMessageProvider(
 	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
 ) func() (entity.Message, error) {
 
 	return func() (entity.Message, error) {
@@ -119,46 +470,153 @@ func NewHailMessageProvider(
 		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
 		} else {
-			return entity.NewMessage(msgId, hostId, entity.MessageTypeCommandHail, nil), nil
+			data := utils.ByteToBytes(ProtocolVersion)
+			if encoding == entity.MessageEncodingProtobuf {
+				data = encodeProtobufHail(ProtocolVersion)
+			}
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeCommandHail, encoding, data), nil
+		}
+	}
+}
+
+// NewHailMessageReader returns a function that reads the highest protocol
+// version the hailing host speaks. Legacy hosts don't advertise any.
+func NewHailMessageReader() func(entity.Message) (byte, error) {
+	return func(message entity.Message) (byte, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufHail(message.GetData())
+		} else if data := message.GetData(); len(data) == 0 {
+			return ProtocolVersionLegacy, nil
+		} else if len(data) != 1 {
+			return 0, newLengthError("hail data", len(data), 1)
+		} else if data[0] == 0 {
+			return 0, ErrPayloadFormat
+		} else {
+			return data[0], nil
 		}
 	}
 }
 
 func NewPatchMessageProvider(
 	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
 ) func(entity.Id, entity.DeviceState) (entity.Message, error) {
 
 	return func(deviceId entity.Id, newState entity.DeviceState) (entity.Message, error) {
+		return createPatchMessage(getHostId, encoding, deviceId, newState, entity.ZeroId)
+	}
+}
+
+// NewPatchRetransmissionMessageProvider returns a function that creates a
+// new patch message for a patch we've already sent. The message gets an id
+// of its own, or the quarantines and replay windows of the peers that saw
+// the first one would drop it, but carries the id of the first message so
+// the device owner can tell it's the same patch.
+func NewPatchRetransmissionMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.Patch) (entity.Message, error) {
+
+	return func(patch entity.Patch) (entity.Message, error) {
+		return createPatchMessage(getHostId, encoding, patch.GetDeviceId(), patch.GetState(), patch.GetId())
+	}
+}
+
+// NewPatchMessageReader returns a function that reads the device id, the
+// new state and the patch id of a patch message. The patch id is the id of
+// the message the patch was first sent in.
+func NewPatchMessageReader() func(entity.Message) (entity.Id, entity.DeviceState, entity.Id, error) {
+	return func(message entity.Message) (entity.Id, entity.DeviceState, entity.Id, error) {
+		var deviceId, patchId entity.Id
+		var state entity.DeviceState
+		var err error
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			deviceId, state, patchId, err = decodeProtobufPatch(message.GetData())
+		} else {
+			deviceId, state, patchId, err = readBinaryPatch(message.GetData())
+		}
+
+		if err != nil {
+			return entity.ZeroId, entity.DeviceStateOff, entity.ZeroId, err
+		} else if patchId == entity.ZeroId {
+			return deviceId, state, message.GetId(), nil
+		} else {
+			return deviceId, state, patchId, nil
+		}
+	}
+}
+
+func NewPatchReplyMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.PatchOutcome) (entity.Message, error) {
+
+	return func(outcome entity.PatchOutcome) (entity.Message, error) {
 		if hostId, err := getHostId(); err != nil {
 			return nil, err
 		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufPatchReply(outcome)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventPatchReply, encoding, data), nil
 		} else {
 			writer := bytes.NewBuffer([]byte{})
-			writer.Write(deviceId.Bytes())
-			writer.Write(utils.ByteToBytes(byte(newState)))
-			return entity.NewMessage(msgId, hostId, entity.MessageTypeCommandPatch, writer.Bytes()), nil
+			writer.Write(outcome.GetPatchId().Bytes())
+			writer.Write(utils.BoolToBytes(outcome.IsAccepted()))
+			writer.Write(utils.Int64ToBytes(int64(outcome.GetVersion())))
+			writer.Write(utils.StringToBytes(outcome.GetReason()))
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventPatchReply, writer.Bytes()), nil
 		}
 	}
 }
 
-func NewPatchMessageReader() func(entity.Message) (entity.Id, entity.DeviceState, error) {
-	return func(message entity.Message) (entity.Id, entity.DeviceState, error) {
-		reader := bytes.NewBuffer(message.GetData())
+func NewPatchReplyMessageReader() func(entity.Message) (entity.PatchOutcome, error) {
+	return func(message entity.Message) (entity.PatchOutcome, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufPatchReply(message.GetData())
+		}
+
+		data := message.GetData()
 		idLen := len(entity.ZeroId)
-		idBytes := reader.Next(idLen)
-		if deviceId, err := entity.NewBytesId(idBytes); err != nil {
-			return entity.ZeroId, entity.DeviceStateOff, err
-		} else if value, err := reader.ReadByte(); err != nil {
-			return entity.ZeroId, entity.DeviceStateOff, err
+		fixedLen := idLen + 1 + 8
+		if len(data) < fixedLen {
+			return nil, newMinLengthError("patch reply data", len(data), fixedLen)
+		}
+
+		reader := bytes.NewBuffer(data)
+		patchId := entity.Id(reader.Next(idLen))
+		accepted, _ := reader.ReadByte()
+		version := utils.BytesToInt64(reader.Next(8))
+		reason := reader.Next(unit.MaxInt)
+		if accepted > 1 || !utf8.Valid(reason) {
+			return nil, ErrPayloadFormat
 		} else {
-			return deviceId, entity.DeviceState(value), nil
+			return entity.NewPatchOutcome(patchId, accepted != 0, int(version), string(reason)), nil
 		}
 	}
 }
 
+// Sync message attribute tags. Tags not listed here are kept as extra
+// device attributes.
+const (
+	syncTagDeviceId byte = iota + 1
+	syncTagOwnerId
+	syncTagType
+	syncTagState
+	syncTagVersion
+)
+
+// Peer addresses are "host:port" strings, where the host is a host name or
+// an IP address. Host names are at most 253 characters long.
+const maxPeerAddressLength = 253 + 1 + 5
+
+// The length of the fixed, positional, sync message layout used before
+// sync messages were tag-length-value encoded.
+const positionalSyncLength = 2*len(entity.ZeroId) + 1 + 1 + 8
+
 func NewSyncMessageProvider(
 	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
 ) func(entity.Device) (entity.Message, error) {
 
 	return func(device entity.Device) (entity.Message, error) {
@@ -166,13 +624,24 @@ func NewSyncMessageProvider(
 			return nil, err
 		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufSync(device)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventSync, encoding, data), nil
 		} else {
+			attributes := make(map[byte][]byte)
+			for tag, value := range device.GetExtraAttributes() {
+				attributes[tag] = value
+			}
+			attributes[syncTagDeviceId] = device.GetId().Bytes()
+			attributes[syncTagOwnerId] = device.GetOwner().Bytes()
+			attributes[syncTagType] = utils.ByteToBytes(byte(device.GetType()))
+			attributes[syncTagState] = utils.ByteToBytes(byte(device.GetState()))
+			attributes[syncTagVersion] = utils.Int64ToBytes(int64(device.GetVersion()))
+
 			writer := bytes.NewBuffer([]byte{})
-			writer.Write(device.GetId().Bytes())
-			writer.Write(device.GetOwner().Bytes())
-			writer.Write(utils.ByteToBytes(byte(device.GetType())))
-			writer.Write(utils.ByteToBytes(byte(device.GetState())))
-			writer.Write(utils.Int64ToBytes(int64(device.GetVersion())))
+			if err := writeTlvs(writer, attributes); err != nil {
+				return nil, err
+			}
 			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventSync, writer.Bytes()), nil
 		}
 	}
@@ -180,72 +649,1078 @@ func NewSyncMessageProvider(
 
 func NewSyncMessageReader() func(entity.Message) (entity.Device, error) {
 	return func(message entity.Message) (entity.Device, error) {
-		reader := bytes.NewBuffer(message.GetData())
+		data := message.GetData()
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufSync(data)
+		} else if len(data) == positionalSyncLength {
+			return readPositionalSync(data)
+		}
+
+		attributes, err := readTlvs(data)
+		if err != nil {
+			return nil, err
+		}
+
+		deviceId, err := readId("sync device id", attributes[syncTagDeviceId])
+		if err != nil {
+			return nil, err
+		}
+
+		ownerId, err := readId("sync owner id", attributes[syncTagOwnerId])
+		if err != nil {
+			return nil, err
+		}
+
+		typeBytes := attributes[syncTagType]
+		stateBytes := attributes[syncTagState]
+		versionBytes := attributes[syncTagVersion]
+		if len(typeBytes) != 1 {
+			return nil, newLengthError("sync type", len(typeBytes), 1)
+		} else if len(stateBytes) != 1 {
+			return nil, newLengthError("sync state", len(stateBytes), 1)
+		} else if len(versionBytes) != 8 {
+			return nil, newLengthError("sync version", len(versionBytes), 8)
+		}
+
+		for _, tag := range []byte{syncTagDeviceId, syncTagOwnerId, syncTagType, syncTagState, syncTagVersion} {
+			delete(attributes, tag)
+		}
+
+		deviceType := entity.DeviceType(utils.BytesToByte(typeBytes))
+		deviceState := entity.DeviceState(utils.BytesToByte(stateBytes))
+		version := utils.BytesToInt64(versionBytes)
+		device := entity.NewExtendedDevice(deviceId, ownerId, deviceType, deviceState, int(version), attributes)
+		return device, nil
+	}
+}
+
+// The length of the fixed part of a binary peer message, preceding the
+// peer address.
+const peerRecordHeaderLength = len(entity.ZeroId) + 8 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+// NewPeerMessageProvider returns a function that creates a message sharing
+// the given peer record. The record keeps the signature of the peer it
+// describes.
+func NewPeerMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.SignedPeer) (entity.Message, error) {
+
+	return func(record entity.SignedPeer) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			data := encodePeerRecord(record, encoding)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventPeer, encoding, data), nil
+		}
+	}
+}
+
+// NewPeerMessageReader returns a function that reads a signed peer record
+// from a peer message. The signature is not verified here.
+func NewPeerMessageReader() func(entity.Message) (entity.SignedPeer, error) {
+	return func(message entity.Message) (entity.SignedPeer, error) {
+		return readPeerRecord(message.GetData(), message.GetEncoding())
+	}
+}
+
+// The length of each device entry in a binary digest message.
+const digestEntryLength = len(entity.ZeroId) + 8
+
+// NewDigestMessageProvider returns a function that creates a digest of the
+// given device versions. A reply digest answers another digest and holds
+// the versions of the devices we want from the receiver.
+func NewDigestMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(map[entity.Id]int, bool) (entity.Message, error) {
+
+	return func(versions map[entity.Id]int, isReply bool) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufDigest(versions, isReply)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventDigest, encoding, data), nil
+		} else {
+			writer := bytes.NewBuffer([]byte{})
+			writer.Write(utils.BoolToBytes(isReply))
+			for deviceId, version := range versions {
+				writer.Write(deviceId.Bytes())
+				writer.Write(utils.Int64ToBytes(int64(version)))
+			}
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventDigest, writer.Bytes()), nil
+		}
+	}
+}
+
+func NewDigestMessageReader() func(entity.Message) (map[entity.Id]int, bool, error) {
+	return func(message entity.Message) (map[entity.Id]int, bool, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufDigest(message.GetData())
+		}
+
+		data := message.GetData()
+		if len(data) == 0 {
+			return nil, false, newMinLengthError("digest data", len(data), 1)
+		} else if partial := (len(data) - 1) % digestEntryLength; partial != 0 {
+			return nil, false, newLengthError("digest entry", partial, digestEntryLength)
+		} else if data[0] > 1 {
+			return nil, false, ErrPayloadFormat
+		}
+
 		idLen := len(entity.ZeroId)
-		if deviceId, err := entity.NewBytesId(reader.Next(idLen)); err != nil {
+		versions := make(map[entity.Id]int)
+		for offset := 1; offset < len(data); offset += digestEntryLength {
+			deviceId := entity.Id(data[offset : offset+idLen])
+			if _, ok := versions[deviceId]; ok {
+				return nil, false, ErrPayloadFormat // duplicate device
+			}
+			versions[deviceId] = int(utils.BytesToInt64(data[offset+idLen : offset+digestEntryLength]))
+		}
+		return versions, data[0] == 1, nil
+	}
+}
+
+// The length of each node entry in a binary tree nodes message.
+const treeNodeEntryLength = 2 + entity.MerkleHashLength
+
+// NewTreeNodesMessageProvider returns a function that creates a message
+// holding the hashes of the given Merkle tree nodes, all on the given
+// level, by index.
+func NewTreeNodesMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(int, map[int][]byte) (entity.Message, error) {
+
+	return func(level int, hashes map[int][]byte) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
 			return nil, err
-		} else if ownerId, err := entity.NewBytesId(reader.Next(idLen)); err != nil {
+		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
-		} else if typeValue, err := reader.ReadByte(); err != nil {
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufTreeNodes(level, hashes)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventTreeNodes, encoding, data), nil
+		} else {
+			writer := bytes.NewBuffer([]byte{})
+			writer.WriteByte(byte(level))
+			for index, hash := range hashes {
+				writer.Write(binary.BigEndian.AppendUint16(nil, uint16(index)))
+				writer.Write(hash)
+			}
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventTreeNodes, writer.Bytes()), nil
+		}
+	}
+}
+
+func NewTreeNodesMessageReader() func(entity.Message) (int, map[int][]byte, error) {
+	return func(message entity.Message) (int, map[int][]byte, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufTreeNodes(message.GetData())
+		}
+
+		data := message.GetData()
+		if len(data) == 0 {
+			return 0, nil, newMinLengthError("tree nodes data", len(data), 1)
+		} else if partial := (len(data) - 1) % treeNodeEntryLength; partial != 0 {
+			return 0, nil, newLengthError("tree node entry", partial, treeNodeEntryLength)
+		} else if data[0] > entity.MerkleTreeDepth {
+			return 0, nil, ErrPayloadFormat
+		}
+
+		level := int(data[0])
+		hashes := make(map[int][]byte)
+		for offset := 1; offset < len(data); offset += treeNodeEntryLength {
+			index := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+			if index >= entity.MerkleNodeCount(level) {
+				return 0, nil, ErrPayloadFormat
+			} else if _, ok := hashes[index]; ok {
+				return 0, nil, ErrPayloadFormat // duplicate node
+			}
+			hashes[index] = data[offset+2 : offset+treeNodeEntryLength]
+		}
+		return level, hashes, nil
+	}
+}
+
+// NewTreeLeavesMessageProvider returns a function that creates a message
+// holding the devices, and their versions, in the given Merkle tree
+// buckets. A final message answers another tree leaves message.
+func NewTreeLeavesMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func([]int, map[entity.Id]int, bool) (entity.Message, error) {
+
+	return func(buckets []int, versions map[entity.Id]int, isFinal bool) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
 			return nil, err
-		} else if stateValue, err := reader.ReadByte(); err != nil {
+		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufTreeLeaves(buckets, versions, isFinal)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventTreeLeaves, encoding, data), nil
 		} else {
-			versionBytes := reader.Next(unit.MaxInt)
-			deviceType := entity.DeviceType(typeValue)
-			deviceState := entity.DeviceState(stateValue)
-			version := utils.BytesToInt64(versionBytes)
-			device := entity.NewDevice(deviceId, ownerId, deviceType, deviceState, int(version))
-			return device, nil
+			writer := bytes.NewBuffer([]byte{})
+			writer.Write(utils.BoolToBytes(isFinal))
+			writer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(buckets))))
+			for _, bucket := range buckets {
+				writer.Write(binary.BigEndian.AppendUint16(nil, uint16(bucket)))
+			}
+			for deviceId, version := range versions {
+				writer.Write(deviceId.Bytes())
+				writer.Write(utils.Int64ToBytes(int64(version)))
+			}
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventTreeLeaves, writer.Bytes()), nil
 		}
 	}
 }
 
-func NewPeerMessageProvider(
+func NewTreeLeavesMessageReader() func(entity.Message) ([]int, map[entity.Id]int, bool, error) {
+	return func(message entity.Message) ([]int, map[entity.Id]int, bool, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufTreeLeaves(message.GetData())
+		}
+
+		data := message.GetData()
+		if len(data) < 3 {
+			return nil, nil, false, newMinLengthError("tree leaves data", len(data), 3)
+		} else if data[0] > 1 {
+			return nil, nil, false, ErrPayloadFormat
+		}
+
+		count := int(binary.BigEndian.Uint16(data[1:3]))
+		entriesOffset := 3 + 2*count
+		if len(data) < entriesOffset {
+			return nil, nil, false, newMinLengthError("tree leaves buckets", len(data)-3, 2*count)
+		} else if partial := (len(data) - entriesOffset) % digestEntryLength; partial != 0 {
+			return nil, nil, false, newLengthError("tree leaves entry", partial, digestEntryLength)
+		}
+
+		buckets := make([]int, 0, count)
+		for offset := 3; offset < entriesOffset; offset += 2 {
+			buckets = append(buckets, int(binary.BigEndian.Uint16(data[offset:offset+2])))
+		}
+
+		idLen := len(entity.ZeroId)
+		versions := make(map[entity.Id]int)
+		for offset := entriesOffset; offset < len(data); offset += digestEntryLength {
+			deviceId := entity.Id(data[offset : offset+idLen])
+			if _, ok := versions[deviceId]; ok {
+				return nil, nil, false, ErrPayloadFormat // duplicate device
+			}
+			versions[deviceId] = int(utils.BytesToInt64(data[offset+idLen : offset+digestEntryLength]))
+		}
+
+		if err := validateTreeLeaves(buckets, versions); err != nil {
+			return nil, nil, false, err
+		}
+		return buckets, versions, data[0] == 1, nil
+	}
+}
+
+// NewPingMessageProvider returns a function that creates a ping message
+// for the peer with the given id.
+func NewPingMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.Id) (entity.Message, error) {
+
+	return func(targetId entity.Id) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufProbeId(targetId)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventPing, encoding, data), nil
+		} else {
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventPing, targetId.Bytes()), nil
+		}
+	}
+}
+
+func NewPingMessageReader() func(entity.Message) (entity.Id, error) {
+	return func(message entity.Message) (entity.Id, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufProbeId("ping target id", message.GetData())
+		}
+		return readId("ping data", message.GetData())
+	}
+}
+
+// NewPingRequestMessageProvider returns a function that creates a message
+// asking the receiver to ping the given peer on our behalf.
+func NewPingRequestMessageProvider(
 	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
 ) func(entity.Peer) (entity.Message, error) {
 
-	return func(peer entity.Peer) (entity.Message, error) {
+	return func(target entity.Peer) (entity.Message, error) {
 		if hostId, err := getHostId(); err != nil {
 			return nil, err
 		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufPeer(target)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventPingRequest, encoding, data), nil
 		} else {
 			writer := bytes.NewBuffer([]byte{})
-			writer.Write(peer.GetId().Bytes())
-			writer.Write([]byte(peer.GetAddress()))
-			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventPeer, writer.Bytes()), nil
+			writer.Write(target.GetId().Bytes())
+			writer.Write([]byte(target.GetAddress()))
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventPingRequest, writer.Bytes()), nil
 		}
 	}
 }
 
-func NewPeerMessageReader() func(entity.Message) (entity.Peer, error) {
+// NewPingRequestMessageReader returns a function that reads the peer to
+// ping from a ping request.
+func NewPingRequestMessageReader() func(entity.Message) (entity.Peer, error) {
 	return func(message entity.Message) (entity.Peer, error) {
-		reader := bytes.NewBuffer(message.GetData())
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufPeer(message.GetData())
+		}
+
+		data := message.GetData()
 		idLen := len(entity.ZeroId)
-		idBytes := reader.Next(idLen)
-		if deviceId, err := entity.NewBytesId(idBytes); err != nil {
+		if len(data) < idLen {
+			return nil, newMinLengthError("ping request data", len(data), idLen)
+		} else if address, err := readAddress(data[idLen:]); err != nil {
 			return nil, err
 		} else {
-			addressBytes := reader.Next(unit.MaxInt)
-			address := string(addressBytes)
-			peer := entity.NewPeer(deviceId, address)
-			return peer, nil
+			return entity.NewPeer(entity.Id(data[:idLen]), address), nil
 		}
 	}
 }
 
-func NewFarewellMessageProvider(
+// NewPingAckMessageProvider returns a function that creates an answer to
+// the ping, or ping request, with the given id.
+func NewPingAckMessageProvider(
 	getHostId func() (entity.Id, error),
-) func() (entity.Message, error) {
+	encoding entity.MessageEncoding,
+) func(entity.Id) (entity.Message, error) {
 
-	return func() (entity.Message, error) {
+	return func(probeId entity.Id) (entity.Message, error) {
 		if hostId, err := getHostId(); err != nil {
 			return nil, err
 		} else if msgId, err := entity.NewRandomId(); err != nil {
 			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufProbeId(probeId)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventPingAck, encoding, data), nil
 		} else {
-			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventFarewell, nil), nil
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventPingAck, probeId.Bytes()), nil
+		}
+	}
+}
+
+func NewPingAckMessageReader() func(entity.Message) (entity.Id, error) {
+	return func(message entity.Message) (entity.Id, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufProbeId("ping ack probe id", message.GetData())
+		}
+		return readId("ping ack data", message.GetData())
+	}
+}
+
+// The length of the fixed part of a binary membership message, preceding
+// the optional member address.
+const membershipHeaderLength = len(entity.ZeroId) + 1 + 8
+
+func NewMembershipMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.Member) (entity.Message, error) {
+
+	return func(member entity.Member) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufMembership(member)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventMembership, encoding, data), nil
+		} else {
+			writer := bytes.NewBuffer([]byte{})
+			writer.Write(member.GetId().Bytes())
+			writer.WriteByte(byte(member.GetState()))
+			writer.Write(utils.Int64ToBytes(int64(member.GetIncarnation())))
+			writer.Write([]byte(member.GetAddress()))
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventMembership, writer.Bytes()), nil
+		}
+	}
+}
+
+func NewMembershipMessageReader() func(entity.Message) (entity.Member, error) {
+	return func(message entity.Message) (entity.Member, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufMembership(message.GetData())
+		}
+
+		data := message.GetData()
+		idLen := len(entity.ZeroId)
+		if len(data) < membershipHeaderLength {
+			return nil, newMinLengthError("membership data", len(data), membershipHeaderLength)
+		} else if state := entity.MemberState(data[idLen]); !state.IsValid() {
+			return nil, ErrPayloadFormat
+		} else {
+			memberId := entity.Id(data[:idLen])
+			incarnation := int(utils.BytesToInt64(data[idLen+1 : membershipHeaderLength]))
+			return readMember(memberId, state, incarnation, data[membershipHeaderLength:])
+		}
+	}
+}
+
+// NewIHaveMessageProvider returns a function that creates a message
+// announcing the ids of messages we have, to a peer we only lazily push
+// messages to.
+func NewIHaveMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func([]entity.Id) (entity.Message, error) {
+
+	return func(messageIds []entity.Id) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufIHave(messageIds)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventIHave, encoding, data), nil
+		} else {
+			writer := bytes.NewBuffer([]byte{})
+			for _, messageId := range messageIds {
+				writer.Write(messageId.Bytes())
+			}
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventIHave, writer.Bytes()), nil
+		}
+	}
+}
+
+func NewIHaveMessageReader() func(entity.Message) ([]entity.Id, error) {
+	return func(message entity.Message) ([]entity.Id, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufIHave(message.GetData())
+		}
+
+		data := message.GetData()
+		idLen := len(entity.ZeroId)
+		if len(data) < idLen {
+			return nil, newMinLengthError("ihave data", len(data), idLen)
+		} else if partial := len(data) % idLen; partial != 0 {
+			return nil, newLengthError("ihave message id", partial, idLen)
+		}
+
+		result := make([]entity.Id, 0, len(data)/idLen)
+		for offset := 0; offset < len(data); offset += idLen {
+			result = append(result, entity.Id(data[offset:offset+idLen]))
+		}
+		return result, nil
+	}
+}
+
+// NewGraftMessageProvider returns a function that creates a message asking
+// the receiver to eagerly push messages to us from now on, starting with
+// the message with the given id.
+func NewGraftMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.Id) (entity.Message, error) {
+
+	return func(messageId entity.Id) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufProbeId(messageId)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventGraft, encoding, data), nil
+		} else {
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventGraft, messageId.Bytes()), nil
+		}
+	}
+}
+
+func NewGraftMessageReader() func(entity.Message) (entity.Id, error) {
+	return func(message entity.Message) (entity.Id, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufProbeId("graft message id", message.GetData())
+		}
+		return readId("graft data", message.GetData())
+	}
+}
+
+// NewPruneMessageProvider returns a function that creates a message asking
+// the receiver to only lazily push messages to us from now on.
+func NewPruneMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func() (entity.Message, error) {
+
+	return func() (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventPrune, encoding, nil), nil
+		}
+	}
+}
+
+// NewJoinMessageProvider returns a function that creates a message asking
+// the receiver to take us into its active view, and to introduce us to
+// its neighbors with the given record of our own.
+func NewJoinMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.SignedPeer) (entity.Message, error) {
+
+	return func(record entity.SignedPeer) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			data := encodePeerRecord(record, encoding)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventJoin, encoding, data), nil
+		}
+	}
+}
+
+// NewJoinMessageReader returns a function that reads the signed record of
+// the joining peer from a join message. The signature is not verified
+// here.
+func NewJoinMessageReader() func(entity.Message) (entity.SignedPeer, error) {
+	return func(message entity.Message) (entity.SignedPeer, error) {
+		return readPeerRecord(message.GetData(), message.GetEncoding())
+	}
+}
+
+// NewForwardJoinMessageProvider returns a function that creates a message
+// introducing a joining peer, by its signed record, on a random walk with
+// the given number of steps left.
+func NewForwardJoinMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.SignedPeer, int) (entity.Message, error) {
+
+	return func(joiner entity.SignedPeer, ttl int) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufPeerRecord(joiner)
+			data = writeProtobufVarint(data, 6, uint64(ttl))
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventForwardJoin, encoding, data), nil
+		} else {
+			data := append([]byte{byte(ttl)}, encodePeerRecord(joiner, encoding)...)
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventForwardJoin, data), nil
+		}
+	}
+}
+
+// NewForwardJoinMessageReader returns a function that reads the signed
+// record of the joining peer, and the steps left of the random walk, from
+// a forward join message. The signature is not verified here.
+func NewForwardJoinMessageReader() func(entity.Message) (entity.SignedPeer, int, error) {
+	return func(message entity.Message) (entity.SignedPeer, int, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufForwardJoin(message.GetData())
+		}
+
+		data := message.GetData()
+		if len(data) < 1 {
+			return nil, 0, newMinLengthError("forward join data", len(data), 1)
+		} else if joiner, err := readPeerRecord(data[1:], message.GetEncoding()); err != nil {
+			return nil, 0, err
+		} else {
+			return joiner, int(data[0]), nil
+		}
+	}
+}
+
+// NewDisconnectMessageProvider returns a function that creates a message
+// telling the receiver that we've dropped it from our active view.
+func NewDisconnectMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func() (entity.Message, error) {
+
+	return func() (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventDisconnect, encoding, nil), nil
+		}
+	}
+}
+
+// NewNeighborMessageProvider returns a function that creates a message
+// asking the receiver to take us into its active view. A high priority
+// request, sent when we have no active peers, is never turned down.
+func NewNeighborMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(bool) (entity.Message, error) {
+
+	return func(isHighPriority bool) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			data := encodeFlag(isHighPriority, encoding)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventNeighbor, encoding, data), nil
+		}
+	}
+}
+
+func NewNeighborMessageReader() func(entity.Message) (bool, error) {
+	return func(message entity.Message) (bool, error) {
+		return readFlag("neighbor priority", message)
+	}
+}
+
+// NewNeighborReplyMessageProvider returns a function that creates an
+// answer to a neighbor request, telling whether it was accepted.
+func NewNeighborReplyMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(bool) (entity.Message, error) {
+
+	return func(isAccepted bool) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			data := encodeFlag(isAccepted, encoding)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventNeighborReply, encoding, data), nil
+		}
+	}
+}
+
+func NewNeighborReplyMessageReader() func(entity.Message) (bool, error) {
+	return func(message entity.Message) (bool, error) {
+		return readFlag("neighbor reply accepted", message)
+	}
+}
+
+// NewShuffleMessageProvider returns a function that creates a message
+// offering the signed records of a sample of the peers we know of to the
+// host at the end of a random walk with the given number of steps left.
+// The host is to answer the origin of the walk directly.
+func NewShuffleMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func(entity.SignedPeer, []entity.SignedPeer, int) (entity.Message, error) {
+
+	return func(origin entity.SignedPeer, peers []entity.SignedPeer, ttl int) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := encodeProtobufShuffle(origin, peers, ttl)
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventShuffle, encoding, data), nil
+		} else {
+			data := []byte{byte(ttl)}
+			data = appendPeerRecordEntry(data, origin)
+			for _, peer := range peers {
+				data = appendPeerRecordEntry(data, peer)
+			}
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventShuffle, data), nil
+		}
+	}
+}
+
+// NewShuffleMessageReader returns a function that reads the signed records
+// of the origin and the offered peers, and the steps left of the random
+// walk, from a shuffle message. The signatures are not verified here.
+func NewShuffleMessageReader() func(entity.Message) (entity.SignedPeer, []entity.SignedPeer, int, error) {
+	return func(message entity.Message) (entity.SignedPeer, []entity.SignedPeer, int, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufShuffle(message.GetData())
+		}
+
+		data := message.GetData()
+		if len(data) < 1 {
+			return nil, nil, 0, newMinLengthError("shuffle data", len(data), 1)
+		} else if peers, err := readPeerRecordEntries(data[1:]); err != nil {
+			return nil, nil, 0, err
+		} else if len(peers) == 0 {
+			return nil, nil, 0, ErrPayloadFormat // no origin
+		} else {
+			return peers[0], peers[1:], int(data[0]), nil
+		}
+	}
+}
+
+// NewShuffleReplyMessageProvider returns a function that creates an answer
+// to a shuffle, offering the signed records of a sample of the peers we
+// know of in return.
+func NewShuffleReplyMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func([]entity.SignedPeer) (entity.Message, error) {
+
+	return func(peers []entity.SignedPeer) (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else if encoding == entity.MessageEncodingProtobuf {
+			data := []byte{}
+			for _, peer := range peers {
+				data = writeProtobufBytes(data, 1, encodeProtobufPeerRecord(peer))
+			}
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventShuffleReply, encoding, data), nil
+		} else {
+			data := []byte{}
+			for _, peer := range peers {
+				data = appendPeerRecordEntry(data, peer)
+			}
+			return entity.NewMessage(msgId, hostId, entity.MessageTypeEventShuffleReply, data), nil
+		}
+	}
+}
+
+// NewShuffleReplyMessageReader returns a function that reads the signed
+// records of the offered peers from a shuffle reply message. The
+// signatures are not verified here.
+func NewShuffleReplyMessageReader() func(entity.Message) ([]entity.SignedPeer, error) {
+	return func(message entity.Message) ([]entity.SignedPeer, error) {
+		if message.GetEncoding() == entity.MessageEncodingProtobuf {
+			return decodeProtobufShuffleReply(message.GetData())
+		}
+		return readPeerRecordEntries(message.GetData())
+	}
+}
+
+// NewHeartbeatMessageProvider returns a function that creates a message
+// telling the receiver that we're still around.
+func NewHeartbeatMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func() (entity.Message, error) {
+
+	return func() (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventHeartbeat, encoding, nil), nil
+		}
+	}
+}
+
+// NewBeaconMessageProvider returns a function that creates a message
+// asking any host hearing it, on the subnet it's broadcast to, to tell us
+// who it is.
+func NewBeaconMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func() (entity.Message, error) {
+
+	return func() (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventBeacon, encoding, nil), nil
+		}
+	}
+}
+
+func NewFarewellMessageProvider(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+) func() (entity.Message, error) {
+
+	return func() (entity.Message, error) {
+		if hostId, err := getHostId(); err != nil {
+			return nil, err
+		} else if msgId, err := entity.NewRandomId(); err != nil {
+			return nil, err
+		} else {
+			return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeEventFarewell, encoding, nil), nil
+		}
+	}
+}
+
+// Private helper functions
+func readPositionalSync(data []byte) (entity.Device, error) {
+	if len(data) != positionalSyncLength {
+		return nil, newLengthError("sync data", len(data), positionalSyncLength)
+	}
+
+	reader := bytes.NewBuffer(data)
+	idLen := len(entity.ZeroId)
+	deviceId := entity.Id(reader.Next(idLen))
+	ownerId := entity.Id(reader.Next(idLen))
+	typeValue, _ := reader.ReadByte()
+	stateValue, _ := reader.ReadByte()
+	version := utils.BytesToInt64(reader.Next(8))
+	deviceType := entity.DeviceType(typeValue)
+	deviceState := entity.DeviceState(stateValue)
+	device := entity.NewDevice(deviceId, ownerId, deviceType, deviceState, int(version))
+	return device, nil
+}
+
+// createPatchMessage creates a patch message. The binary layout appends
+// the patch id to retransmitted patches only:
+//
+//	device id(16) | state(1) [| patch id(16)]
+func createPatchMessage(
+	getHostId func() (entity.Id, error),
+	encoding entity.MessageEncoding,
+	deviceId entity.Id,
+	newState entity.DeviceState,
+	patchId entity.Id,
+) (entity.Message, error) {
+
+	if hostId, err := getHostId(); err != nil {
+		return nil, err
+	} else if msgId, err := entity.NewRandomId(); err != nil {
+		return nil, err
+	} else if encoding == entity.MessageEncodingProtobuf {
+		data := encodeProtobufPatch(deviceId, newState, patchId)
+		return entity.NewEncodedMessage(msgId, hostId, entity.MessageTypeCommandPatch, encoding, data), nil
+	} else {
+		writer := bytes.NewBuffer([]byte{})
+		writer.Write(deviceId.Bytes())
+		writer.Write(utils.ByteToBytes(byte(newState)))
+		if patchId != entity.ZeroId {
+			writer.Write(patchId.Bytes())
+		}
+		return entity.NewMessage(msgId, hostId, entity.MessageTypeCommandPatch, writer.Bytes()), nil
+	}
+}
+
+// readBinaryPatch returns a zero patch id if the patch isn't a
+// retransmission.
+func readBinaryPatch(data []byte) (entity.Id, entity.DeviceState, entity.Id, error) {
+	idLen := len(entity.ZeroId)
+	if len(data) == idLen+1 {
+		return entity.Id(data[:idLen]), entity.DeviceState(data[idLen]), entity.ZeroId, nil
+	} else if len(data) != 2*idLen+1 {
+		return entity.ZeroId, entity.DeviceStateOff, entity.ZeroId, newLengthError("patch data", len(data), idLen+1)
+	} else {
+		return entity.Id(data[:idLen]), entity.DeviceState(data[idLen]), entity.Id(data[idLen+1:]), nil
+	}
+}
+
+// readId reads an id from a field that must hold exactly one id.
+func readId(field string, data []byte) (entity.Id, error) {
+	if len(data) != len(entity.ZeroId) {
+		return entity.ZeroId, newLengthError(field, len(data), len(entity.ZeroId))
+	} else {
+		return entity.Id(data), nil
+	}
+}
+
+// readAddress reads a peer address, which must be given as "host:port".
+func readAddress(data []byte) (string, error) {
+	if len(data) == 0 || len(data) > maxPeerAddressLength {
+		return "", newRangeLengthError("peer address", len(data), 1, maxPeerAddressLength)
+	} else if !utf8.Valid(data) {
+		return "", ErrPayloadFormat
+	} else if _, _, err := net.SplitHostPort(string(data)); err != nil {
+		return "", ErrPayloadFormat
+	} else {
+		return string(data), nil
+	}
+}
+
+// A binary peer record holds the id of the peer, the time the record was
+// signed, the public key of the peer and its signature, followed by the
+// address of the peer:
+//
+//	id(16) | timestamp(8) | public key(32) | signature(64) | address
+func encodePeerRecord(record entity.SignedPeer, encoding entity.MessageEncoding) []byte {
+	if encoding == entity.MessageEncodingProtobuf {
+		return encodeProtobufPeerRecord(record)
+	}
+
+	data := append([]byte{}, record.GetId().Bytes()...)
+	data = append(data, timestampBytes(record.GetTimestamp())...)
+	data = append(data, record.GetPublicKey()...)
+	data = append(data, record.GetSignature()...)
+	return append(data, record.GetAddress()...)
+}
+
+func readPeerRecord(data []byte, encoding entity.MessageEncoding) (entity.SignedPeer, error) {
+	if encoding == entity.MessageEncodingProtobuf {
+		return decodeProtobufPeerRecord(data)
+	}
+
+	idLen := len(entity.ZeroId)
+	keyOffset := idLen + 8
+	signatureOffset := keyOffset + ed25519.PublicKeySize
+	if len(data) < peerRecordHeaderLength {
+		return nil, newMinLengthError("peer data", len(data), peerRecordHeaderLength)
+	} else if address, err := readAddress(data[peerRecordHeaderLength:]); err != nil {
+		return nil, err
+	} else {
+		return entity.NewSignedPeer(
+			entity.Id(data[:idLen]),
+			address,
+			time.UnixMilli(utils.BytesToInt64(data[idLen:keyOffset])),
+			data[keyOffset:signatureOffset],
+			data[signatureOffset:peerRecordHeaderLength],
+		), nil
+	}
+}
+
+// A binary peer record entry holds a peer record with the length of the
+// address preceding it, so that entries can follow each other:
+//
+//	id(16) | timestamp(8) | public key(32) | signature(64) | length(2) | address(length)
+func appendPeerRecordEntry(data []byte, record entity.SignedPeer) []byte {
+	data = append(data, record.GetId().Bytes()...)
+	data = append(data, timestampBytes(record.GetTimestamp())...)
+	data = append(data, record.GetPublicKey()...)
+	data = append(data, record.GetSignature()...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(record.GetAddress())))
+	return append(data, record.GetAddress()...)
+}
+
+func readPeerRecordEntries(data []byte) ([]entity.SignedPeer, error) {
+	result := make([]entity.SignedPeer, 0)
+	for len(data) > 0 {
+		if len(data) < peerRecordHeaderLength+2 {
+			return nil, newMinLengthError("peer record entry", len(data), peerRecordHeaderLength+2)
+		}
+
+		length := int(binary.BigEndian.Uint16(data[peerRecordHeaderLength : peerRecordHeaderLength+2]))
+		end := peerRecordHeaderLength + 2 + length
+		if len(data) < end {
+			return nil, newMinLengthError("peer record entry address", len(data)-peerRecordHeaderLength-2, length)
+		}
+
+		entry := append(append([]byte{}, data[:peerRecordHeaderLength]...), data[peerRecordHeaderLength+2:end]...)
+		if record, err := readPeerRecord(entry, entity.MessageEncodingBinary); err != nil {
+			return nil, err
+		} else {
+			result = append(result, record)
+			data = data[end:]
+		}
+	}
+	return result, nil
+}
+
+// Flags, e.g. the priority of a neighbor request, are a single byte in the
+// binary encoding and a bool in field 1 in the protobuf encoding.
+func encodeFlag(flag bool, encoding entity.MessageEncoding) []byte {
+	if encoding == entity.MessageEncodingProtobuf {
+		return encodeProtobufFlag(flag)
+	} else if flag {
+		return []byte{1}
+	} else {
+		return []byte{0}
+	}
+}
+
+func readFlag(field string, message entity.Message) (bool, error) {
+	data := message.GetData()
+	if message.GetEncoding() == entity.MessageEncodingProtobuf {
+		return decodeProtobufFlag(data)
+	} else if len(data) != 1 {
+		return false, newLengthError(field, len(data), 1)
+	} else if data[0] > 1 {
+		return false, ErrPayloadFormat
+	} else {
+		return data[0] == 1, nil
+	}
+}
+
+func frameMessage(
+	signMessage func(entity.Message, byte) (entity.Message, error),
+	version byte,
+	message entity.Message,
+) ([]byte, error) {
+	signed, err := signMessage(message, version)
+	if err != nil {
+		log.Error("Failed signing message %s (type=%s)", message.GetId(), message.GetType())
+		return nil, err
+	}
+
+	header := frameHeader{version: version, flags: FrameFlagsNone}
+	frame, err := encodeFrame(header, signed)
+	if err != nil {
+		log.Error("Failed encoding message %s (type=%s, version=%d)", message.GetId(), message.GetType(), version)
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// signedBytes returns the parts of the message covered by its signature.
+// The timestamp and the encoding are only included when they are set and
+// not the original binary one respectively, so that signatures made by
+// older hosts remain valid.
+func signedBytes(message entity.Message) []byte {
+	writer := bytes.NewBuffer([]byte{})
+	writer.Write(message.GetId().Bytes())
+	writer.Write(message.GetType().Bytes())
+	writer.Write(message.GetSender().Bytes())
+	if timestamp := message.GetTimestamp(); !timestamp.IsZero() {
+		writer.Write(timestampBytes(timestamp))
+	}
+	if encoding := message.GetEncoding(); encoding != entity.MessageEncodingBinary {
+		writer.WriteByte(byte(encoding))
+	}
+	writer.Write(message.GetData())
+	return writer.Bytes()
+}
+
+// Peer records are signed with a context of their own, so that their
+// signatures can't be mistaken for message signatures, or vice versa.
+var peerRecordContext = []byte("FUDP peer record")
+
+func peerRecordBytes(id entity.Id, address string, timestamp time.Time) []byte {
+	writer := bytes.NewBuffer([]byte{})
+	writer.Write(peerRecordContext)
+	writer.Write(id.Bytes())
+	writer.Write(timestampBytes(timestamp))
+	writer.Write([]byte(address))
+	return writer.Bytes()
+}
+
+// readMember reads the address of a member, which is optional as a host
+// declaring a member dead doesn't need to know where it was.
+func readMember(memberId entity.Id, state entity.MemberState, incarnation int, address []byte) (entity.Member, error) {
+	if len(address) == 0 {
+		return entity.NewMember(memberId, "", state, incarnation), nil
+	} else if address, err := readAddress(address); err != nil {
+		return nil, err
+	} else {
+		return entity.NewMember(memberId, address, state, incarnation), nil
+	}
+}
+
+// validateTreeLeaves checks that the given buckets are valid and distinct
+// and that each device lives in one of them.
+func validateTreeLeaves(buckets []int, versions map[entity.Id]int) error {
+	listed := make(map[int]bool)
+	for _, bucket := range buckets {
+		if bucket < 0 || bucket >= entity.MerkleTreeBucketCount || listed[bucket] {
+			return ErrPayloadFormat
+		}
+		listed[bucket] = true
+	}
+	for deviceId := range versions {
+		if !listed[entity.MerkleBucket(deviceId)] {
+			return ErrPayloadFormat
 		}
 	}
+	return nil
 }
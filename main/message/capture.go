@@ -0,0 +1,269 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/echsylon/go-log"
+)
+
+// Capture files hold every datagram a host has sent or received, exactly
+// as they went over the wire, in the order they did so:
+//
+//	magic(4) | version(1) | [record]...
+//
+// Each record is laid out as:
+//
+//	time(8) | direction(1) | address length(2) | address | length(4) | datagram
+//
+// The time is given in nanoseconds since the Unix epoch.
+type CaptureDirection byte
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureDirectionInbound:
+		return "inbound"
+	case CaptureDirectionOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	CaptureDirectionInbound CaptureDirection = iota + 1
+	CaptureDirectionOutbound
+)
+
+const (
+	captureFormatVersion byte = 1
+	captureHeaderLength       = 5
+	captureRecordLength       = 8 + 1 + 2 + 4
+)
+
+var captureMagic = []byte("FUDC")
+
+var ErrCaptureFormat = errors.New("capture format error")
+
+type CapturedDatagram struct {
+	Time      time.Time
+	Direction CaptureDirection
+	Address   string
+	Data      []byte
+}
+
+type CaptureFile interface {
+	Record(CaptureDirection, string, []byte) error
+	Close() error
+}
+
+type captureFile struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewCaptureFile creates, or truncates, the capture file at the given path.
+func NewCaptureFile(path string) (CaptureFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(file)
+	writer.Write(captureMagic)
+	writer.WriteByte(captureFormatVersion)
+	return &captureFile{file: file, writer: writer}, nil
+}
+
+// Record appends the given datagram to the capture file. Records are
+// flushed to disk as they are written, so that nothing is lost if the
+// host is killed.
+func (c *captureFile) Record(direction CaptureDirection, address string, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.writer == nil {
+		return os.ErrClosed
+	}
+
+	header := make([]byte, 0, captureRecordLength+len(address))
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().UnixNano()))
+	header = append(header, byte(direction))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(address)))
+	header = append(header, address...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(data)))
+	c.writer.Write(header)
+	c.writer.Write(data)
+	return c.writer.Flush()
+}
+
+func (c *captureFile) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.writer == nil {
+		return nil
+	}
+
+	err := c.writer.Flush()
+	c.writer = nil
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadCaptureFile reads all datagrams from the capture file at the given
+// path. A record cut short, e.g. by the host being killed while writing
+// it, ends the capture.
+func ReadCaptureFile(path string) ([]CapturedDatagram, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	} else if len(data) < captureHeaderLength || !bytes.HasPrefix(data, captureMagic) {
+		return nil, ErrCaptureFormat
+	} else if data[len(captureMagic)] != captureFormatVersion {
+		return nil, ErrCaptureFormat
+	}
+
+	result := make([]CapturedDatagram, 0)
+	reader := bytes.NewReader(data[captureHeaderLength:])
+	for reader.Len() > 0 {
+		var nanos uint64
+		var direction byte
+		var addressLength uint16
+		var dataLength uint32
+		if err := binary.Read(reader, binary.BigEndian, &nanos); err != nil {
+			break
+		} else if direction, err = reader.ReadByte(); err != nil {
+			break
+		} else if err := binary.Read(reader, binary.BigEndian, &addressLength); err != nil {
+			break
+		}
+
+		address := make([]byte, addressLength)
+		if _, err := io.ReadFull(reader, address); err != nil {
+			break
+		} else if err := binary.Read(reader, binary.BigEndian, &dataLength); err != nil {
+			break
+		} else if int64(dataLength) > int64(reader.Len()) {
+			break
+		}
+
+		datagram := make([]byte, dataLength)
+		io.ReadFull(reader, datagram)
+		result = append(result, CapturedDatagram{
+			Time:      time.Unix(0, int64(nanos)),
+			Direction: CaptureDirection(direction),
+			Address:   string(address),
+			Data:      datagram,
+		})
+	}
+
+	if reader.Len() > 0 {
+		log.Warning("Capture file %s ends with a partial record, ignoring it", path)
+	}
+
+	return result, nil
+}
+
+// NewCapturingSender returns a function that records each outbound
+// datagram before handing it to the given send function.
+func NewCapturingSender(
+	record func(CaptureDirection, string, []byte) error,
+	sendDatagram func(string, []byte) error,
+) func(string, []byte) error {
+
+	return func(address string, data []byte) error {
+		if err := record(CaptureDirectionOutbound, address, data); err != nil {
+			log.Warning("Failed capturing %d bytes sent to %s", len(data), address)
+		}
+		return sendDatagram(address, data)
+	}
+}
+
+// NewCapturingReceiver returns a function that records each inbound
+// datagram before handing it to the given receive function.
+func NewCapturingReceiver(
+	record func(CaptureDirection, string, []byte) error,
+	receiveDatagram func(string, []byte) error,
+) func(string, []byte) error {
+
+	return func(sender string, data []byte) error {
+		if err := record(CaptureDirectionInbound, sender, data); err != nil {
+			log.Warning("Failed capturing %d bytes received from %s", len(data), sender)
+		}
+		return receiveDatagram(sender, data)
+	}
+}
+
+// NewDryRunSender returns a function that drops, and logs, each outbound
+// datagram while the given predicate holds, and hands it to the given send
+// function otherwise.
+func NewDryRunSender(
+	isDryRun func() bool,
+	sendDatagram func(string, []byte) error,
+) func(string, []byte) error {
+
+	return func(address string, data []byte) error {
+		if isDryRun() {
+			log.Debug("Dropping %d bytes sent to %s during dry run", len(data), address)
+			return nil
+		}
+		return sendDatagram(address, data)
+	}
+}
+
+// NewReplayCaptureUseCase returns a function that feeds the inbound
+// datagrams of a capture file to the given receive function, keeping the
+// original time between them divided by the given speed. A speed of zero
+// replays the datagrams as fast as possible. Replaying stops early if the
+// given context is cancelled.
+func NewReplayCaptureUseCase(
+	readCapture func(string) ([]CapturedDatagram, error),
+	receiveDatagram func(string, []byte) error,
+) func(context.Context, string, float64) error {
+
+	return func(ctxt context.Context, path string, speed float64) error {
+		datagrams, err := readCapture(path)
+		if err != nil {
+			log.Error("Failed reading capture file %s", path)
+			return err
+		}
+
+		log.Information("Replaying %d datagrams from %s", len(datagrams), path)
+		var previous time.Time
+		count := 0
+		for _, datagram := range datagrams {
+			if datagram.Direction != CaptureDirectionInbound {
+				continue
+			}
+
+			if speed > 0 && !previous.IsZero() {
+				delay := time.Duration(float64(datagram.Time.Sub(previous)) / speed)
+				select {
+				case <-ctxt.Done():
+					return ctxt.Err()
+				case <-time.After(delay):
+				}
+			} else if ctxt.Err() != nil {
+				return ctxt.Err()
+			}
+
+			previous = datagram.Time
+			if err := receiveDatagram(datagram.Address, datagram.Data); err != nil {
+				log.Debug("Failed handling replayed datagram from %s: %s", datagram.Address, err.Error())
+			}
+			count++
+		}
+
+		log.Information("Replayed %d inbound datagrams from %s", count, path)
+		return nil
+	}
+}
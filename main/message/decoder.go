@@ -0,0 +1,350 @@
+package message
+
+import (
+	"crypto/cipher"
+	"echsylon/fudpucker/entity"
+	"encoding/hex"
+	"maps"
+	"time"
+)
+
+// Human readable names of the frame header flags, in bit order.
+var frameFlagNames = []struct {
+	flag byte
+	name string
+}{
+	{FrameFlagBatch, "batch"},
+	{FrameFlagFragment, "fragment"},
+	{FrameFlagEncrypted, "encrypted"},
+	{FrameFlagProtobuf, "protobuf"},
+}
+
+// NewFrameDescriber returns a function that describes a raw datagram, as
+// received by the message server, in a JSON friendly form. Encrypted
+// datagrams are only described beyond their header if a cipher is given.
+// Fragments are described alone, as they can't be reassembled from a
+// single datagram. Payloads are read with the given message readers.
+func NewFrameDescriber(
+	aead cipher.AEAD,
+	verifyMessage func(entity.Message) error,
+	readHail func(entity.Message) (byte, error),
+	readPatch func(entity.Message) (entity.Id, entity.DeviceState, entity.Id, error),
+	readSync func(entity.Message) (entity.Device, error),
+	readPeer func(entity.Message) (entity.SignedPeer, error),
+	readPatchReply func(entity.Message) (entity.PatchOutcome, error),
+	readDigest func(entity.Message) (map[entity.Id]int, bool, error),
+	readTreeNodes func(entity.Message) (int, map[int][]byte, error),
+	readTreeLeaves func(entity.Message) ([]int, map[entity.Id]int, bool, error),
+	readPing func(entity.Message) (entity.Id, error),
+	readPingRequest func(entity.Message) (entity.Peer, error),
+	readPingAck func(entity.Message) (entity.Id, error),
+	readMembership func(entity.Message) (entity.Member, error),
+	readIHave func(entity.Message) ([]entity.Id, error),
+	readGraft func(entity.Message) (entity.Id, error),
+	readJoin func(entity.Message) (entity.SignedPeer, error),
+	readForwardJoin func(entity.Message) (entity.SignedPeer, int, error),
+	readNeighbor func(entity.Message) (bool, error),
+	readNeighborReply func(entity.Message) (bool, error),
+	readShuffle func(entity.Message) (entity.SignedPeer, []entity.SignedPeer, int, error),
+	readShuffleReply func(entity.Message) ([]entity.SignedPeer, error),
+) func([]byte) (map[string]any, error) {
+
+	describePayload := func(message entity.Message) (map[string]any, error) {
+		result := make(map[string]any)
+		switch message.GetType() {
+		case entity.MessageTypeCommandHail:
+			if version, err := readHail(message); err != nil {
+				return nil, err
+			} else {
+				result["version"] = version
+			}
+
+		case entity.MessageTypeCommandPatch:
+			if deviceId, state, patchId, err := readPatch(message); err != nil {
+				return nil, err
+			} else {
+				result["device"] = deviceId.String()
+				result["state"] = state
+				result["patch"] = patchId.String()
+			}
+
+		case entity.MessageTypeEventSync:
+			if device, err := readSync(message); err != nil {
+				return nil, err
+			} else {
+				result["id"] = device.GetId().String()
+				result["owner"] = device.GetOwner().String()
+				result["type"] = device.GetType()
+				result["state"] = device.GetState()
+				result["version"] = device.GetVersion()
+				if extras := device.GetExtraAttributes(); len(extras) > 0 {
+					attributes := make(map[byte]string)
+					for tag, value := range extras {
+						attributes[tag] = hex.EncodeToString(value)
+					}
+					result["extras"] = attributes
+				}
+			}
+
+		case entity.MessageTypeEventPeer:
+			if peer, err := readPeer(message); err != nil {
+				return nil, err
+			} else {
+				maps.Copy(result, describePeerRecord(peer))
+			}
+
+		case entity.MessageTypeEventPatchReply:
+			if outcome, err := readPatchReply(message); err != nil {
+				return nil, err
+			} else {
+				result["patch"] = outcome.GetPatchId().String()
+				result["accepted"] = outcome.IsAccepted()
+				result["version"] = outcome.GetVersion()
+				result["reason"] = outcome.GetReason()
+			}
+
+		case entity.MessageTypeEventDigest:
+			if versions, isReply, err := readDigest(message); err != nil {
+				return nil, err
+			} else {
+				devices := make(map[string]int)
+				for deviceId, version := range versions {
+					devices[deviceId.String()] = version
+				}
+				result["reply"] = isReply
+				result["devices"] = devices
+			}
+
+		case entity.MessageTypeEventTreeNodes:
+			if level, hashes, err := readTreeNodes(message); err != nil {
+				return nil, err
+			} else {
+				nodes := make(map[int]string)
+				for index, hash := range hashes {
+					nodes[index] = hex.EncodeToString(hash)
+				}
+				result["level"] = level
+				result["nodes"] = nodes
+			}
+
+		case entity.MessageTypeEventTreeLeaves:
+			if buckets, versions, isFinal, err := readTreeLeaves(message); err != nil {
+				return nil, err
+			} else {
+				devices := make(map[string]int)
+				for deviceId, version := range versions {
+					devices[deviceId.String()] = version
+				}
+				result["final"] = isFinal
+				result["buckets"] = buckets
+				result["devices"] = devices
+			}
+
+		case entity.MessageTypeEventPing:
+			if targetId, err := readPing(message); err != nil {
+				return nil, err
+			} else {
+				result["target"] = targetId.String()
+			}
+
+		case entity.MessageTypeEventPingRequest:
+			if target, err := readPingRequest(message); err != nil {
+				return nil, err
+			} else {
+				result["target"] = target.GetId().String()
+				result["address"] = target.GetAddress()
+			}
+
+		case entity.MessageTypeEventPingAck:
+			if probeId, err := readPingAck(message); err != nil {
+				return nil, err
+			} else {
+				result["probe"] = probeId.String()
+			}
+
+		case entity.MessageTypeEventMembership:
+			if member, err := readMembership(message); err != nil {
+				return nil, err
+			} else {
+				result["member"] = member.GetId().String()
+				result["state"] = member.GetState().String()
+				result["incarnation"] = member.GetIncarnation()
+				if address := member.GetAddress(); address != "" {
+					result["address"] = address
+				}
+			}
+
+		case entity.MessageTypeEventIHave:
+			if messageIds, err := readIHave(message); err != nil {
+				return nil, err
+			} else {
+				messages := make([]string, 0, len(messageIds))
+				for _, messageId := range messageIds {
+					messages = append(messages, messageId.String())
+				}
+				result["messages"] = messages
+			}
+
+		case entity.MessageTypeEventGraft:
+			if messageId, err := readGraft(message); err != nil {
+				return nil, err
+			} else {
+				result["message"] = messageId.String()
+			}
+
+		case entity.MessageTypeEventJoin:
+			if joiner, err := readJoin(message); err != nil {
+				return nil, err
+			} else {
+				result["peer"] = describePeerRecord(joiner)
+			}
+
+		case entity.MessageTypeEventForwardJoin:
+			if joiner, ttl, err := readForwardJoin(message); err != nil {
+				return nil, err
+			} else {
+				result["peer"] = describePeerRecord(joiner)
+				result["ttl"] = ttl
+			}
+
+		case entity.MessageTypeEventNeighbor:
+			if isHighPriority, err := readNeighbor(message); err != nil {
+				return nil, err
+			} else {
+				result["highPriority"] = isHighPriority
+			}
+
+		case entity.MessageTypeEventNeighborReply:
+			if isAccepted, err := readNeighborReply(message); err != nil {
+				return nil, err
+			} else {
+				result["accepted"] = isAccepted
+			}
+
+		case entity.MessageTypeEventShuffle:
+			if origin, peers, ttl, err := readShuffle(message); err != nil {
+				return nil, err
+			} else {
+				result["origin"] = describePeerRecord(origin)
+				result["peers"] = describePeerRecords(peers)
+				result["ttl"] = ttl
+			}
+
+		case entity.MessageTypeEventShuffleReply:
+			if peers, err := readShuffleReply(message); err != nil {
+				return nil, err
+			} else {
+				result["peers"] = describePeerRecords(peers)
+			}
+		}
+		return result, nil
+	}
+
+	describeMessage := func(message entity.Message) map[string]any {
+		result := make(map[string]any)
+		result["id"] = message.GetId().String()
+		result["type"] = message.GetType().String()
+		result["sender"] = message.GetSender().String()
+		result["encoding"] = message.GetEncoding().String()
+		result["hops"] = message.GetHops()
+		result["publicKey"] = hex.EncodeToString(message.GetPublicKey())
+		result["signature"] = hex.EncodeToString(message.GetSignature())
+		result["verified"] = verifyMessage(message) == nil
+		if timestamp := message.GetTimestamp(); !timestamp.IsZero() {
+			result["timestamp"] = timestamp.UTC().Format(time.RFC3339Nano)
+		}
+
+		if payload, err := describePayload(message); err != nil {
+			result["data"] = hex.EncodeToString(message.GetData())
+			result["error"] = err.Error()
+		} else {
+			result["payload"] = payload
+		}
+		return result
+	}
+
+	var describeFrame func([]byte) (map[string]any, error)
+	describeFrame = func(data []byte) (map[string]any, error) {
+		header, body, err := readFrameHeader(data)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := make([]string, 0)
+		for _, item := range frameFlagNames {
+			if header.flags&item.flag != 0 {
+				flags = append(flags, item.name)
+			}
+		}
+
+		result := make(map[string]any)
+		result["version"] = header.version
+		result["flags"] = flags
+		result["length"] = len(data)
+
+		if header.flags&FrameFlagEncrypted != 0 {
+			if aead == nil {
+				result["error"] = "no network key given"
+			} else if len(body) < nonceLength+tagLength {
+				return nil, ErrFrameFormat
+			} else if plain, err := aead.Open(nil, body[:nonceLength], body[nonceLength:], data[:frameHeaderLength]); err != nil {
+				return nil, err
+			} else if frame, err := describeFrame(plain); err != nil {
+				return nil, err
+			} else {
+				result["frame"] = frame
+			}
+		} else if header.flags&FrameFlagFragment != 0 {
+			if fragmentId, index, count, payload, err := readFragment(data); err != nil {
+				return nil, err
+			} else {
+				result["fragment"] = fragmentId.String()
+				result["index"] = index
+				result["count"] = count
+				result["data"] = hex.EncodeToString(payload)
+			}
+		} else if header.flags&FrameFlagBatch != 0 {
+			frames, err := unpackBatch(body)
+			if err != nil {
+				return nil, err
+			}
+
+			descriptions := make([]map[string]any, 0, len(frames))
+			for _, frame := range frames {
+				if description, err := describeFrame(frame); err != nil {
+					return nil, err
+				} else {
+					descriptions = append(descriptions, description)
+				}
+			}
+			result["frames"] = descriptions
+		} else if _, message, err := decodeFrame(data); err != nil {
+			return nil, err
+		} else {
+			result["message"] = describeMessage(message)
+		}
+
+		return result, nil
+	}
+
+	return describeFrame
+}
+
+// Private helper functions
+func describePeerRecord(record entity.SignedPeer) map[string]any {
+	return map[string]any{
+		"id":        record.GetId().String(),
+		"address":   record.GetAddress(),
+		"timestamp": record.GetTimestamp().UTC().Format(time.RFC3339Nano),
+		"publicKey": hex.EncodeToString(record.GetPublicKey()),
+		"signature": hex.EncodeToString(record.GetSignature()),
+	}
+}
+
+func describePeerRecords(records []entity.SignedPeer) []map[string]any {
+	result := make([]map[string]any, 0, len(records))
+	for _, record := range records {
+		result = append(result, describePeerRecord(record))
+	}
+	return result
+}
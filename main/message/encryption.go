@@ -0,0 +1,96 @@
+package message
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted datagrams wrap any other frame, fragments included:
+//
+//	magic(4) | version(1) | flags(1) | nonce(12) | ciphertext(n) | tag(16)
+//
+// The header is authenticated, but not encrypted.
+const (
+	nonceLength = 12
+	tagLength   = 16
+
+	// The number of bytes encryption adds to each datagram.
+	EncryptionOverhead = frameHeaderLength + nonceLength + tagLength
+)
+
+// The network key is stretched with scrypt into the AES-256 key. The salt
+// is fixed, as all peers must derive the same key, so it only separates
+// our keys from those of other applications.
+const (
+	keyDerivationSalt = "fudpucker network key"
+	keyDerivationN    = 1 << 15
+	keyDerivationR    = 8
+	keyDerivationP    = 1
+	keyLength         = 32
+)
+
+var ErrNotEncrypted = errors.New("datagram not encrypted")
+
+// NewNetworkCipher derives an AES-256-GCM cipher from the pre-shared
+// network key, using scrypt.
+func NewNetworkCipher(networkKey string) (cipher.AEAD, error) {
+	if key, err := scrypt.Key([]byte(networkKey), []byte(keyDerivationSalt), keyDerivationN, keyDerivationR, keyDerivationP, keyLength); err != nil {
+		return nil, err
+	} else if block, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCMWithNonceSize(block, nonceLength)
+	}
+}
+
+// NewEncryptingSender returns a function that encrypts each datagram with
+// the given cipher and a random nonce before handing it to the given send
+// function.
+func NewEncryptingSender(
+	aead cipher.AEAD,
+	sendDatagram func(string, []byte) error,
+) func(string, []byte) error {
+
+	return func(address string, data []byte) error {
+		writer := bytes.NewBuffer([]byte{})
+		writeFrameHeader(writer, frameHeader{version: ProtocolVersion, flags: FrameFlagEncrypted})
+		header := bytes.Clone(writer.Bytes())
+
+		nonce := make([]byte, nonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		writer.Write(nonce)
+		writer.Write(aead.Seal(nil, nonce, data, header))
+		return sendDatagram(address, writer.Bytes())
+	}
+}
+
+// NewDecryptingReceiver returns a function that decrypts each datagram
+// with the given cipher before handing it to the given receive function.
+// Datagrams that aren't encrypted, or that fail to decrypt, are rejected.
+func NewDecryptingReceiver(
+	aead cipher.AEAD,
+	receiveDatagram func(string, []byte) error,
+) func(string, []byte) error {
+
+	return func(sender string, data []byte) error {
+		if header, body, err := readFrameHeader(data); err != nil {
+			return err
+		} else if header.flags&FrameFlagEncrypted == 0 {
+			return ErrNotEncrypted
+		} else if len(body) < nonceLength+tagLength {
+			return ErrFrameFormat
+		} else if plain, err := aead.Open(nil, body[:nonceLength], body[nonceLength:], data[:frameHeaderLength]); err != nil {
+			return err
+		} else {
+			return receiveDatagram(sender, plain)
+		}
+	}
+}
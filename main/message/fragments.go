@@ -0,0 +1,269 @@
+package message
+
+import (
+	"bytes"
+	"echsylon/fudpucker/entity"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/echsylon/go-log"
+)
+
+// Frames that don't fit in a single datagram are split into fragments:
+//
+//	magic(4) | version(1) | flags(1) | fragment id(16) | index(2) | count(2) | payload
+//
+// No frame is larger than the max frame length, and no sender splits
+// frames into fragments smaller than the min fragment payload, unless the
+// frame is smaller than that, which bounds the fragment count.
+const (
+	fragmentHeaderLength  = frameHeaderLength + len(entity.ZeroId) + 4
+	minFragmentPayloadLen = 512
+	maxFragmentCount      = (maxFrameLength + minFragmentPayloadLen - 1) / minFragmentPayloadLen
+)
+
+// The fragment slots of a partial frame are allocated up front, from the
+// fragment count, and are counted towards the capacity like the payloads.
+const (
+	defaultReassemblyTimeout  = 5 * time.Second
+	defaultReassemblyCapacity = 16 * maxFrameLength
+	maxPartialFrames          = 256
+	maxPartialFramesPerSender = 8
+	fragmentSlotSize          = 24 // a slice header on 64 bit platforms
+)
+
+type ReassemblyBuffer interface {
+	Add(string, []byte) ([]byte, error)
+	Reset()
+}
+
+type partialFrame struct {
+	sender    string
+	fragments [][]byte
+	received  int
+	size      int
+	overhead  int
+	deadline  time.Time
+}
+
+type reassemblyBuffer struct {
+	lock     sync.Mutex
+	frames   map[string]*partialFrame
+	senders  map[string]int
+	size     int
+	capacity int
+	timeout  time.Duration
+}
+
+func NewReassemblyBuffer() ReassemblyBuffer {
+	return &reassemblyBuffer{
+		frames:   make(map[string]*partialFrame),
+		senders:  make(map[string]int),
+		capacity: defaultReassemblyCapacity,
+		timeout:  defaultReassemblyTimeout,
+	}
+}
+
+// Add stores the given fragment, received from the given address, and
+// returns the reassembled frame once all its fragments have arrived. A nil
+// frame and nil error means that more fragments are needed.
+func (b *reassemblyBuffer) Add(sender string, data []byte) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.clearOutdated()
+
+	fragmentId, index, count, payload, err := readFragment(data)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sender + fragmentId.String()
+	frame, ok := b.frames[key]
+	if !ok {
+		if b.senders[sender] >= maxPartialFramesPerSender {
+			log.Debug("Too many incomplete frames from %s, dropping fragment", sender)
+			return nil, ErrFrameFormat
+		}
+		frame = &partialFrame{
+			sender:    sender,
+			fragments: make([][]byte, count),
+			overhead:  count * fragmentSlotSize,
+			deadline:  time.Now().Add(b.timeout),
+		}
+		b.frames[key] = frame
+		b.senders[sender]++
+		b.size += frame.overhead
+	}
+
+	if len(frame.fragments) != count {
+		return nil, ErrFrameFormat
+	} else if frame.fragments[index] != nil {
+		return nil, nil // duplicate
+	} else if frame.size+len(payload) > maxFrameLength {
+		b.drop(key)
+		return nil, ErrFrameFormat
+	}
+
+	frame.fragments[index] = bytes.Clone(payload)
+	frame.received++
+	frame.size += len(payload)
+	b.size += len(payload)
+
+	if frame.received < count {
+		b.enforceCapacity(key)
+		return nil, nil
+	}
+
+	b.drop(key)
+	return bytes.Join(frame.fragments, nil), nil
+}
+
+func (b *reassemblyBuffer) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	clear(b.frames)
+	clear(b.senders)
+	b.size = 0
+}
+
+func (b *reassemblyBuffer) drop(key string) {
+	if frame, ok := b.frames[key]; ok {
+		b.size -= frame.size + frame.overhead
+		delete(b.frames, key)
+		b.senders[frame.sender]--
+		if b.senders[frame.sender] <= 0 {
+			delete(b.senders, frame.sender)
+		}
+	}
+}
+
+func (b *reassemblyBuffer) clearOutdated() {
+	now := time.Now()
+	for key, frame := range b.frames {
+		if frame.deadline.Before(now) {
+			log.Debug("Dropping incomplete frame, %d of %d fragments received", frame.received, len(frame.fragments))
+			b.drop(key)
+		}
+	}
+}
+
+// enforceCapacity drops the incomplete frames closest to their deadline
+// until the buffer is within its memory and frame count limits again. The
+// frame that is currently being assembled is dropped last.
+func (b *reassemblyBuffer) enforceCapacity(current string) {
+	for b.size > b.capacity || len(b.frames) > maxPartialFrames {
+		oldestKey := ""
+		for key, frame := range b.frames {
+			if key == current {
+				continue
+			} else if oldest, ok := b.frames[oldestKey]; !ok || frame.deadline.Before(oldest.deadline) {
+				oldestKey = key
+			}
+		}
+		if oldestKey == "" {
+			oldestKey = current
+		}
+		log.Debug("Reassembly buffer full, dropping incomplete frame")
+		b.drop(oldestKey)
+	}
+}
+
+// NewFragmentingSender returns a function that splits frames larger than
+// the max datagram size into numbered fragments before handing them to
+// the given send function. Legacy frames are sent as they are since legacy
+// peers don't know how to reassemble them.
+func NewFragmentingSender(
+	sendDatagram func(string, []byte) error,
+	maxDatagramSize int,
+) func(string, []byte) error {
+
+	return func(address string, data []byte) error {
+		if len(data) <= maxDatagramSize {
+			return sendDatagram(address, data)
+		}
+
+		header, _, err := readFrameHeader(data)
+		if err != nil {
+			return err
+		} else if header.version == ProtocolVersionLegacy {
+			return sendDatagram(address, data)
+		}
+
+		payloadSize := maxDatagramSize - fragmentHeaderLength
+		if payloadSize <= 0 {
+			return ErrFrameFormat
+		}
+
+		count := (len(data) + payloadSize - 1) / payloadSize
+		if count > maxFragmentCount {
+			return ErrFrameFormat
+		}
+
+		fragmentId, err := entity.NewRandomId()
+		if err != nil {
+			return err
+		}
+
+		for index := 0; index < count; index++ {
+			start := index * payloadSize
+			end := min(start+payloadSize, len(data))
+			writer := bytes.NewBuffer([]byte{})
+			writeFrameHeader(writer, frameHeader{version: header.version, flags: FrameFlagFragment})
+			writer.Write(fragmentId.Bytes())
+			writer.Write(binary.BigEndian.AppendUint16(nil, uint16(index)))
+			writer.Write(binary.BigEndian.AppendUint16(nil, uint16(count)))
+			writer.Write(data[start:end])
+			if err := sendDatagram(address, writer.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		log.Debug("Sent %d bytes in %d fragments to %s", len(data), count, address)
+		return nil
+	}
+}
+
+// NewReassemblingReceiver returns a function that collects fragments in
+// the given buffer and hands complete frames to the given receive function.
+// Datagrams that aren't fragments are handed over directly.
+func NewReassemblingReceiver(
+	buffer ReassemblyBuffer,
+	receiveFrame func(string, []byte) error,
+) func(string, []byte) error {
+
+	return func(sender string, data []byte) error {
+		if header, _, err := readFrameHeader(data); err != nil {
+			return err
+		} else if header.flags&FrameFlagFragment == 0 {
+			return receiveFrame(sender, data)
+		} else if frame, err := buffer.Add(sender, data); err != nil {
+			return err
+		} else if frame == nil {
+			return nil
+		} else {
+			return receiveFrame(sender, frame)
+		}
+	}
+}
+
+// Private helper functions
+func readFragment(data []byte) (entity.Id, int, int, []byte, error) {
+	if len(data) < fragmentHeaderLength {
+		return entity.ZeroId, 0, 0, nil, ErrFrameFormat
+	}
+
+	reader := bytes.NewBuffer(data[frameHeaderLength:])
+	fragmentId, err := entity.NewBytesId(reader.Next(len(entity.ZeroId)))
+	if err != nil {
+		return entity.ZeroId, 0, 0, nil, err
+	}
+
+	index := int(binary.BigEndian.Uint16(reader.Next(2)))
+	count := int(binary.BigEndian.Uint16(reader.Next(2)))
+	if count == 0 || count > maxFragmentCount || index >= count {
+		return entity.ZeroId, 0, 0, nil, ErrFrameFormat
+	}
+
+	return fragmentId, index, count, reader.Bytes(), nil
+}
@@ -0,0 +1,453 @@
+package message
+
+import (
+	"bytes"
+	"echsylon/fudpucker/entity"
+	"echsylon/fudpucker/entity/utils"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Frames sent with protocol version 2 and later start with a header:
+//
+//	magic(4) | version(1) | flags(1) | body
+//
+// From protocol version 3 the body carries the number of hops the message
+// has left to travel, right after the sender id. The hop count is changed
+// by each relay and is therefore not covered by the signature.
+//
+// Protocol version 4 doesn't change the frame itself, but tells that the
+// host understands tag-length-value encoded sync messages.
+//
+// Protocol version 5 allows message data to be encoded as protocol buffers
+// (see the schemas in the proto directory) instead of the compact binary
+// layout. Such frames are flagged as protobuf in the header.
+//
+// From protocol version 6 the body carries the time the message was signed,
+// in milliseconds since the Unix epoch, right after the hop count. Unlike
+// the hop count, the timestamp is covered by the signature.
+//
+// Protocol version 7 doesn't change the frame either, but tells that the
+// host answers the pings of the failure detector.
+//
+// Protocol version 8 doesn't change the frame either, but tells that the
+// host understands the ihave, graft and prune messages of the broadcast
+// tree.
+//
+// Protocol version 9 doesn't change the frame either, but tells that the
+// host understands the join, forward join, disconnect, neighbor and shuffle
+// messages of the partial views.
+//
+// Protocol version 10 doesn't change the frame either, but tells that the
+// host understands, and sends, heartbeat messages.
+//
+// Protocol version 11 doesn't change the frame either, but tells that the
+// host answers discovery beacons.
+//
+// Legacy frames (protocol version 1) have no header and consist of the
+// body alone:
+//
+//	id(16) | type(1) | sender(16) | data(n) | public key(32) | signature(64)
+//
+// A batch frame (flagged as such in the header) carries several complete
+// frames, each prefixed with its length:
+//
+//	magic(4) | version(1) | flags(1) | [length(2) | frame(length)]...
+const (
+	ProtocolVersionLegacy      byte = 1
+	ProtocolVersionHeader      byte = 2
+	ProtocolVersionHops        byte = 3
+	ProtocolVersionTlv         byte = 4
+	ProtocolVersionProtobuf    byte = 5
+	ProtocolVersionTimestamp   byte = 6
+	ProtocolVersionMembership  byte = 7
+	ProtocolVersionPlumtree    byte = 8
+	ProtocolVersionPartialView byte = 9
+	ProtocolVersionHeartbeat   byte = 10
+	ProtocolVersionBeacon      byte = 11
+
+	// The highest protocol version this build speaks.
+	ProtocolVersion = ProtocolVersionBeacon
+)
+
+const (
+	FrameFlagsNone     byte = 0
+	FrameFlagBatch     byte = 1 << 0
+	FrameFlagFragment  byte = 1 << 1
+	FrameFlagEncrypted byte = 1 << 2
+	FrameFlagProtobuf  byte = 1 << 3
+)
+
+const (
+	frameHeaderLength      = 6
+	batchEntryHeaderLength = 2
+	maxBatchEntryLength    = 1<<16 - 1
+	timestampLength        = 8
+
+	// The largest frame of a single message: the header, the fixed length
+	// parts of the body and the largest message data.
+	maxFrameLength = frameHeaderLength + 2*len(entity.ZeroId) + 1 + 1 + timestampLength +
+		entity.PublicKeyLength + entity.SignatureLength + entity.MaxMessageLength
+)
+
+var frameMagic = []byte("FUDP")
+
+var (
+	ErrFrameFormat        = errors.New("frame format error")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnsupportedCodec   = errors.New("unsupported message encoding")
+)
+
+// LengthError tells that a field in a frame or message payload doesn't
+// have a length within the expected bounds. A negative max length means
+// that there is no upper bound.
+type LengthError struct {
+	Field  string
+	Length int
+	Min    int
+	Max    int
+}
+
+func (e *LengthError) Error() string {
+	if e.Min == e.Max {
+		return fmt.Sprintf("unexpected %s length %d, expected %d", e.Field, e.Length, e.Min)
+	} else if e.Max < 0 {
+		return fmt.Sprintf("unexpected %s length %d, expected at least %d", e.Field, e.Length, e.Min)
+	} else {
+		return fmt.Sprintf("unexpected %s length %d, expected %d to %d", e.Field, e.Length, e.Min, e.Max)
+	}
+}
+
+func newLengthError(field string, length int, expected int) error {
+	return &LengthError{Field: field, Length: length, Min: expected, Max: expected}
+}
+
+func newMinLengthError(field string, length int, min int) error {
+	return &LengthError{Field: field, Length: length, Min: min, Max: -1}
+}
+
+func newRangeLengthError(field string, length int, min int, max int) error {
+	return &LengthError{Field: field, Length: length, Min: min, Max: max}
+}
+
+type frameHeader struct {
+	version byte
+	flags   byte
+}
+
+var frameDecoders = map[byte]func(*bytes.Buffer, entity.MessageEncoding) (entity.Message, error){
+	ProtocolVersionLegacy:      decodeMessageBody,
+	ProtocolVersionHeader:      decodeMessageBody,
+	ProtocolVersionHops:        decodeMessageBodyWithHops,
+	ProtocolVersionTlv:         decodeMessageBodyWithHops,
+	ProtocolVersionProtobuf:    decodeMessageBodyWithHops,
+	ProtocolVersionTimestamp:   decodeMessageBodyWithTimestamp,
+	ProtocolVersionMembership:  decodeMessageBodyWithTimestamp,
+	ProtocolVersionPlumtree:    decodeMessageBodyWithTimestamp,
+	ProtocolVersionPartialView: decodeMessageBodyWithTimestamp,
+	ProtocolVersionHeartbeat:   decodeMessageBodyWithTimestamp,
+	ProtocolVersionBeacon:      decodeMessageBodyWithTimestamp,
+}
+
+var frameEncoders = map[byte]func(*bytes.Buffer, entity.Message){
+	ProtocolVersionLegacy:      encodeMessageBody,
+	ProtocolVersionHeader:      encodeMessageBody,
+	ProtocolVersionHops:        encodeMessageBodyWithHops,
+	ProtocolVersionTlv:         encodeMessageBodyWithHops,
+	ProtocolVersionProtobuf:    encodeMessageBodyWithHops,
+	ProtocolVersionTimestamp:   encodeMessageBodyWithTimestamp,
+	ProtocolVersionMembership:  encodeMessageBodyWithTimestamp,
+	ProtocolVersionPlumtree:    encodeMessageBodyWithTimestamp,
+	ProtocolVersionPartialView: encodeMessageBodyWithTimestamp,
+	ProtocolVersionHeartbeat:   encodeMessageBodyWithTimestamp,
+	ProtocolVersionBeacon:      encodeMessageBodyWithTimestamp,
+}
+
+// NegotiateVersion returns the protocol version to use when talking to a
+// peer advertising the given version. Unknown (zero) versions are assumed
+// to be ours.
+func NegotiateVersion(peerVersion byte) byte {
+	if peerVersion == 0 || peerVersion > ProtocolVersion {
+		return ProtocolVersion
+	} else {
+		return peerVersion
+	}
+}
+
+// NewHailVersionProvider returns a function that tells the protocol version
+// to hail a peer in. Peers we don't know the version of are hailed in the
+// lowest version the given encoding allows, as they may be old builds that
+// can't read anything newer. The hail tells them our version.
+func NewHailVersionProvider(
+	getPeerVersion func(entity.Id) byte,
+	encoding entity.MessageEncoding,
+) func(entity.Id) byte {
+
+	return func(peerId entity.Id) byte {
+		if version := getPeerVersion(peerId); version != 0 {
+			return version
+		} else if encoding == entity.MessageEncodingProtobuf {
+			return ProtocolVersionProtobuf
+		} else {
+			return ProtocolVersionLegacy
+		}
+	}
+}
+
+// NewPeerVersionProvider returns a function that tells the protocol
+// version advertised by a peer. Group and broadcast addresses, given as
+// peers with a zero id, are heard by many hosts at once, and are given the
+// lowest version negotiated with any peer we know of. Never lower than the
+// timestamp version though, as hosts speaking it reject messages without
+// timestamps from us. Older hosts can't read what's sent to a group, see
+// NewGroupDeafPeersProvider.
+func NewPeerVersionProvider(
+	getPeerVersion func(entity.Id) byte,
+	getKnownPeers func() []entity.Peer,
+) func(entity.Id) byte {
+
+	return func(peerId entity.Id) byte {
+		if peerId != entity.ZeroId {
+			return getPeerVersion(peerId)
+		}
+
+		version := ProtocolVersion
+		for _, peer := range getKnownPeers() {
+			version = min(version, NegotiateVersion(getPeerVersion(peer.GetId())))
+		}
+		return max(version, ProtocolVersionTimestamp)
+	}
+}
+
+// NewGroupDeafPeersProvider returns a function that picks the peers we
+// know of that speak a protocol version older than the timestamp version.
+// They can't read the timestamped messages sent to a group, so they must
+// be sent messages of their own.
+func NewGroupDeafPeersProvider(
+	getPeerVersion func(entity.Id) byte,
+	getKnownPeers func() []entity.Peer,
+) func() []entity.Peer {
+
+	return func() []entity.Peer {
+		result := make([]entity.Peer, 0)
+		for _, peer := range getKnownPeers() {
+			if NegotiateVersion(getPeerVersion(peer.GetId())) < ProtocolVersionTimestamp {
+				result = append(result, peer)
+			}
+		}
+		return result
+	}
+}
+
+func readFrameHeader(data []byte) (frameHeader, []byte, error) {
+	if !bytes.HasPrefix(data, frameMagic) {
+		return frameHeader{version: ProtocolVersionLegacy, flags: FrameFlagsNone}, data, nil
+	} else if len(data) < frameHeaderLength {
+		return frameHeader{}, nil, ErrFrameFormat
+	} else {
+		header := frameHeader{
+			version: data[len(frameMagic)],
+			flags:   data[len(frameMagic)+1],
+		}
+		return header, data[frameHeaderLength:], nil
+	}
+}
+
+func writeFrameHeader(writer *bytes.Buffer, header frameHeader) {
+	if header.version != ProtocolVersionLegacy {
+		writer.Write(frameMagic)
+		writer.WriteByte(header.version)
+		writer.WriteByte(header.flags)
+	}
+}
+
+func decodeFrame(data []byte) (frameHeader, entity.Message, error) {
+	header, body, err := readFrameHeader(data)
+	if err != nil {
+		return header, nil, err
+	}
+
+	decode, ok := frameDecoders[header.version]
+	if !ok {
+		return header, nil, ErrUnsupportedVersion
+	}
+
+	encoding := entity.MessageEncodingBinary
+	if header.flags&FrameFlagProtobuf != 0 {
+		if header.version < ProtocolVersionProtobuf {
+			return header, nil, ErrUnsupportedCodec
+		}
+		encoding = entity.MessageEncodingProtobuf
+	}
+
+	message, err := decode(bytes.NewBuffer(body), encoding)
+	return header, message, err
+}
+
+func encodeFrame(header frameHeader, message entity.Message) ([]byte, error) {
+	encode, ok := frameEncoders[header.version]
+	if !ok {
+		return nil, ErrUnsupportedVersion
+	}
+
+	if message.GetEncoding() == entity.MessageEncodingProtobuf {
+		if header.version < ProtocolVersionProtobuf {
+			return nil, ErrUnsupportedCodec
+		}
+		header.flags |= FrameFlagProtobuf
+	}
+
+	// The timestamp is signed, so it can't be left out for older hosts.
+	if !message.GetTimestamp().IsZero() && header.version < ProtocolVersionTimestamp {
+		return nil, ErrUnsupportedVersion
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	writeFrameHeader(writer, header)
+	encode(writer, message)
+	return writer.Bytes(), nil
+}
+
+func decodeMessageBody(reader *bytes.Buffer, encoding entity.MessageEncoding) (entity.Message, error) {
+	return decodeMessage(reader, encoding, false, false)
+}
+
+func decodeMessageBodyWithHops(reader *bytes.Buffer, encoding entity.MessageEncoding) (entity.Message, error) {
+	return decodeMessage(reader, encoding, true, false)
+}
+
+func decodeMessageBodyWithTimestamp(reader *bytes.Buffer, encoding entity.MessageEncoding) (entity.Message, error) {
+	return decodeMessage(reader, encoding, true, true)
+}
+
+func encodeMessageBody(writer *bytes.Buffer, message entity.Message) {
+	encodeMessage(writer, message, false, false)
+}
+
+func encodeMessageBodyWithHops(writer *bytes.Buffer, message entity.Message) {
+	encodeMessage(writer, message, true, false)
+}
+
+func encodeMessageBodyWithTimestamp(writer *bytes.Buffer, message entity.Message) {
+	encodeMessage(writer, message, true, true)
+}
+
+func decodeMessage(reader *bytes.Buffer, encoding entity.MessageEncoding, withHops bool, withTimestamp bool) (entity.Message, error) {
+	idLen := len(entity.ZeroId)
+	trailerLen := entity.PublicKeyLength + entity.SignatureLength
+
+	// Everything but the data has a fixed length, so we know up front if
+	// there are enough bytes to read.
+	fixedLen := 2*idLen + 1 + trailerLen
+	if withHops {
+		fixedLen += 1
+	}
+	if withTimestamp {
+		fixedLen += timestampLength
+	}
+	if reader.Len() < fixedLen {
+		return nil, newMinLengthError("frame body", reader.Len(), fixedLen)
+	} else if reader.Len()-fixedLen > entity.MaxMessageLength {
+		return nil, newRangeLengthError("message data", reader.Len()-fixedLen, 0, entity.MaxMessageLength)
+	}
+
+	messageId := entity.Id(reader.Next(idLen))
+	typeValue, _ := reader.ReadByte()
+	senderId := entity.Id(reader.Next(idLen))
+
+	hops := entity.UnlimitedHops
+	if withHops {
+		hops, _ = reader.ReadByte()
+	}
+
+	timestamp := time.Time{}
+	if withTimestamp {
+		if millis := utils.BytesToInt64(reader.Next(timestampLength)); millis != 0 {
+			timestamp = time.UnixMilli(millis)
+		}
+	}
+
+	data := reader.Next(reader.Len() - trailerLen)
+	publicKey := reader.Next(entity.PublicKeyLength)
+	signature := reader.Next(entity.SignatureLength)
+	messageType := entity.MessageType(typeValue)
+	return entity.NewSignedMessage(messageId, senderId, messageType, encoding, data, publicKey, signature, hops, timestamp), nil
+}
+
+func encodeMessage(writer *bytes.Buffer, message entity.Message, withHops bool, withTimestamp bool) {
+	writer.Write(message.GetId().Bytes())
+	writer.Write(message.GetType().Bytes())
+	writer.Write(message.GetSender().Bytes())
+	if withHops {
+		writer.WriteByte(message.GetHops())
+	}
+	if withTimestamp {
+		writer.Write(timestampBytes(message.GetTimestamp()))
+	}
+	writer.Write(message.GetData())
+	writer.Write(message.GetPublicKey())
+	writer.Write(message.GetSignature())
+}
+
+// packBatches packs the given frames into as few batch frames as possible
+// without exceeding the max datagram size. Frames that won't fit in a batch
+// on their own are returned as they are.
+func packBatches(version byte, frames [][]byte, maxDatagramSize int) [][]byte {
+	result := make([][]byte, 0)
+	header := frameHeader{version: version, flags: FrameFlagBatch}
+	writer := bytes.NewBuffer([]byte{})
+
+	flush := func() {
+		if writer.Len() > frameHeaderLength {
+			result = append(result, bytes.Clone(writer.Bytes()))
+		}
+		writer.Reset()
+		writeFrameHeader(writer, header)
+	}
+
+	flush()
+	for _, frame := range frames {
+		entryLength := batchEntryHeaderLength + len(frame)
+		if len(frame) > maxBatchEntryLength || frameHeaderLength+entryLength > maxDatagramSize {
+			result = append(result, frame)
+			continue
+		} else if writer.Len()+entryLength > maxDatagramSize {
+			flush()
+		}
+		writer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(frame))))
+		writer.Write(frame)
+	}
+	flush()
+
+	return result
+}
+
+func unpackBatch(body []byte) ([][]byte, error) {
+	result := make([][]byte, 0)
+	reader := bytes.NewBuffer(body)
+	for reader.Len() > 0 {
+		if reader.Len() < batchEntryHeaderLength {
+			return result, ErrFrameFormat
+		}
+
+		length := int(binary.BigEndian.Uint16(reader.Next(batchEntryHeaderLength)))
+		if reader.Len() < length {
+			return result, ErrFrameFormat
+		}
+
+		result = append(result, reader.Next(length))
+	}
+	return result, nil
+}
+
+// timestampBytes returns the given time in milliseconds since the Unix
+// epoch. The zero time, i.e. no timestamp, is written as zero.
+func timestampBytes(timestamp time.Time) []byte {
+	if timestamp.IsZero() {
+		return utils.Int64ToBytes(0)
+	} else {
+		return utils.Int64ToBytes(timestamp.UnixMilli())
+	}
+}
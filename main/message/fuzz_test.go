@@ -0,0 +1,361 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"echsylon/fudpucker/entity"
+	"testing"
+	"time"
+)
+
+// The fuzz targets feed arbitrary bytes to the frame and payload readers,
+// which must reject malformed input with an error rather than panic. Run
+// any of them with e.g. `go test ./message -fuzz FuzzDecodeFrame`.
+
+var (
+	fuzzHostId   = entity.NewStringId("fuzz host")
+	fuzzDeviceId = entity.NewStringId("fuzz device")
+	fuzzPeer     = entity.NewSignedPeer(entity.NewStringId("fuzz peer"), "192.168.0.1:8881", time.UnixMilli(1700000000000), make([]byte, ed25519.PublicKeySize), make([]byte, ed25519.SignatureSize))
+	fuzzDevice   = entity.NewExtendedDevice(fuzzDeviceId, fuzzHostId, 1, entity.DeviceStateOn, 3, map[byte][]byte{42: []byte("extra")})
+	fuzzOutcome  = entity.NewPatchOutcome(fuzzDeviceId, false, 3, "invalid state")
+	fuzzMember   = entity.NewMember(entity.NewStringId("fuzz peer"), "192.168.0.1:8881", entity.MemberStateSuspect, 1700000000)
+)
+
+var fuzzEncodings = []entity.MessageEncoding{
+	entity.MessageEncodingBinary,
+	entity.MessageEncodingProtobuf,
+}
+
+func getFuzzHostId() (entity.Id, error) {
+	return fuzzHostId, nil
+}
+
+// addPayloadSeeds adds the data of the given messages, as created by the
+// providers in each encoding, to the corpus.
+func addPayloadSeeds(f *testing.F, provide func(entity.MessageEncoding) (entity.Message, error)) {
+	for _, encoding := range fuzzEncodings {
+		if message, err := provide(encoding); err != nil {
+			f.Fatal(err)
+		} else {
+			f.Add(byte(encoding), message.GetData())
+		}
+	}
+	f.Add(byte(entity.MessageEncodingBinary), []byte{})
+}
+
+func newFuzzMessage(messageType entity.MessageType, encoding byte, data []byte) entity.Message {
+	return entity.NewEncodedMessage(fuzzHostId, fuzzHostId, messageType, entity.MessageEncoding(encoding%2), data)
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	signMessage := NewMessageSigner(func() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+		return publicKey, privateKey, nil
+	}, 8)
+
+	frames := make([][]byte, 0)
+	for _, version := range []byte{ProtocolVersionLegacy, ProtocolVersionHops, ProtocolVersion} {
+		message, _ := NewSyncMessageProvider(getFuzzHostId, entity.MessageEncodingBinary)(fuzzDevice)
+		if frame, err := frameMessage(signMessage, version, message); err != nil {
+			f.Fatal(err)
+		} else {
+			frames = append(frames, frame)
+			f.Add(frame)
+		}
+	}
+	for _, batch := range packBatches(ProtocolVersion, frames[1:], 1400) {
+		f.Add(batch)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if header, body, err := readFrameHeader(data); err == nil && header.flags&FrameFlagBatch != 0 {
+			unpackBatch(body)
+		}
+		readFragment(data)
+		decodeFrame(data)
+	})
+}
+
+func FuzzReceiveMessageHandler(f *testing.F) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	signMessage := NewMessageSigner(func() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+		return publicKey, privateKey, nil
+	}, 8)
+
+	message, _ := NewPeerMessageProvider(getFuzzHostId, entity.MessageEncodingBinary)(fuzzPeer)
+	if frame, err := frameMessage(signMessage, ProtocolVersion, message); err != nil {
+		f.Fatal(err)
+	} else {
+		f.Add(frame)
+	}
+
+	readPeer := NewPeerMessageReader()
+	handle := func(_ string, message entity.Message) error {
+		_, err := readPeer(message)
+		return err
+	}
+	handleFrame := NewReceiveMessageHandler(
+		handle, handle, handle, handle, handle, handle, handle, handle,
+		handle, handle, handle, handle, handle, handle, handle, handle,
+		handle, handle, handle, handle, handle, handle, handle, handle,
+		func(entity.Message) error { return nil },
+		func(entity.Message) error { return nil },
+		func(entity.Id) bool { return false },
+		func(entity.Id, entity.Id) {},
+		func(string) {},
+		func(string, byte) {},
+		func(entity.Id, entity.Id) {},
+		func(string, entity.Message, bool) error { return nil },
+	)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handleFrame("192.168.0.1:8881", data)
+	})
+}
+
+func FuzzHailMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewHailMessageProvider(getFuzzHostId, encoding)()
+	})
+
+	readHail := NewHailMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if version, err := readHail(newFuzzMessage(entity.MessageTypeCommandHail, encoding, data)); err == nil && version == 0 {
+			t.Error("accepted zero protocol version")
+		}
+	})
+}
+
+func FuzzPatchMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewPatchMessageProvider(getFuzzHostId, encoding)(fuzzDeviceId, entity.DeviceStateOn)
+	})
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		patch := entity.NewPatch(fuzzDeviceId, fuzzDeviceId, entity.DeviceStateOn, 1, entity.PatchStatusPending, 0, "")
+		return NewPatchRetransmissionMessageProvider(getFuzzHostId, encoding)(patch)
+	})
+
+	readPatch := NewPatchMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readPatch(newFuzzMessage(entity.MessageTypeCommandPatch, encoding, data))
+	})
+}
+
+func FuzzPatchReplyMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewPatchReplyMessageProvider(getFuzzHostId, encoding)(fuzzOutcome)
+	})
+
+	readPatchReply := NewPatchReplyMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readPatchReply(newFuzzMessage(entity.MessageTypeEventPatchReply, encoding, data))
+	})
+}
+
+func FuzzSyncMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewSyncMessageProvider(getFuzzHostId, encoding)(fuzzDevice)
+	})
+	f.Add(byte(entity.MessageEncodingBinary), make([]byte, positionalSyncLength))
+
+	readSync := NewSyncMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readSync(newFuzzMessage(entity.MessageTypeEventSync, encoding, data))
+	})
+}
+
+func FuzzPeerMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewPeerMessageProvider(getFuzzHostId, encoding)(fuzzPeer)
+	})
+
+	readPeer := NewPeerMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if peer, err := readPeer(newFuzzMessage(entity.MessageTypeEventPeer, encoding, data)); err == nil && peer.GetAddress() == "" {
+			t.Error("accepted empty peer address")
+		}
+	})
+}
+
+func FuzzDigestMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewDigestMessageProvider(getFuzzHostId, encoding)(map[entity.Id]int{fuzzDeviceId: 3}, true)
+	})
+
+	readDigest := NewDigestMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readDigest(newFuzzMessage(entity.MessageTypeEventDigest, encoding, data))
+	})
+}
+
+func FuzzTreeNodesMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewTreeNodesMessageProvider(getFuzzHostId, encoding)(1, map[int][]byte{7: make([]byte, entity.MerkleHashLength)})
+	})
+
+	readTreeNodes := NewTreeNodesMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readTreeNodes(newFuzzMessage(entity.MessageTypeEventTreeNodes, encoding, data))
+	})
+}
+
+func FuzzTreeLeavesMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		buckets := []int{entity.MerkleBucket(fuzzDeviceId)}
+		return NewTreeLeavesMessageProvider(getFuzzHostId, encoding)(buckets, map[entity.Id]int{fuzzDeviceId: 3}, false)
+	})
+
+	readTreeLeaves := NewTreeLeavesMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readTreeLeaves(newFuzzMessage(entity.MessageTypeEventTreeLeaves, encoding, data))
+	})
+}
+
+func FuzzPingMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewPingMessageProvider(getFuzzHostId, encoding)(fuzzHostId)
+	})
+
+	readPing := NewPingMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readPing(newFuzzMessage(entity.MessageTypeEventPing, encoding, data))
+	})
+}
+
+func FuzzPingRequestMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewPingRequestMessageProvider(getFuzzHostId, encoding)(fuzzPeer)
+	})
+
+	readPingRequest := NewPingRequestMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if target, err := readPingRequest(newFuzzMessage(entity.MessageTypeEventPingRequest, encoding, data)); err == nil && target == nil {
+			t.Error("accepted ping request without target")
+		}
+	})
+}
+
+func FuzzPingAckMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewPingAckMessageProvider(getFuzzHostId, encoding)(fuzzDeviceId)
+	})
+
+	readPingAck := NewPingAckMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readPingAck(newFuzzMessage(entity.MessageTypeEventPingAck, encoding, data))
+	})
+}
+
+func FuzzMembershipMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewMembershipMessageProvider(getFuzzHostId, encoding)(fuzzMember)
+	})
+
+	readMembership := NewMembershipMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if member, err := readMembership(newFuzzMessage(entity.MessageTypeEventMembership, encoding, data)); err == nil && !member.GetState().IsValid() {
+			t.Error("accepted invalid member state")
+		}
+	})
+}
+
+func FuzzIHaveMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewIHaveMessageProvider(getFuzzHostId, encoding)([]entity.Id{fuzzHostId, fuzzDeviceId})
+	})
+
+	readIHave := NewIHaveMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if messageIds, err := readIHave(newFuzzMessage(entity.MessageTypeEventIHave, encoding, data)); err == nil && len(messageIds) == 0 {
+			t.Error("accepted no message ids")
+		}
+	})
+}
+
+func FuzzGraftMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewGraftMessageProvider(getFuzzHostId, encoding)(fuzzDeviceId)
+	})
+
+	readGraft := NewGraftMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readGraft(newFuzzMessage(entity.MessageTypeEventGraft, encoding, data))
+	})
+}
+
+func FuzzJoinMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewJoinMessageProvider(getFuzzHostId, encoding)(fuzzPeer)
+	})
+
+	readJoin := NewJoinMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readJoin(newFuzzMessage(entity.MessageTypeEventJoin, encoding, data))
+	})
+}
+
+func FuzzForwardJoinMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewForwardJoinMessageProvider(getFuzzHostId, encoding)(fuzzPeer, 6)
+	})
+
+	readForwardJoin := NewForwardJoinMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if _, ttl, err := readForwardJoin(newFuzzMessage(entity.MessageTypeEventForwardJoin, encoding, data)); err == nil && (ttl < 0 || ttl > 0xff) {
+			t.Error("accepted out of range ttl")
+		}
+	})
+}
+
+func FuzzNeighborMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewNeighborMessageProvider(getFuzzHostId, encoding)(true)
+	})
+
+	readNeighbor := NewNeighborMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readNeighbor(newFuzzMessage(entity.MessageTypeEventNeighbor, encoding, data))
+	})
+}
+
+func FuzzNeighborReplyMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewNeighborReplyMessageProvider(getFuzzHostId, encoding)(false)
+	})
+
+	readNeighborReply := NewNeighborReplyMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readNeighborReply(newFuzzMessage(entity.MessageTypeEventNeighborReply, encoding, data))
+	})
+}
+
+func FuzzShuffleMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewShuffleMessageProvider(getFuzzHostId, encoding)(fuzzPeer, []entity.SignedPeer{fuzzPeer}, 6)
+	})
+
+	readShuffle := NewShuffleMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		if origin, _, _, err := readShuffle(newFuzzMessage(entity.MessageTypeEventShuffle, encoding, data)); err == nil && origin == nil {
+			t.Error("accepted shuffle without origin")
+		}
+	})
+}
+
+func FuzzShuffleReplyMessageReader(f *testing.F) {
+	addPayloadSeeds(f, func(encoding entity.MessageEncoding) (entity.Message, error) {
+		return NewShuffleReplyMessageProvider(getFuzzHostId, encoding)([]entity.SignedPeer{fuzzPeer, fuzzPeer})
+	})
+
+	readShuffleReply := NewShuffleReplyMessageReader()
+	f.Fuzz(func(t *testing.T, encoding byte, data []byte) {
+		readShuffleReply(newFuzzMessage(entity.MessageTypeEventShuffleReply, encoding, data))
+	})
+}
@@ -0,0 +1,695 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"echsylon/fudpucker/entity"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Message data can be encoded as protocol buffers instead of the compact
+// binary layout. The schemas are found in proto/payloads.proto. All fields
+// are always written, also when they hold zero values, but readers accept
+// omitted scalar fields as zero, as protocol buffers readers should.
+var ErrProtobufFormat = errors.New("protobuf format error")
+
+// Sync fields with numbers above this can't be kept as extra attributes.
+const maxProtobufExtraField = 0xff
+
+func writeProtobufBytes(data []byte, field protowire.Number, value []byte) []byte {
+	data = protowire.AppendTag(data, field, protowire.BytesType)
+	return protowire.AppendBytes(data, value)
+}
+
+func writeProtobufVarint(data []byte, field protowire.Number, value uint64) []byte {
+	data = protowire.AppendTag(data, field, protowire.VarintType)
+	return protowire.AppendVarint(data, value)
+}
+
+// readProtobufFields calls visit for each field in the given message data,
+// with the raw field value. Fields are visited in the order they appear.
+func readProtobufFields(data []byte, visit func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(data) > 0 {
+		field, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ErrProtobufFormat
+		}
+		data = data[n:]
+
+		m := protowire.ConsumeFieldValue(field, kind, data)
+		if m < 0 {
+			return ErrProtobufFormat
+		}
+
+		if err := visit(field, kind, data[:m]); err != nil {
+			return err
+		}
+		data = data[m:]
+	}
+	return nil
+}
+
+func readProtobufBytes(kind protowire.Type, value []byte) ([]byte, error) {
+	if kind != protowire.BytesType {
+		return nil, ErrProtobufFormat
+	} else if result, n := protowire.ConsumeBytes(value); n < 0 {
+		return nil, ErrProtobufFormat
+	} else {
+		return result, nil
+	}
+}
+
+func readProtobufVarint(kind protowire.Type, value []byte) (uint64, error) {
+	if kind != protowire.VarintType {
+		return 0, ErrProtobufFormat
+	} else if result, n := protowire.ConsumeVarint(value); n < 0 {
+		return 0, ErrProtobufFormat
+	} else {
+		return result, nil
+	}
+}
+
+func encodeProtobufHail(version byte) []byte {
+	return writeProtobufVarint(nil, 1, uint64(version))
+}
+
+func decodeProtobufHail(data []byte) (byte, error) {
+	version := ProtocolVersionLegacy
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) error {
+		if field == 1 {
+			number, err := readProtobufVarint(kind, value)
+			version = byte(number)
+			if err == nil && (number == 0 || number > 0xff) {
+				err = ErrProtobufFormat
+			}
+			return err
+		}
+		return nil
+	})
+	return version, err
+}
+
+func encodeProtobufPatch(deviceId entity.Id, state entity.DeviceState, patchId entity.Id) []byte {
+	data := writeProtobufBytes(nil, 1, deviceId.Bytes())
+	data = writeProtobufVarint(data, 2, uint64(state))
+	if patchId != entity.ZeroId {
+		data = writeProtobufBytes(data, 3, patchId.Bytes())
+	}
+	return data
+}
+
+// decodeProtobufPatch returns a zero patch id if the patch isn't a
+// retransmission.
+func decodeProtobufPatch(data []byte) (entity.Id, entity.DeviceState, entity.Id, error) {
+	var idBytes, patchIdBytes []byte
+	var state uint64
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			idBytes, err = readProtobufBytes(kind, value)
+		case 2:
+			state, err = readProtobufVarint(kind, value)
+		case 3:
+			patchIdBytes, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return entity.ZeroId, entity.DeviceStateOff, entity.ZeroId, err
+	} else if state > 0xff {
+		return entity.ZeroId, entity.DeviceStateOff, entity.ZeroId, ErrProtobufFormat
+	} else if deviceId, err := readId("patch device id", idBytes); err != nil {
+		return entity.ZeroId, entity.DeviceStateOff, entity.ZeroId, err
+	} else if patchIdBytes == nil {
+		return deviceId, entity.DeviceState(state), entity.ZeroId, nil
+	} else if patchId, err := readId("patch id", patchIdBytes); err != nil {
+		return entity.ZeroId, entity.DeviceStateOff, entity.ZeroId, err
+	} else {
+		return deviceId, entity.DeviceState(state), patchId, nil
+	}
+}
+
+func encodeProtobufPatchReply(outcome entity.PatchOutcome) []byte {
+	accepted := uint64(0)
+	if outcome.IsAccepted() {
+		accepted = 1
+	}
+	data := writeProtobufBytes(nil, 1, outcome.GetPatchId().Bytes())
+	data = writeProtobufVarint(data, 2, accepted)
+	data = writeProtobufVarint(data, 3, uint64(outcome.GetVersion()))
+	return writeProtobufBytes(data, 4, []byte(outcome.GetReason()))
+}
+
+func decodeProtobufPatchReply(data []byte) (entity.PatchOutcome, error) {
+	var idBytes, reason []byte
+	var accepted, version uint64
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			idBytes, err = readProtobufBytes(kind, value)
+		case 2:
+			accepted, err = readProtobufVarint(kind, value)
+		case 3:
+			version, err = readProtobufVarint(kind, value)
+		case 4:
+			reason, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	} else if accepted > 1 || !utf8.Valid(reason) {
+		return nil, ErrProtobufFormat
+	} else if patchId, err := readId("patch reply id", idBytes); err != nil {
+		return nil, err
+	} else {
+		return entity.NewPatchOutcome(patchId, accepted != 0, int(int64(version)), string(reason)), nil
+	}
+}
+
+func encodeProtobufSync(device entity.Device) []byte {
+	data := writeProtobufBytes(nil, protowire.Number(syncTagDeviceId), device.GetId().Bytes())
+	data = writeProtobufBytes(data, protowire.Number(syncTagOwnerId), device.GetOwner().Bytes())
+	data = writeProtobufVarint(data, protowire.Number(syncTagType), uint64(device.GetType()))
+	data = writeProtobufVarint(data, protowire.Number(syncTagState), uint64(device.GetState()))
+	data = writeProtobufVarint(data, protowire.Number(syncTagVersion), uint64(device.GetVersion()))
+	for tag, value := range device.GetExtraAttributes() {
+		data = writeProtobufBytes(data, protowire.Number(tag), value)
+	}
+	return data
+}
+
+func decodeProtobufSync(data []byte) (entity.Device, error) {
+	var idBytes, ownerBytes []byte
+	var deviceType, deviceState, version uint64
+	extras := make(map[byte][]byte)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case protowire.Number(syncTagDeviceId):
+			idBytes, err = readProtobufBytes(kind, value)
+		case protowire.Number(syncTagOwnerId):
+			ownerBytes, err = readProtobufBytes(kind, value)
+		case protowire.Number(syncTagType):
+			deviceType, err = readProtobufVarint(kind, value)
+		case protowire.Number(syncTagState):
+			deviceState, err = readProtobufVarint(kind, value)
+		case protowire.Number(syncTagVersion):
+			version, err = readProtobufVarint(kind, value)
+		default:
+			if kind == protowire.BytesType && field <= maxProtobufExtraField {
+				var extra []byte
+				extra, err = readProtobufBytes(kind, value)
+				extras[byte(field)] = extra
+			}
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	} else if deviceType > 0xff || deviceState > 0xff {
+		return nil, ErrProtobufFormat
+	}
+
+	deviceId, err := readId("sync device id", idBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerId, err := readId("sync owner id", ownerBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return entity.NewExtendedDevice(
+		deviceId,
+		ownerId,
+		entity.DeviceType(deviceType),
+		entity.DeviceState(deviceState),
+		int(int64(version)),
+		extras,
+	), nil
+}
+
+func encodeProtobufPeer(peer entity.Peer) []byte {
+	data := writeProtobufBytes(nil, 1, peer.GetId().Bytes())
+	return writeProtobufBytes(data, 2, []byte(peer.GetAddress()))
+}
+
+func decodeProtobufPeer(data []byte) (entity.Peer, error) {
+	var idBytes, address []byte
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			idBytes, err = readProtobufBytes(kind, value)
+		case 2:
+			address, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	} else if peerId, err := readId("peer id", idBytes); err != nil {
+		return nil, err
+	} else if address, err := readAddress(address); err != nil {
+		return nil, err
+	} else {
+		return entity.NewPeer(peerId, address), nil
+	}
+}
+
+func encodeProtobufFlag(flag bool) []byte {
+	value := uint64(0)
+	if flag {
+		value = 1
+	}
+	return writeProtobufVarint(nil, 1, value)
+}
+
+func decodeProtobufFlag(data []byte) (bool, error) {
+	var value uint64
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, raw []byte) (err error) {
+		if field == 1 {
+			value, err = readProtobufVarint(kind, raw)
+		}
+		return
+	})
+
+	if err != nil {
+		return false, err
+	} else if value > 1 {
+		return false, ErrProtobufFormat
+	} else {
+		return value == 1, nil
+	}
+}
+
+func decodeProtobufForwardJoin(data []byte) (entity.SignedPeer, int, error) {
+	var ttl uint64
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		if field == 6 {
+			ttl, err = readProtobufVarint(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, 0, err
+	} else if ttl > 0xff {
+		return nil, 0, ErrProtobufFormat
+	} else if joiner, err := decodeProtobufPeerRecord(data); err != nil {
+		return nil, 0, err
+	} else {
+		return joiner, int(ttl), nil
+	}
+}
+
+func encodeProtobufShuffle(origin entity.SignedPeer, peers []entity.SignedPeer, ttl int) []byte {
+	data := writeProtobufVarint(nil, 1, uint64(ttl))
+	data = writeProtobufBytes(data, 2, encodeProtobufPeerRecord(origin))
+	for _, peer := range peers {
+		data = writeProtobufBytes(data, 3, encodeProtobufPeerRecord(peer))
+	}
+	return data
+}
+
+func decodeProtobufShuffle(data []byte) (entity.SignedPeer, []entity.SignedPeer, int, error) {
+	var ttl uint64
+	var origin entity.SignedPeer
+	peers := make([]entity.SignedPeer, 0)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		var entry []byte
+		switch field {
+		case 1:
+			ttl, err = readProtobufVarint(kind, value)
+		case 2:
+			if entry, err = readProtobufBytes(kind, value); err == nil {
+				origin, err = decodeProtobufPeerRecord(entry)
+			}
+		case 3:
+			var peer entity.SignedPeer
+			if entry, err = readProtobufBytes(kind, value); err == nil {
+				if peer, err = decodeProtobufPeerRecord(entry); err == nil {
+					peers = append(peers, peer)
+				}
+			}
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, nil, 0, err
+	} else if ttl > 0xff || origin == nil {
+		return nil, nil, 0, ErrProtobufFormat
+	} else {
+		return origin, peers, int(ttl), nil
+	}
+}
+
+func decodeProtobufShuffleReply(data []byte) ([]entity.SignedPeer, error) {
+	peers := make([]entity.SignedPeer, 0)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) error {
+		if field != 1 {
+			return nil
+		} else if entry, err := readProtobufBytes(kind, value); err != nil {
+			return err
+		} else if peer, err := decodeProtobufPeerRecord(entry); err != nil {
+			return err
+		} else {
+			peers = append(peers, peer)
+			return nil
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	} else {
+		return peers, nil
+	}
+}
+
+func encodeProtobufPeerRecord(record entity.SignedPeer) []byte {
+	data := encodeProtobufPeer(record)
+	data = writeProtobufVarint(data, 3, uint64(record.GetTimestamp().UnixMilli()))
+	data = writeProtobufBytes(data, 4, record.GetPublicKey())
+	return writeProtobufBytes(data, 5, record.GetSignature())
+}
+
+func decodeProtobufPeerRecord(data []byte) (entity.SignedPeer, error) {
+	var timestamp uint64
+	var publicKey, signature []byte
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 3:
+			timestamp, err = readProtobufVarint(kind, value)
+		case 4:
+			publicKey, err = readProtobufBytes(kind, value)
+		case 5:
+			signature, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	} else if len(publicKey) != ed25519.PublicKeySize {
+		return nil, newLengthError("peer public key", len(publicKey), ed25519.PublicKeySize)
+	} else if len(signature) != ed25519.SignatureSize {
+		return nil, newLengthError("peer signature", len(signature), ed25519.SignatureSize)
+	} else if peer, err := decodeProtobufPeer(data); err != nil {
+		return nil, err
+	} else {
+		return entity.NewSignedPeer(peer.GetId(), peer.GetAddress(), time.UnixMilli(int64(timestamp)), publicKey, signature), nil
+	}
+}
+
+func encodeProtobufDigest(versions map[entity.Id]int, isReply bool) []byte {
+	reply := uint64(0)
+	if isReply {
+		reply = 1
+	}
+	data := writeProtobufVarint(nil, 1, reply)
+	for deviceId, version := range versions {
+		entry := writeProtobufBytes(nil, 1, deviceId.Bytes())
+		entry = writeProtobufVarint(entry, 2, uint64(version))
+		data = writeProtobufBytes(data, 2, entry)
+	}
+	return data
+}
+
+func decodeProtobufDigest(data []byte) (map[entity.Id]int, bool, error) {
+	var reply uint64
+	versions := make(map[entity.Id]int)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			reply, err = readProtobufVarint(kind, value)
+		case 2:
+			var entry []byte
+			if entry, err = readProtobufBytes(kind, value); err == nil {
+				err = decodeProtobufDigestEntry(entry, versions)
+			}
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, false, err
+	} else if reply > 1 {
+		return nil, false, ErrProtobufFormat
+	} else {
+		return versions, reply == 1, nil
+	}
+}
+
+func decodeProtobufDigestEntry(data []byte, versions map[entity.Id]int) error {
+	var idBytes []byte
+	var version uint64
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			idBytes, err = readProtobufBytes(kind, value)
+		case 2:
+			version, err = readProtobufVarint(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return err
+	} else if deviceId, err := readId("digest device id", idBytes); err != nil {
+		return err
+	} else if _, ok := versions[deviceId]; ok {
+		return ErrProtobufFormat // duplicate device
+	} else {
+		versions[deviceId] = int(int64(version))
+		return nil
+	}
+}
+
+func encodeProtobufTreeNodes(level int, hashes map[int][]byte) []byte {
+	data := writeProtobufVarint(nil, 1, uint64(level))
+	for index, hash := range hashes {
+		node := writeProtobufVarint(nil, 1, uint64(index))
+		node = writeProtobufBytes(node, 2, hash)
+		data = writeProtobufBytes(data, 2, node)
+	}
+	return data
+}
+
+func decodeProtobufTreeNodes(data []byte) (int, map[int][]byte, error) {
+	var level uint64
+	hashes := make(map[int][]byte)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			level, err = readProtobufVarint(kind, value)
+		case 2:
+			var node []byte
+			if node, err = readProtobufBytes(kind, value); err == nil {
+				err = decodeProtobufTreeNode(node, hashes)
+			}
+		}
+		return
+	})
+
+	if err != nil {
+		return 0, nil, err
+	} else if level > entity.MerkleTreeDepth {
+		return 0, nil, ErrProtobufFormat
+	}
+
+	for index := range hashes {
+		if index >= entity.MerkleNodeCount(int(level)) {
+			return 0, nil, ErrProtobufFormat
+		}
+	}
+	return int(level), hashes, nil
+}
+
+func decodeProtobufTreeNode(data []byte, hashes map[int][]byte) error {
+	var index uint64
+	var hash []byte
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			index, err = readProtobufVarint(kind, value)
+		case 2:
+			hash, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return err
+	} else if len(hash) != entity.MerkleHashLength {
+		return newLengthError("tree node hash", len(hash), entity.MerkleHashLength)
+	} else if index >= entity.MerkleTreeBucketCount {
+		return ErrProtobufFormat
+	} else if _, ok := hashes[int(index)]; ok {
+		return ErrProtobufFormat // duplicate node
+	} else {
+		hashes[int(index)] = hash
+		return nil
+	}
+}
+
+func encodeProtobufTreeLeaves(buckets []int, versions map[entity.Id]int, isFinal bool) []byte {
+	final := uint64(0)
+	if isFinal {
+		final = 1
+	}
+	data := writeProtobufVarint(nil, 1, final)
+	packed := []byte{}
+	for _, bucket := range buckets {
+		packed = protowire.AppendVarint(packed, uint64(bucket))
+	}
+	data = writeProtobufBytes(data, 2, packed)
+	for deviceId, version := range versions {
+		entry := writeProtobufBytes(nil, 1, deviceId.Bytes())
+		entry = writeProtobufVarint(entry, 2, uint64(version))
+		data = writeProtobufBytes(data, 3, entry)
+	}
+	return data
+}
+
+// decodeProtobufTreeLeaves accepts the buckets both packed, as written by
+// encodeProtobufTreeLeaves, and unpacked.
+func decodeProtobufTreeLeaves(data []byte) ([]int, map[entity.Id]int, bool, error) {
+	var final uint64
+	buckets := make([]int, 0)
+	versions := make(map[entity.Id]int)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			final, err = readProtobufVarint(kind, value)
+		case 2:
+			if kind == protowire.VarintType {
+				var bucket uint64
+				bucket, err = readProtobufVarint(kind, value)
+				buckets = append(buckets, int(bucket))
+			} else if packed, err := readProtobufBytes(kind, value); err != nil {
+				return err
+			} else {
+				for len(packed) > 0 {
+					bucket, n := protowire.ConsumeVarint(packed)
+					if n < 0 {
+						return ErrProtobufFormat
+					}
+					buckets = append(buckets, int(bucket))
+					packed = packed[n:]
+				}
+			}
+		case 3:
+			var entry []byte
+			if entry, err = readProtobufBytes(kind, value); err == nil {
+				err = decodeProtobufDigestEntry(entry, versions)
+			}
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, nil, false, err
+	} else if final > 1 {
+		return nil, nil, false, ErrProtobufFormat
+	} else if err := validateTreeLeaves(buckets, versions); err != nil {
+		return nil, nil, false, err
+	} else {
+		return buckets, versions, final == 1, nil
+	}
+}
+
+// Ping, ping ack and graft messages hold a single id, like ack messages do.
+func encodeProtobufProbeId(probeId entity.Id) []byte {
+	return writeProtobufBytes(nil, 1, probeId.Bytes())
+}
+
+func decodeProtobufProbeId(field string, data []byte) (entity.Id, error) {
+	var idBytes []byte
+	err := readProtobufFields(data, func(number protowire.Number, kind protowire.Type, value []byte) (err error) {
+		if number == 1 {
+			idBytes, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return entity.ZeroId, err
+	} else {
+		return readId(field, idBytes)
+	}
+}
+
+func encodeProtobufIHave(messageIds []entity.Id) []byte {
+	data := []byte{}
+	for _, messageId := range messageIds {
+		data = writeProtobufBytes(data, 1, messageId.Bytes())
+	}
+	return data
+}
+
+func decodeProtobufIHave(data []byte) ([]entity.Id, error) {
+	result := make([]entity.Id, 0)
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) error {
+		if field != 1 {
+			return nil
+		} else if idBytes, err := readProtobufBytes(kind, value); err != nil {
+			return err
+		} else if messageId, err := readId("ihave message id", idBytes); err != nil {
+			return err
+		} else {
+			result = append(result, messageId)
+			return nil
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	} else if len(result) == 0 {
+		return nil, ErrProtobufFormat
+	} else {
+		return result, nil
+	}
+}
+
+func encodeProtobufMembership(member entity.Member) []byte {
+	data := writeProtobufBytes(nil, 1, member.GetId().Bytes())
+	data = writeProtobufVarint(data, 2, uint64(member.GetState()))
+	data = writeProtobufVarint(data, 3, uint64(member.GetIncarnation()))
+	return writeProtobufBytes(data, 4, []byte(member.GetAddress()))
+}
+
+func decodeProtobufMembership(data []byte) (entity.Member, error) {
+	var idBytes, address []byte
+	var state, incarnation uint64
+	err := readProtobufFields(data, func(field protowire.Number, kind protowire.Type, value []byte) (err error) {
+		switch field {
+		case 1:
+			idBytes, err = readProtobufBytes(kind, value)
+		case 2:
+			state, err = readProtobufVarint(kind, value)
+		case 3:
+			incarnation, err = readProtobufVarint(kind, value)
+		case 4:
+			address, err = readProtobufBytes(kind, value)
+		}
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	} else if memberId, err := readId("member id", idBytes); err != nil {
+		return nil, err
+	} else if state > 0xff || !entity.MemberState(state).IsValid() {
+		return nil, ErrProtobufFormat
+	} else {
+		return readMember(memberId, entity.MemberState(state), int(int64(incarnation)), address)
+	}
+}
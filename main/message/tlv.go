@@ -0,0 +1,68 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// Tag-length-value encoded attributes are written back to back:
+//
+//	tag(1) | length(2) | value(length)
+//
+// Readers skip, but keep, any tags they don't know about, so newer hosts
+// can add attributes that older hosts will relay untouched.
+const (
+	tlvHeaderLength = 3
+	maxTlvLength    = 1<<16 - 1
+)
+
+var ErrTlvFormat = errors.New("tlv format error")
+
+func writeTlv(writer *bytes.Buffer, tag byte, value []byte) error {
+	if len(value) > maxTlvLength {
+		return ErrTlvFormat
+	}
+	writer.WriteByte(tag)
+	writer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(value))))
+	writer.Write(value)
+	return nil
+}
+
+// writeTlvs writes the given attributes in ascending tag order.
+func writeTlvs(writer *bytes.Buffer, attributes map[byte][]byte) error {
+	tags := make([]byte, 0, len(attributes))
+	for tag := range attributes {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	for _, tag := range tags {
+		if err := writeTlv(writer, tag, attributes[tag]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTlvs(data []byte) (map[byte][]byte, error) {
+	result := make(map[byte][]byte)
+	reader := bytes.NewBuffer(data)
+	for reader.Len() > 0 {
+		if reader.Len() < tlvHeaderLength {
+			return nil, ErrTlvFormat
+		}
+
+		tag, _ := reader.ReadByte()
+		length := int(binary.BigEndian.Uint16(reader.Next(2)))
+		if reader.Len() < length {
+			return nil, ErrTlvFormat
+		} else if _, ok := result[tag]; ok {
+			return nil, ErrTlvFormat // duplicate tag
+		}
+
+		result[tag] = bytes.Clone(reader.Next(length))
+	}
+	return result, nil
+}
@@ -8,21 +8,25 @@ import (
 	"time"
 
 	"github.com/echsylon/go-log"
+	"golang.org/x/net/ipv4"
 )
 
 type UdpServer interface {
 	Observe(func(string, []byte) error) error
 	Send(string, []byte) error
+	GetGroupAddress() string
 	Stop() error
 }
 
 type udpServer struct {
-	port       int
-	connection net.PacketConn
+	port         int
+	group        string
+	groupAddress string
+	connection   net.PacketConn
 }
 
 const (
-	maxPacketSize   = 10 * unit.MiB
+	maxPacketSize   = 64 * unit.KiB // max UDP payload is just below this
 	maxReadTimeout  = 10 * time.Second
 	maxWriteTimeout = 5 * time.Second
 )
@@ -32,9 +36,13 @@ var (
 	ErrSendFailure      = errors.New("write error")
 )
 
-func NewUdpServer(port int) UdpServer {
+// NewUdpServer returns a UDP server listening on the given port. Unless
+// the given IPv4 multicast group is empty, the server also joins it when
+// starting to observe the port.
+func NewUdpServer(port int, group string) UdpServer {
 	return &udpServer{
-		port: port,
+		port:  port,
+		group: group,
 	}
 }
 
@@ -52,6 +60,9 @@ func (s *udpServer) Observe(callback func(string, []byte) error) error {
 	} else {
 		log.Information("UDP Server opened connection successfully")
 		s.connection = connection
+		if s.group != "" {
+			s.joinGroup()
+		}
 		go readBlocking(s.connection, callback)
 		return nil
 	}
@@ -72,6 +83,12 @@ func (s *udpServer) Send(address string, data []byte) error {
 	}
 }
 
+// GetGroupAddress returns the address of the multicast group, including
+// our port, if we have joined it, or an empty string otherwise.
+func (s *udpServer) GetGroupAddress() string {
+	return s.groupAddress
+}
+
 func (s *udpServer) Stop() error {
 	if s.connection == nil {
 		return nil
@@ -79,9 +96,47 @@ func (s *udpServer) Stop() error {
 
 	err := s.connection.Close()
 	s.connection = nil
+	s.groupAddress = ""
 	return err
 }
 
+// joinGroup joins the multicast group on all interfaces supporting it, or
+// on the default interface if there are none. Our own group messages are
+// not looped back to us.
+func (s *udpServer) joinGroup() {
+	group := net.ParseIP(s.group).To4()
+	if group == nil || !group.IsMulticast() {
+		log.Warning("UDP Server can't join %s, not an IPv4 multicast group", s.group)
+		return
+	}
+
+	joined := 0
+	connection := ipv4.NewPacketConn(s.connection)
+	groupAddress := &net.UDPAddr{IP: group}
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, ifi := range interfaces {
+			if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+				continue
+			} else if err := connection.JoinGroup(&ifi, groupAddress); err != nil {
+				log.Trace("UDP Server failed to join %s on %s; %s", s.group, ifi.Name, err.Error())
+			} else {
+				joined++
+			}
+		}
+	}
+
+	if joined == 0 {
+		if err := connection.JoinGroup(nil, groupAddress); err != nil {
+			log.Warning("UDP Server failed to join multicast group %s, using unicast only", s.group)
+			return
+		}
+	}
+
+	connection.SetMulticastLoopback(false)
+	s.groupAddress = fmt.Sprintf("%s:%d", group, s.port)
+	log.Information("UDP Server joined multicast group %s", s.groupAddress)
+}
+
 func readBlocking(connection net.PacketConn, transport func(string, []byte) error) {
 	var buffer = make([]byte, maxPacketSize)
 	for {
@@ -1,76 +1,131 @@
 package message
 
 import (
+	"bytes"
 	"echsylon/fudpucker/entity"
-	"echsylon/fudpucker/entity/unit"
+	"time"
 
 	"github.com/echsylon/go-log"
 )
 
+// NewSaluteOnHailUseCase returns a function that answers a hail with sync
+// messages for all our devices, followed by our own peer record and the
+// signed peer records we know of, up to the given number of records in
+// all. Each record is signed by the peer it describes, so the hailing host
+// doesn't have to trust us about any of them.
 func NewSaluteOnHailUseCase(
+	readHail func(entity.Message) (byte, error),
+	rememberPeerVersion func(entity.Id, byte),
 	getDeviceIds func() ([]entity.Id, error),
 	getDevice func(entity.Id) (entity.Device, error),
-	getPeers func() []entity.Peer,
+	createOwnPeerRecord func() (entity.SignedPeer, error),
+	getPeerRecords func(int) []entity.SignedPeer,
 	rememberPeer func(entity.Peer),
 	createSyncMessage func(entity.Device) (entity.Message, error),
-	createPeerMessage func(entity.Peer) (entity.Message, error),
-	sendMessage func(entity.Peer, entity.Message) error,
+	createPeerMessage func(entity.SignedPeer) (entity.Message, error),
+	sendMessages func(entity.Peer, []entity.Message) error,
+	maxSharedPeers int,
 ) func(string, entity.Message) error {
 
 	return func(senderAddress string, message entity.Message) error {
 		peer := entity.NewPeer(message.GetSender(), senderAddress)
 		rememberPeer(peer)
 
+		if version, err := readHail(message); err != nil {
+			log.Warning("Failed reading protocol version from hail, ignoring")
+		} else {
+			rememberPeerVersion(peer.GetId(), version)
+		}
+
 		deviceIds, err := getDeviceIds()
 		if err != nil {
 			deviceIds = []entity.Id{}
 		}
 
+		messages := make([]entity.Message, 0, len(deviceIds))
 		for _, id := range deviceIds {
 			if device, err := getDevice(id); err != nil {
 				log.Warning("Failed getting device to sync, skipping")
 			} else if message, err := createSyncMessage(device); err != nil {
 				log.Warning("Failed creating sync message, skipping")
-			} else if err := sendMessage(peer, message); err != nil {
-				log.Warning("Failed sending sync message, trying next")
+			} else {
+				messages = append(messages, message)
+			}
+		}
+
+		records := getPeerRecords(maxSharedPeers + 1)
+		if record, err := createOwnPeerRecord(); err != nil {
+			log.Warning("Failed creating our own peer record, not sharing it")
+		} else {
+			records = append([]entity.SignedPeer{record}, records...)
+		}
+
+		shared := 0
+		for _, record := range records {
+			if record.GetId() == peer.GetId() {
+				continue
+			} else if shared == maxSharedPeers {
+				break
+			} else if message, err := createPeerMessage(record); err != nil {
+				log.Warning("Failed creating peer message, skipping")
+			} else {
+				messages = append(messages, message)
+				shared++
 			}
 		}
 
-		// Don't sync peers for demo
-		//peers := getPeers()
-		//for _, peer := range peers {
-		//	if peer.GetId() == message.GetSender() {
-		//		continue
-		//	} else if message, err := createPeerMessage(peer); err != nil {
-		//		continue
-		//	} else if err := sendMessage(senderAddress, message); err != nil {
-		//		continue
-		//	}
-		//}
+		if err := sendMessages(peer, messages); err != nil {
+			log.Warning("Failed sending some sync and peer messages")
+		}
 
 		return nil
 	}
 }
 
+// NewSaveStateUseCase returns a function handling patch messages. Patches
+// for devices we own are applied and answered with a patch reply, unless
+// they're retransmissions of patches we've already handled, which are only
+// answered with the reply we sent the first time. Other patches are passed
+// on towards the owner.
 func NewSaveStateUseCase(
-	readMessage func(entity.Message) (entity.Id, entity.DeviceState, error),
+	readMessage func(entity.Message) (entity.Id, entity.DeviceState, entity.Id, error),
 	checkIfOwner func(entity.Id) (bool, error),
 	getDevice func(entity.Id) (entity.Device, error),
 	saveData func(entity.Id, entity.DeviceState, int) error,
 	createSyncMessage func(entity.Device) (entity.Message, error),
+	createReplyMessage func(entity.PatchOutcome) (entity.Message, error),
+	getOutcome func(entity.Id) (entity.PatchOutcome, bool),
+	putOutcome func(entity.PatchOutcome),
+	getPeer func(entity.Id) (entity.Peer, error),
+	getFanout func(entity.MessageType) int,
 	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
 	sendMessage func(entity.Peer, entity.Message) error,
 ) func(string, entity.Message) error {
 	return func(senderAddress string, message entity.Message) error {
 		var messageToPropagate entity.Message = message
-		var deviceId, newState, err = readMessage(message)
+		var messagesToPropagate = []entity.Message{}
+		var deviceId, newState, patchId, err = readMessage(message)
 		if err != nil {
 			return err
 		}
 
 		isOwner, err := checkIfOwner(deviceId)
-		if err == nil && isOwner {
-			if device, err := getDevice(deviceId); err != nil {
+		if err != nil || !isOwner {
+			if message.GetHops() == 0 {
+				log.Debug("Message %s has no hops left, not propagating", message.GetId())
+				return nil
+			}
+			messageToPropagate = entity.NewRelayedMessage(message)
+		} else {
+			outcome, isHandled := getOutcome(patchId)
+			if isHandled {
+				log.Information("Patch %s already handled, repeating reply", patchId)
+				messageToPropagate = nil
+			} else if !newState.IsValid() {
+				log.Notice("Rejecting patch %s, invalid state %d", patchId, newState)
+				outcome = entity.NewPatchOutcome(patchId, false, 0, "invalid state")
+				messageToPropagate = nil
+			} else if device, err := getDevice(deviceId); err != nil {
 				return err
 			} else if err := saveData(deviceId, newState, device.GetVersion()+1); err != nil {
 				return err
@@ -78,16 +133,41 @@ func NewSaveStateUseCase(
 				return err
 			} else if messageToPropagate, err = createSyncMessage(updatedDevice); err != nil {
 				return err
+			} else {
+				outcome = entity.NewPatchOutcome(patchId, true, updatedDevice.GetVersion(), "")
+			}
+			putOutcome(outcome)
+
+			// Let the patch sender know how it went. The reply is gossiped
+			// like any other message, but we also send it straight to the
+			// patch sender if we happen to know it.
+			if reply, err := createReplyMessage(outcome); err != nil {
+				log.Warning("Failed creating patch reply message, ignoring")
+			} else if origin, err := getPeer(message.GetSender()); err != nil {
+				messagesToPropagate = append(messagesToPropagate, reply)
+			} else {
+				sendMessage(origin, reply)
+				messagesToPropagate = append(messagesToPropagate, reply)
 			}
 		}
 
-		peers, err := getRandomPeers(entity.ZeroId, unit.MinInt)
+		fanout := getFanout(entity.MessageTypeCommandPatch)
+		if messageToPropagate != nil {
+			fanout = getFanout(messageToPropagate.GetType())
+		}
+
+		peers, err := getRandomPeers(entity.ZeroId, fanout)
 		if err != nil {
 			return err
 		}
 
+		if messageToPropagate != nil {
+			messagesToPropagate = append(messagesToPropagate, messageToPropagate)
+		}
 		for _, peer := range peers {
-			sendMessage(peer, messageToPropagate)
+			for _, message := range messagesToPropagate {
+				sendMessage(peer, message)
+			}
 		}
 
 		return nil
@@ -100,8 +180,10 @@ func NewSaveDeviceUseCase(
 	readCandidate func(entity.Message) (entity.Device, error),
 	saveCandidate func(entity.Device) error,
 	getDevice func(entity.Id) (entity.Device, error),
+	getFanout func(entity.MessageType) int,
 	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
 	createSyncMessage func(entity.Device) (entity.Message, error),
+	supersedePatches func(entity.Id, int),
 	sendMessage func(entity.Peer, entity.Message) error,
 ) func(string, entity.Message) error {
 
@@ -135,9 +217,17 @@ func NewSaveDeviceUseCase(
 		} else if err := saveCandidate(candidate); err != nil {
 			log.Warning("Failed to save new device state, ignoring")
 			return err
+		} else {
+			// Any patches we've sent for this device are now outdated.
+			supersedePatches(deviceId, candidate.GetVersion())
+			if message.GetHops() == 0 {
+				log.Debug("Message %s has no hops left, not propagating", message.GetId())
+				return nil
+			}
+			messageToPropagate = entity.NewRelayedMessage(message)
 		}
 
-		peers, err := getRandomPeers(messageToPropagate.GetId(), unit.MinInt)
+		peers, err := getRandomPeers(messageToPropagate.GetId(), getFanout(messageToPropagate.GetType()))
 		if err != nil {
 			log.Warning("Failed to select peer pool, ignoring")
 			return err
@@ -151,9 +241,16 @@ func NewSaveDeviceUseCase(
 	}
 }
 
+// NewSavePeerUseCase returns a function that adds the sender of a peer
+// message, and the peer described in it, to our peers. The peer record
+// must be signed by the peer it describes, as the sender could otherwise
+// make us send our traffic anywhere.
 func NewSavePeerUseCase(
-	readPeer func(entity.Message) (entity.Peer, error),
+	readPeer func(entity.Message) (entity.SignedPeer, error),
+	verifyPeerRecord func(entity.SignedPeer) error,
+	getHostId func() (entity.Id, error),
 	savePeer func(entity.Peer),
+	savePeerRecord func(entity.SignedPeer) bool,
 ) func(string, entity.Message) error {
 
 	return func(senderAddress string, message entity.Message) error {
@@ -163,12 +260,23 @@ func NewSavePeerUseCase(
 		sender := entity.NewPeer(message.GetSender(), senderAddress)
 		savePeer(sender)
 
-		if peer, err := readPeer(message); err != nil {
+		record, err := readPeer(message)
+		if err != nil {
+			return err
+		}
+
+		if hostId, err := getHostId(); err != nil {
 			return err
-		} else {
-			savePeer(peer)
+		} else if record.GetId() == hostId {
 			return nil
+		} else if err := verifyPeerRecord(record); err != nil {
+			log.Warning("Failed verifying record of peer %s shared by %s, ignoring", record.GetId(), message.GetSender())
+			return err
+		} else if savePeerRecord(record) {
+			log.Debug("Learned peer %s at %s from %s", record.GetId(), record.GetAddress(), message.GetSender())
 		}
+
+		return nil
 	}
 }
 
@@ -184,72 +292,1497 @@ func NewDeletePeerUseCase(
 	}
 }
 
-func NewSendHailCommandUseCase(
+func NewResolvePatchUseCase(
+	readReply func(entity.Message) (entity.PatchOutcome, error),
+	resolvePatch func(entity.PatchOutcome) bool,
+	getFanout func(entity.MessageType) int,
 	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
-	createHailMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		outcome, err := readReply(message)
+		if err != nil {
+			return err
+		}
+
+		if resolvePatch(outcome) {
+			log.Information("Patch %s resolved by %s (accepted=%t)", outcome.GetPatchId(), message.GetSender(), outcome.IsAccepted())
+			return nil
+		} else if message.GetHops() == 0 {
+			log.Debug("Message %s has no hops left, not propagating", message.GetId())
+			return nil
+		}
+
+		// Not our patch, help the reply find its way to the patch sender.
+		relayedMessage := entity.NewRelayedMessage(message)
+		peers, err := getRandomPeers(message.GetId(), getFanout(message.GetType()))
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range peers {
+			sendMessage(peer, relayedMessage)
+		}
+
+		return nil
+	}
+}
+
+// NewRetransmitPatchesUseCase returns a function that sends the patches
+// that are due for retransmission again, each in a new message.
+func NewRetransmitPatchesUseCase(
+	getDuePatches func() []entity.Patch,
+	createRetransmission func(entity.Patch) (entity.Message, error),
+	getFanout func(entity.MessageType) int,
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func() error {
+
+	return func() error {
+		for _, patch := range getDuePatches() {
+			message, err := createRetransmission(patch)
+			if err != nil {
+				return err
+			}
+
+			log.Information("Retransmitting patch %s in message %s", patch.GetId(), message.GetId())
+
+			// Patches are always sent to random peers, regardless of
+			// whether we have sent them the patch before or not.
+			peers, err := getRandomPeers(entity.ZeroId, getFanout(message.GetType()))
+			if err != nil {
+				return err
+			}
+
+			for _, peer := range peers {
+				sendMessage(peer, message)
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewSpreadRumorsUseCase returns a function that runs a round of rumor
+// mongering, sending each rumor we're still spreading to random peers not
+// known to have heard it.
+func NewSpreadRumorsUseCase(
+	getHotRumors func() []entity.Message,
+	getFanout func(entity.MessageType) int,
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func() error {
+
+	return func() error {
+		for _, message := range getHotRumors() {
+			peers, err := getRandomPeers(message.GetId(), getFanout(message.GetType()))
+			if err != nil {
+				return err
+			}
+
+			for _, peer := range peers {
+				sendMessage(peer, message)
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewSendDigestUseCase returns a function that starts a round of push-pull
+// anti-entropy by sending a digest of the versions of all our devices to a
+// random peer.
+func NewSendDigestUseCase(
 	getDeviceIds func() ([]entity.Id, error),
-	getDevice func(entity.Id) (entity.Device, error),
-	createSyncMessage func(entity.Device) (entity.Message, error),
+	getVersion func(entity.Id) (int, error),
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	createDigestMessage func(map[entity.Id]int, bool) (entity.Message, error),
 	sendMessage func(entity.Peer, entity.Message) error,
 ) func() error {
 
 	return func() error {
-		message, err := createHailMessage()
+		deviceIds, err := getDeviceIds()
 		if err != nil {
 			return err
 		}
 
-		peers, err := getRandomPeers(message.GetId(), unit.MinInt)
+		versions := make(map[entity.Id]int)
+		for _, id := range deviceIds {
+			if version, err := getVersion(id); err == nil {
+				versions[id] = version
+			}
+		}
+
+		message, err := createDigestMessage(versions, false)
 		if err != nil {
 			return err
 		}
 
-		deviceIds, err := getDeviceIds()
+		peers, err := getRandomPeers(message.GetId(), 1)
 		if err != nil {
-			deviceIds = []entity.Id{}
+			return err
+		}
+
+		for _, peer := range peers {
+			log.Debug("Sending digest of %d devices to %s", len(versions), peer.GetId())
+			sendMessage(peer, message)
+		}
+
+		return nil
+	}
+}
+
+// NewReconcileDigestUseCase returns a function that compares a received
+// digest with our devices. We push sync messages for the devices that the
+// sender doesn't have, or has older versions of, and answer with a reply
+// digest of the devices we want from the sender. A reply digest is only
+// answered with sync messages, which ends the round.
+func NewReconcileDigestUseCase(
+	readDigest func(entity.Message) (map[entity.Id]int, bool, error),
+	getDeviceIds func() ([]entity.Id, error),
+	getVersion func(entity.Id) (int, error),
+	checkIfNewer func(entity.Id, int) (bool, error),
+	getDevice func(entity.Id) (entity.Device, error),
+	createDigestMessage func(map[entity.Id]int, bool) (entity.Message, error),
+	createSyncMessage func(entity.Device) (entity.Message, error),
+	sendMessages func(entity.Peer, []entity.Message) error,
+) func(string, entity.Message) error {
+
+	// Devices we don't have at all are asked for with a version older
+	// than any real version.
+	const missingVersion = -1
+
+	return func(senderAddress string, message entity.Message) error {
+		remoteVersions, isReply, err := readDigest(message)
+		if err != nil {
+			log.Error("Failed to read digest from message")
+			return err
+		}
+
+		// A reply only holds the devices the sender wants, anything else
+		// in our store is not of interest.
+		candidateIds := make([]entity.Id, 0, len(remoteVersions))
+		if isReply {
+			for id := range remoteVersions {
+				candidateIds = append(candidateIds, id)
+			}
+		} else if candidateIds, err = getDeviceIds(); err != nil {
+			return err
 		}
 
 		messages := make([]entity.Message, 0)
-		for _, id := range deviceIds {
-			if device, err := getDevice(id); err == nil {
-				if message, err := createSyncMessage(device); err == nil {
-					messages = append(messages, message)
+		for _, id := range candidateIds {
+			remoteVersion, isKnown := remoteVersions[id]
+			if version, err := getVersion(id); err != nil {
+				continue
+			} else if isKnown && version <= remoteVersion {
+				continue
+			} else if device, err := getDevice(id); err != nil {
+				log.Warning("Failed getting device to sync, skipping")
+			} else if message, err := createSyncMessage(device); err != nil {
+				log.Warning("Failed creating sync message, skipping")
+			} else {
+				messages = append(messages, message)
+			}
+		}
+
+		wanted := make(map[entity.Id]int)
+		if !isReply {
+			for id, remoteVersion := range remoteVersions {
+				if isNewer, err := checkIfNewer(id, remoteVersion); err != nil {
+					wanted[id] = missingVersion
+				} else if isNewer {
+					version, _ := getVersion(id)
+					wanted[id] = version
 				}
 			}
 		}
 
-		for _, peer := range peers {
-			sendMessage(peer, message)
-			for _, message := range messages {
-				sendMessage(peer, message)
+		pushCount := len(messages)
+		if len(wanted) > 0 {
+			if reply, err := createDigestMessage(wanted, true); err != nil {
+				log.Warning("Failed creating reply digest")
+			} else {
+				messages = append([]entity.Message{reply}, messages...)
 			}
 		}
 
-		return nil
+		if len(messages) == 0 {
+			log.Debug("Digest %s matches our devices", message.GetId())
+			return nil
+		}
+
+		log.Information("Reconciled digest %s, pushing %d devices and pulling %d", message.GetId(), pushCount, len(wanted))
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		return sendMessages(peer, messages)
 	}
 }
 
-func NewSendFarewellEventUseCase(
+// NewSendTreeRootUseCase returns a function that starts a round of Merkle
+// tree reconciliation by sending the root hash of our device tree to a
+// random peer.
+func NewSendTreeRootUseCase(
+	getTreeHash func(int, int) []byte,
 	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
-	createFarewellMessage func() (entity.Message, error),
+	createTreeNodesMessage func(int, map[int][]byte) (entity.Message, error),
 	sendMessage func(entity.Peer, entity.Message) error,
 ) func() error {
 
 	return func() error {
-		message, err := createFarewellMessage()
+		message, err := createTreeNodesMessage(0, map[int][]byte{0: getTreeHash(0, 0)})
 		if err != nil {
 			return err
 		}
 
-		peers, err := getRandomPeers(message.GetId(), unit.MaxInt)
+		peers, err := getRandomPeers(message.GetId(), 1)
 		if err != nil {
 			return err
 		}
 
 		for _, peer := range peers {
+			log.Debug("Sending device tree root to %s", peer.GetId())
 			sendMessage(peer, message)
 		}
 
 		return nil
 	}
 }
+
+// NewReconcileTreeNodesUseCase returns a function that compares received
+// Merkle tree node hashes with our own. Nothing is sent back if all hashes
+// match. Otherwise we answer with our hashes of the children of the nodes
+// that differ, or with the devices in the buckets that differ once the
+// bottom of the tree is reached.
+func NewReconcileTreeNodesUseCase(
+	readTreeNodes func(entity.Message) (int, map[int][]byte, error),
+	getTreeHash func(int, int) []byte,
+	getBucket func(int) map[entity.Id]int,
+	createTreeNodesMessage func(int, map[int][]byte) (entity.Message, error),
+	createTreeLeavesMessage func([]int, map[entity.Id]int, bool) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		level, remoteHashes, err := readTreeNodes(message)
+		if err != nil {
+			log.Error("Failed to read tree nodes from message")
+			return err
+		}
+
+		differing := make([]int, 0)
+		for index, remoteHash := range remoteHashes {
+			if !bytes.Equal(getTreeHash(level, index), remoteHash) {
+				differing = append(differing, index)
+			}
+		}
+
+		if len(differing) == 0 {
+			log.Debug("Tree nodes %s match our devices", message.GetId())
+			return nil
+		}
+
+		var reply entity.Message
+		if level < entity.MerkleTreeDepth {
+			hashes := make(map[int][]byte)
+			for _, index := range differing {
+				for child := index * entity.MerkleTreeFanout; child < (index+1)*entity.MerkleTreeFanout; child++ {
+					hashes[child] = getTreeHash(level+1, child)
+				}
+			}
+			reply, err = createTreeNodesMessage(level+1, hashes)
+		} else {
+			versions := make(map[entity.Id]int)
+			for _, index := range differing {
+				for id, version := range getBucket(index) {
+					versions[id] = version
+				}
+			}
+			reply, err = createTreeLeavesMessage(differing, versions, false)
+		}
+
+		if err != nil {
+			log.Warning("Failed creating tree reply")
+			return err
+		}
+
+		log.Debug("Tree nodes %s differ in %d nodes on level %d", message.GetId(), len(differing), level)
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		return sendMessage(peer, reply)
+	}
+}
+
+// NewReconcileTreeLeavesUseCase returns a function that compares received
+// Merkle tree buckets with our own. We push sync messages for the devices
+// in the buckets that the sender doesn't have, or has older versions of.
+// Unless the received buckets are final, we answer with our own version of
+// them if the sender has devices, or versions, that we don't, so that the
+// sender can push those in turn.
+func NewReconcileTreeLeavesUseCase(
+	readTreeLeaves func(entity.Message) ([]int, map[entity.Id]int, bool, error),
+	getBucket func(int) map[entity.Id]int,
+	checkIfNewer func(entity.Id, int) (bool, error),
+	getDevice func(entity.Id) (entity.Device, error),
+	createTreeLeavesMessage func([]int, map[entity.Id]int, bool) (entity.Message, error),
+	createSyncMessage func(entity.Device) (entity.Message, error),
+	sendMessages func(entity.Peer, []entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		buckets, remoteVersions, isFinal, err := readTreeLeaves(message)
+		if err != nil {
+			log.Error("Failed to read tree leaves from message")
+			return err
+		}
+
+		versions := make(map[entity.Id]int)
+		for _, index := range buckets {
+			for id, version := range getBucket(index) {
+				versions[id] = version
+			}
+		}
+
+		messages := make([]entity.Message, 0)
+		for id, version := range versions {
+			if remoteVersion, isKnown := remoteVersions[id]; isKnown && version <= remoteVersion {
+				continue
+			} else if device, err := getDevice(id); err != nil {
+				log.Warning("Failed getting device to sync, skipping")
+			} else if message, err := createSyncMessage(device); err != nil {
+				log.Warning("Failed creating sync message, skipping")
+			} else {
+				messages = append(messages, message)
+			}
+		}
+
+		pullCount := 0
+		if !isFinal {
+			for id, remoteVersion := range remoteVersions {
+				if isNewer, err := checkIfNewer(id, remoteVersion); err != nil || isNewer {
+					pullCount++
+				}
+			}
+		}
+
+		pushCount := len(messages)
+		if pullCount > 0 {
+			if reply, err := createTreeLeavesMessage(buckets, versions, true); err != nil {
+				log.Warning("Failed creating reply tree leaves")
+			} else {
+				messages = append([]entity.Message{reply}, messages...)
+			}
+		}
+
+		if len(messages) == 0 {
+			log.Debug("Tree leaves %s match our devices", message.GetId())
+			return nil
+		}
+
+		log.Information("Reconciled tree leaves %s, pushing %d devices and pulling %d", message.GetId(), pushCount, pullCount)
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		return sendMessages(peer, messages)
+	}
+}
+
+// NewProbePeerUseCase returns a function that runs one round of SWIM style
+// failure detection. The next peer in turn is pinged directly and, if it
+// doesn't answer within the ack timeout, indirectly through a few other
+// peers. A peer that answers neither before the probe timeout is suspected
+// of having failed, which is spread to our peers. A peer is never suspected
+// if we failed sending the probes, as it's then us that can't be reached.
+// Peers known to speak an older protocol version don't answer pings and are
+// never probed. The round blocks until the probe timeout at the most.
+func NewProbePeerUseCase(
+	getAllPeers func() []entity.Peer,
+	getPeerVersion func(entity.Id) byte,
+	getProbeTarget func([]entity.Peer) (entity.Peer, bool),
+	createPingMessage func(entity.Id) (entity.Message, error),
+	createPingRequestMessage func(entity.Peer) (entity.Message, error),
+	expectAck func(entity.Id, entity.Peer, entity.Id),
+	awaitAck func(entity.Id, time.Duration) bool,
+	suspectMember func(entity.Peer) (entity.Member, bool),
+	spreadMembership func(entity.Member) error,
+	sendMessage func(entity.Peer, entity.Message) error,
+	ackTimeout time.Duration,
+	probeTimeout time.Duration,
+	indirectProbeCount int,
+) func() error {
+
+	return func() error {
+		peers := make([]entity.Peer, 0)
+		for _, peer := range getAllPeers() {
+			if version := getPeerVersion(peer.GetId()); version == 0 || version >= ProtocolVersionMembership {
+				peers = append(peers, peer)
+			}
+		}
+
+		target, ok := getProbeTarget(peers)
+		if !ok {
+			return nil
+		}
+
+		ping, err := createPingMessage(target.GetId())
+		if err != nil {
+			return err
+		}
+
+		expectAck(ping.GetId(), nil, entity.ZeroId)
+		if err := sendMessage(target, ping); err != nil {
+			log.Warning("Failed sending ping to peer %s", target.GetId())
+			return err
+		} else if awaitAck(ping.GetId(), ackTimeout) {
+			return nil
+		}
+
+		request, err := createPingRequestMessage(target)
+		if err != nil {
+			return err
+		}
+
+		// Map key order is random when iterating.
+		helpers := make(map[entity.Id]entity.Peer)
+		for _, peer := range peers {
+			if peer.GetId() != target.GetId() {
+				helpers[peer.GetId()] = peer
+			}
+		}
+
+		log.Debug("Peer %s didn't answer ping, probing it indirectly", target.GetId())
+		expectAck(request.GetId(), nil, entity.ZeroId)
+		count := 0
+		sent := 0
+		for _, helper := range helpers {
+			if count == indirectProbeCount {
+				break
+			} else if err := sendMessage(helper, request); err != nil {
+				log.Warning("Failed sending ping request to peer %s", helper.GetId())
+			} else {
+				sent++
+			}
+			count++
+		}
+
+		if count > 0 && sent == 0 {
+			return ErrSendFailure
+		} else if awaitAck(request.GetId(), probeTimeout-ackTimeout) {
+			return nil
+		}
+
+		if member, ok := suspectMember(target); ok {
+			log.Warning("Peer %s didn't answer any probes, suspecting it has failed", target.GetId())
+			return spreadMembership(member)
+		}
+
+		return nil
+	}
+}
+
+// NewConfirmSuspectsUseCase returns a function that declares peers dead
+// once they have been suspected for longer than the given timeout without
+// refuting it. Dead peers are removed and their death spread to our peers.
+func NewConfirmSuspectsUseCase(
+	confirmSuspects func(time.Duration) []entity.Member,
+	removePeer func(entity.Id),
+	spreadMembership func(entity.Member) error,
+	suspicionTimeout time.Duration,
+) func() error {
+
+	return func() error {
+		for _, member := range confirmSuspects(suspicionTimeout) {
+			log.Warning("Peer %s is confirmed dead, removing it", member.GetId())
+			removePeer(member.GetId())
+			spreadMembership(member)
+		}
+		return nil
+	}
+}
+
+// NewSendHeartbeatsUseCase returns a function that sends a heartbeat to
+// each of our peers, so that they don't take our silence for us being
+// gone. Peers known to speak an older protocol version don't understand
+// heartbeats and are skipped.
+func NewSendHeartbeatsUseCase(
+	getAllPeers func() []entity.Peer,
+	getPeerVersion func(entity.Id) byte,
+	createHeartbeatMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func() error {
+
+	return func() error {
+		message, err := createHeartbeatMessage()
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range getAllPeers() {
+			if version := getPeerVersion(peer.GetId()); version == 0 || version >= ProtocolVersionHeartbeat {
+				sendMessage(peer, message)
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewExpireSilentPeersUseCase returns a function that removes the peers
+// we haven't heard from for longer than the given silence, telling the
+// components interested in expired peers about each. Peers known to speak
+// an older protocol version don't send heartbeats and never expire.
+func NewExpireSilentPeersUseCase(
+	getSilentPeers func(time.Duration) []entity.Peer,
+	getPeerVersion func(entity.Id) byte,
+	removePeer func(entity.Id),
+	peerExpired func(entity.Peer),
+	silence time.Duration,
+) func() error {
+
+	return func() error {
+		for _, peer := range getSilentPeers(silence) {
+			if version := getPeerVersion(peer.GetId()); version != 0 && version < ProtocolVersionHeartbeat {
+				continue
+			}
+			log.Warning("Peer %s has been silent for more than %s, removing it", peer.GetId(), silence)
+			removePeer(peer.GetId())
+			peerExpired(peer)
+		}
+		return nil
+	}
+}
+
+// NewSpreadMembershipUseCase returns a function that sends the given
+// member state to random peers. The member itself may well be among them,
+// which lets a wrongly suspected member learn about it and refute it.
+func NewSpreadMembershipUseCase(
+	createMembershipMessage func(entity.Member) (entity.Message, error),
+	getFanout func(entity.MessageType) int,
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(entity.Member) error {
+
+	return func(member entity.Member) error {
+		message, err := createMembershipMessage(member)
+		if err != nil {
+			return err
+		}
+
+		peers, err := getRandomPeers(message.GetId(), getFanout(message.GetType()))
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range peers {
+			sendMessage(peer, message)
+		}
+
+		return nil
+	}
+}
+
+// NewAnswerPingUseCase returns a function that answers pings meant for us.
+func NewAnswerPingUseCase(
+	readPing func(entity.Message) (entity.Id, error),
+	getHostId func() (entity.Id, error),
+	createPingAckMessage func(entity.Id) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		if targetId, err := readPing(message); err != nil {
+			log.Error("Failed to read ping from message")
+			return err
+		} else if hostId, err := getHostId(); err != nil {
+			return err
+		} else if targetId != hostId {
+			log.Debug("Ping %s is meant for %s, ignoring", message.GetId(), targetId)
+			return nil
+		} else if ack, err := createPingAckMessage(message.GetId()); err != nil {
+			return err
+		} else {
+			sender := entity.NewPeer(message.GetSender(), senderAddress)
+			return sendMessage(sender, ack)
+		}
+	}
+}
+
+// NewRelayPingUseCase returns a function that pings the target of a ping
+// request on behalf of the sender. The ack, if any, is relayed to the
+// sender once it arrives.
+func NewRelayPingUseCase(
+	readPingRequest func(entity.Message) (entity.Peer, error),
+	createPingMessage func(entity.Id) (entity.Message, error),
+	expectAck func(entity.Id, entity.Peer, entity.Id),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		target, err := readPingRequest(message)
+		if err != nil {
+			log.Error("Failed to read ping request from message")
+			return err
+		}
+
+		ping, err := createPingMessage(target.GetId())
+		if err != nil {
+			return err
+		}
+
+		sender := entity.NewPeer(message.GetSender(), senderAddress)
+		expectAck(ping.GetId(), sender, message.GetId())
+		return sendMessage(target, ping)
+	}
+}
+
+// NewAcknowledgePingUseCase returns a function that handles ping acks,
+// relaying those answering pings we sent on behalf of other hosts.
+func NewAcknowledgePingUseCase(
+	readPingAck func(entity.Message) (entity.Id, error),
+	acknowledge func(entity.Id) (entity.Peer, entity.Id, bool),
+	createPingAckMessage func(entity.Id) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		probeId, err := readPingAck(message)
+		if err != nil {
+			log.Error("Failed to read ping ack from message")
+			return err
+		}
+
+		relayTo, relayId, ok := acknowledge(probeId)
+		if !ok {
+			log.Debug("Ping ack %s answers no ping of ours, ignoring", message.GetId())
+			return nil
+		} else if relayTo == nil {
+			return nil
+		}
+
+		if ack, err := createPingAckMessage(relayId); err != nil {
+			return err
+		} else {
+			return sendMessage(relayTo, ack)
+		}
+	}
+}
+
+// NewUpdateMembershipUseCase returns a function that applies a received
+// member state, spreading it further if it was news to us. Peers declared
+// dead are removed. Suspicions about ourselves are refuted by spreading
+// that we're alive, with a higher incarnation than the one we're suspected
+// with. Membership messages are signed by whoever spreads them, not by the
+// member they're about, so states of peers we don't know are ignored, and
+// addresses are never taken from them.
+func NewUpdateMembershipUseCase(
+	readMembership func(entity.Message) (entity.Member, error),
+	getHostId func() (entity.Id, error),
+	getLocalAddress func() (string, error),
+	refute func(int) int,
+	updateMember func(entity.Member) bool,
+	getPeer func(entity.Id) (entity.Peer, error),
+	removePeer func(entity.Id),
+	spreadMembership func(entity.Member) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		member, err := readMembership(message)
+		if err != nil {
+			log.Error("Failed to read membership from message")
+			return err
+		}
+
+		hostId, err := getHostId()
+		if err != nil {
+			return err
+		}
+
+		memberId := member.GetId()
+		if memberId == hostId {
+			if member.GetState() == entity.MemberStateAlive {
+				return nil
+			}
+
+			address, _ := getLocalAddress()
+			incarnation := refute(member.GetIncarnation())
+			log.Notice("Refuting being %s, announcing incarnation %d", member.GetState(), incarnation)
+			return spreadMembership(entity.NewMember(hostId, address, entity.MemberStateAlive, incarnation))
+		}
+
+		if _, err := getPeer(memberId); err != nil {
+			log.Debug("Ignoring membership of unknown peer %s", memberId)
+			return nil
+		} else if !updateMember(member) {
+			return nil
+		}
+
+		switch member.GetState() {
+		case entity.MemberStateSuspect:
+			log.Information("Peer %s is suspected of having failed", memberId)
+		case entity.MemberStateDead:
+			log.Warning("Peer %s is declared dead, removing it", memberId)
+			removePeer(memberId)
+		}
+
+		return spreadMembership(member)
+	}
+}
+
+// NewShapeBroadcastTreeUseCase returns a function that maintains the
+// broadcast tree as sync messages arrive. The peer relaying a new message
+// to us becomes an eager push peer, while a peer relaying a message we
+// already had becomes a lazy push peer and is told to prune us from its
+// eager push peers. Peers known to speak an older protocol version don't
+// understand lazy push and are kept eager. Peers are told apart by the
+// address the message came from, as relayed messages carry the id of
+// their original sender. The relaying peer is known to have the message,
+// so it's never pushed back to it.
+func NewShapeBroadcastTreeUseCase(
+	getAllPeers func() []entity.Peer,
+	getPeerVersion func(entity.Id) byte,
+	putMessageInQuarantine func(entity.Id, entity.Id),
+	received func(entity.Id),
+	graft func(entity.Id) bool,
+	prune func(entity.Id) bool,
+	createPruneMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message, bool) error {
+
+	return func(senderAddress string, message entity.Message, isDuplicate bool) error {
+		if message.GetType() != entity.MessageTypeEventSync {
+			return nil
+		} else if !isDuplicate {
+			received(message.GetId())
+		}
+
+		var relay entity.Peer
+		for _, peer := range getAllPeers() {
+			if peer.GetAddress() == senderAddress {
+				relay = peer
+				break
+			}
+		}
+
+		if relay == nil {
+			return nil
+		}
+
+		putMessageInQuarantine(message.GetId(), relay.GetId())
+		if version := getPeerVersion(relay.GetId()); version != 0 && version < ProtocolVersionPlumtree {
+			return nil
+		} else if !isDuplicate {
+			if graft(relay.GetId()) {
+				log.Debug("Grafted %s onto the broadcast tree", relay.GetId())
+			}
+			return nil
+		} else if !prune(relay.GetId()) {
+			return nil
+		}
+
+		log.Debug("Pruned %s from the broadcast tree", relay.GetId())
+		if pruneMessage, err := createPruneMessage(); err != nil {
+			return err
+		} else {
+			return sendMessage(relay, pruneMessage)
+		}
+	}
+}
+
+// NewAnnounceMessagesUseCase returns a function that sends the ids of the
+// messages queued for each lazy push peer, at most the given number of
+// ids per message.
+func NewAnnounceMessagesUseCase(
+	getAnnouncements func() map[entity.Peer][]entity.Id,
+	createIHaveMessage func([]entity.Id) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+	maxIdsPerMessage int,
+) func() error {
+
+	return func() error {
+		for peer, messageIds := range getAnnouncements() {
+			for start := 0; start < len(messageIds); start += maxIdsPerMessage {
+				end := min(start+maxIdsPerMessage, len(messageIds))
+				if message, err := createIHaveMessage(messageIds[start:end]); err != nil {
+					return err
+				} else {
+					sendMessage(peer, message)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewExpectAnnouncedMessagesUseCase returns a function that notes the
+// messages announced to us, which we haven't seen yet.
+func NewExpectAnnouncedMessagesUseCase(
+	readIHave func(entity.Message) ([]entity.Id, error),
+	isMessageInQuarantine func(entity.Id) bool,
+	expectMessage func(entity.Id, entity.Peer),
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		messageIds, err := readIHave(message)
+		if err != nil {
+			log.Error("Failed to read message ids from ihave message")
+			return err
+		}
+
+		announcer := entity.NewPeer(message.GetSender(), senderAddress)
+		for _, messageId := range messageIds {
+			if !isMessageInQuarantine(messageId) {
+				expectMessage(messageId, announcer)
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewRequestMissingMessagesUseCase returns a function that asks for the
+// announced messages we haven't received through the broadcast tree in
+// time. The announcer is grafted onto the tree, which repairs it.
+func NewRequestMissingMessagesUseCase(
+	getMissing func(time.Duration) map[entity.Id]entity.Peer,
+	graft func(entity.Id) bool,
+	createGraftMessage func(entity.Id) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+	timeout time.Duration,
+) func() error {
+
+	return func() error {
+		for messageId, announcer := range getMissing(timeout) {
+			log.Information("Message %s is missing, grafting %s", messageId, announcer.GetId())
+			graft(announcer.GetId())
+			if message, err := createGraftMessage(messageId); err != nil {
+				return err
+			} else {
+				sendMessage(announcer, message)
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewAnswerGraftUseCase returns a function that makes the sender of a
+// graft message an eager push peer, and sends it the message it asks for
+// if we still have it.
+func NewAnswerGraftUseCase(
+	readGraft func(entity.Message) (entity.Id, error),
+	graft func(entity.Id) bool,
+	getMessage func(entity.Id) (entity.Message, bool),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		messageId, err := readGraft(message)
+		if err != nil {
+			log.Error("Failed to read message id from graft message")
+			return err
+		}
+
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		graft(peer.GetId())
+		if requested, ok := getMessage(messageId); !ok {
+			log.Debug("Grafted message %s is no longer kept", messageId)
+			return nil
+		} else {
+			return sendMessage(peer, requested)
+		}
+	}
+}
+
+// NewAcceptPruneUseCase returns a function that makes the sender of a
+// prune message a lazy push peer.
+func NewAcceptPruneUseCase(
+	prune func(entity.Id) bool,
+) func(string, entity.Message) error {
+
+	return func(_ string, message entity.Message) error {
+		prune(message.GetSender())
+		return nil
+	}
+}
+
+// NewSendJoinUseCase returns a function that asks a random passive peer
+// to take us into its active view, and to introduce us to the rest of the
+// network with our own peer record.
+func NewSendJoinUseCase(
+	getPassivePeers func() []entity.Peer,
+	createOwnPeerRecord func() (entity.SignedPeer, error),
+	createJoinMessage func(entity.SignedPeer) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func() error {
+
+	return func() error {
+		peers := getPassivePeers()
+		if len(peers) == 0 {
+			log.Debug("No known peers to join the network through")
+			return nil
+		} else if record, err := createOwnPeerRecord(); err != nil {
+			return err
+		} else if message, err := createJoinMessage(record); err != nil {
+			return err
+		} else {
+			return sendMessage(peers[0], message)
+		}
+	}
+}
+
+// NewAcceptJoinUseCase returns a function that takes a joining peer into
+// our active view and sends a forward join, on a random walk of the given
+// length, to each of our other active peers. The forward join carries the
+// record the joining peer signed, so that the hosts it reaches needn't
+// take our word for its address.
+func NewAcceptJoinUseCase(
+	readJoin func(entity.Message) (entity.SignedPeer, error),
+	verifyPeerRecord func(entity.SignedPeer) error,
+	getAllPeers func() []entity.Peer,
+	activate func(entity.Peer) entity.Peer,
+	createDisconnectMessage func() (entity.Message, error),
+	createNeighborReplyMessage func(bool) (entity.Message, error),
+	createForwardJoinMessage func(entity.SignedPeer, int) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+	activeWalkLength int,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		record, err := readJoin(message)
+		if err != nil {
+			log.Error("Failed to read joining peer from join message")
+			return err
+		} else if record.GetId() != message.GetSender() {
+			log.Warning("Peer %s joined with the record of peer %s, ignoring", message.GetSender(), record.GetId())
+			return ErrPayloadFormat
+		} else if err := verifyPeerRecord(record); err != nil {
+			log.Warning("Failed verifying record of joining peer %s, ignoring", record.GetId())
+			return err
+		}
+
+		joiner := entity.NewPeer(message.GetSender(), senderAddress)
+		if err := activatePeer(joiner, activate, createDisconnectMessage, sendMessage); err != nil {
+			return err
+		} else if reply, err := createNeighborReplyMessage(true); err != nil {
+			return err
+		} else {
+			sendMessage(joiner, reply)
+		}
+
+		forward, err := createForwardJoinMessage(record, activeWalkLength)
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range getAllPeers() {
+			if peer.GetId() != joiner.GetId() {
+				sendMessage(peer, forward)
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewForwardJoinUseCase returns a function that handles a forward join on
+// its random walk. The joining peer is taken into our active view when the
+// walk ends with us, or when we have no other active peer to pass it on
+// to. It's added to our passive view when the walk passes the given
+// passive walk length. The joining peer is only known by the record it
+// signed, which is ignored unless it can be verified.
+func NewForwardJoinUseCase(
+	readForwardJoin func(entity.Message) (entity.SignedPeer, int, error),
+	verifyPeerRecord func(entity.SignedPeer) error,
+	getHostId func() (entity.Id, error),
+	getAllPeers func() []entity.Peer,
+	activate func(entity.Peer) entity.Peer,
+	addPassivePeers func([]entity.SignedPeer),
+	createDisconnectMessage func() (entity.Message, error),
+	createNeighborReplyMessage func(bool) (entity.Message, error),
+	createForwardJoinMessage func(entity.SignedPeer, int) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+	passiveWalkLength int,
+) func(string, entity.Message) error {
+
+	return func(_ string, message entity.Message) error {
+		joiner, ttl, err := readForwardJoin(message)
+		if err != nil {
+			log.Error("Failed to read joining peer from forward join message")
+			return err
+		}
+
+		hostId, err := getHostId()
+		if err != nil {
+			return err
+		} else if joiner.GetId() == hostId {
+			return nil
+		} else if err := verifyPeerRecord(joiner); err != nil {
+			log.Warning("Failed verifying record of peer %s joining through %s, ignoring", joiner.GetId(), message.GetSender())
+			return err
+		}
+
+		peers := getAllPeers()
+		if ttl > 0 && len(peers) > 1 {
+			if ttl == passiveWalkLength {
+				addPassivePeers([]entity.SignedPeer{joiner})
+			}
+			for _, peer := range peers {
+				if peer.GetId() != message.GetSender() && peer.GetId() != joiner.GetId() {
+					if forward, err := createForwardJoinMessage(joiner, ttl-1); err != nil {
+						return err
+					} else {
+						return sendMessage(peer, forward)
+					}
+				}
+			}
+		}
+
+		if err := activatePeer(joiner, activate, createDisconnectMessage, sendMessage); err != nil {
+			return err
+		} else if reply, err := createNeighborReplyMessage(true); err != nil {
+			return err
+		} else {
+			return sendMessage(joiner, reply)
+		}
+	}
+}
+
+// NewAnswerNeighborUseCase returns a function that answers a request to
+// take the sender into our active view. The request is accepted if it's of
+// high priority, or if we have room for the sender.
+func NewAnswerNeighborUseCase(
+	readNeighbor func(entity.Message) (bool, error),
+	isActiveViewFull func() bool,
+	activate func(entity.Peer) entity.Peer,
+	createDisconnectMessage func() (entity.Message, error),
+	createNeighborReplyMessage func(bool) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		isHighPriority, err := readNeighbor(message)
+		if err != nil {
+			log.Error("Failed to read priority from neighbor message")
+			return err
+		}
+
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		isAccepted := isHighPriority || !isActiveViewFull()
+		if isAccepted {
+			if err := activatePeer(peer, activate, createDisconnectMessage, sendMessage); err != nil {
+				return err
+			}
+		}
+
+		if reply, err := createNeighborReplyMessage(isAccepted); err != nil {
+			return err
+		} else {
+			return sendMessage(peer, reply)
+		}
+	}
+}
+
+// NewAcceptNeighborReplyUseCase returns a function that takes the sender
+// of an accepting neighbor reply into our active view.
+func NewAcceptNeighborReplyUseCase(
+	readNeighborReply func(entity.Message) (bool, error),
+	neighborReplied func(entity.Id),
+	activate func(entity.Peer) entity.Peer,
+	createDisconnectMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		isAccepted, err := readNeighborReply(message)
+		if err != nil {
+			log.Error("Failed to read outcome from neighbor reply message")
+			return err
+		}
+
+		neighborReplied(message.GetSender())
+		if !isAccepted {
+			log.Debug("Peer %s turned down our neighbor request", message.GetSender())
+			return nil
+		}
+
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		return activatePeer(peer, activate, createDisconnectMessage, sendMessage)
+	}
+}
+
+// NewAcceptDisconnectUseCase returns a function that moves the sender of a
+// disconnect message from our active view to our passive view.
+func NewAcceptDisconnectUseCase(
+	deactivate func(entity.Id) bool,
+) func(string, entity.Message) error {
+
+	return func(_ string, message entity.Message) error {
+		if deactivate(message.GetSender()) {
+			log.Information("Peer %s dropped us from its active view", message.GetSender())
+		}
+		return nil
+	}
+}
+
+// NewRepairActiveViewUseCase returns a function that, unless our active
+// view is full, asks a random passive peer to become an active peer. The
+// request is of high priority when we have no active peers at all. Passive
+// peers not answering within the given timeout are forgotten.
+func NewRepairActiveViewUseCase(
+	dropUnresponsive func(time.Duration) []entity.Id,
+	isActiveViewFull func() bool,
+	getAllPeers func() []entity.Peer,
+	getPassivePeers func() []entity.Peer,
+	expectNeighborReply func(entity.Id) bool,
+	createNeighborMessage func(bool) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+	timeout time.Duration,
+) func() error {
+
+	return func() error {
+		for _, peerId := range dropUnresponsive(timeout) {
+			log.Information("Passive peer %s didn't answer our neighbor request, forgetting it", peerId)
+		}
+
+		if isActiveViewFull() {
+			return nil
+		}
+
+		for _, peer := range getPassivePeers() {
+			if expectNeighborReply(peer.GetId()) {
+				if message, err := createNeighborMessage(len(getAllPeers()) == 0); err != nil {
+					return err
+				} else {
+					return sendMessage(peer, message)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewShufflePeersUseCase returns a function that sends a sample of our
+// active and passive peers, up to the given number of each, on a random
+// walk through the active view of a random active peer. The host at the
+// end of the walk answers with a sample of its passive peers, which keeps
+// the passive views fresh and well mixed. Peers are offered by the records
+// they signed, so peers we have no record of are left out of the sample.
+func NewShufflePeersUseCase(
+	createOwnPeerRecord func() (entity.SignedPeer, error),
+	getPeerRecord func(entity.Id) (entity.SignedPeer, error),
+	getAllPeers func() []entity.Peer,
+	getPassivePeers func() []entity.Peer,
+	createShuffleMessage func(entity.SignedPeer, []entity.SignedPeer, int) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+	activeSampleSize int,
+	passiveSampleSize int,
+	activeWalkLength int,
+) func() error {
+
+	return func() error {
+		activePeers := getAllPeers()
+		if len(activePeers) == 0 {
+			return nil
+		}
+
+		origin, err := createOwnPeerRecord()
+		if err != nil {
+			return err
+		}
+
+		passivePeers := getPassivePeers()
+		sample := getPeerRecords(activePeers[:min(activeSampleSize, len(activePeers))], getPeerRecord)
+		sample = append(sample, getPeerRecords(passivePeers[:min(passiveSampleSize, len(passivePeers))], getPeerRecord)...)
+		if message, err := createShuffleMessage(origin, sample, activeWalkLength); err != nil {
+			return err
+		} else {
+			return sendMessage(activePeers[len(activePeers)-1], message)
+		}
+	}
+}
+
+// NewAnswerShuffleUseCase returns a function that handles a shuffle on its
+// random walk. Once the walk ends with us, the origin of the shuffle is
+// answered with a sample of our passive peers of the same size as the one
+// received, and the received peers are added to our passive view. Only
+// peers whose records can be verified are passed on or added.
+func NewAnswerShuffleUseCase(
+	readShuffle func(entity.Message) (entity.SignedPeer, []entity.SignedPeer, int, error),
+	verifyPeerRecord func(entity.SignedPeer) error,
+	getHostId func() (entity.Id, error),
+	getAllPeers func() []entity.Peer,
+	getPassivePeers func() []entity.Peer,
+	getPeerRecord func(entity.Id) (entity.SignedPeer, error),
+	addPassivePeers func([]entity.SignedPeer),
+	createShuffleMessage func(entity.SignedPeer, []entity.SignedPeer, int) (entity.Message, error),
+	createShuffleReplyMessage func([]entity.SignedPeer) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(_ string, message entity.Message) error {
+		origin, peers, ttl, err := readShuffle(message)
+		if err != nil {
+			log.Error("Failed to read peers from shuffle message")
+			return err
+		}
+
+		hostId, err := getHostId()
+		if err != nil {
+			return err
+		} else if origin.GetId() == hostId {
+			return nil
+		} else if err := verifyPeerRecord(origin); err != nil {
+			log.Warning("Failed verifying record of peer %s shuffling through %s, ignoring", origin.GetId(), message.GetSender())
+			return err
+		}
+
+		peers = verifiedPeerRecords(peers, verifyPeerRecord)
+		if activePeers := getAllPeers(); ttl > 0 && len(activePeers) > 1 {
+			for _, peer := range activePeers {
+				if peer.GetId() != message.GetSender() && peer.GetId() != origin.GetId() {
+					if forward, err := createShuffleMessage(origin, peers, ttl-1); err != nil {
+						return err
+					} else {
+						return sendMessage(peer, forward)
+					}
+				}
+			}
+		}
+
+		passivePeers := getPassivePeers()
+		sample := getPeerRecords(passivePeers[:min(len(peers)+1, len(passivePeers))], getPeerRecord)
+		addPassivePeers(withoutPeer(append(peers, origin), hostId))
+		if reply, err := createShuffleReplyMessage(sample); err != nil {
+			return err
+		} else {
+			return sendMessage(origin, reply)
+		}
+	}
+}
+
+// NewAcceptShuffleReplyUseCase returns a function that adds the peers in a
+// shuffle reply, whose records can be verified, to our passive view.
+func NewAcceptShuffleReplyUseCase(
+	readShuffleReply func(entity.Message) ([]entity.SignedPeer, error),
+	verifyPeerRecord func(entity.SignedPeer) error,
+	getHostId func() (entity.Id, error),
+	addPassivePeers func([]entity.SignedPeer),
+) func(string, entity.Message) error {
+
+	return func(_ string, message entity.Message) error {
+		peers, err := readShuffleReply(message)
+		if err != nil {
+			log.Error("Failed to read peers from shuffle reply message")
+			return err
+		}
+
+		if hostId, err := getHostId(); err != nil {
+			return err
+		} else {
+			addPassivePeers(verifiedPeerRecords(withoutPeer(peers, hostId), verifyPeerRecord))
+			return nil
+		}
+	}
+}
+
+// NewSendBeaconsUseCase returns a function that broadcasts a discovery
+// beacon on each of our subnets. The broadcast addresses go by the zero
+// id, as they are no peers of their own.
+func NewSendBeaconsUseCase(
+	getBroadcastAddresses func() ([]string, error),
+	createBeaconMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func() error {
+
+	return func() error {
+		addresses, err := getBroadcastAddresses()
+		if err != nil {
+			return err
+		}
+
+		message, err := createBeaconMessage()
+		if err != nil {
+			return err
+		}
+
+		for _, address := range addresses {
+			log.Debug("Broadcasting discovery beacon to %s", address)
+			sendMessage(entity.NewPeer(entity.ZeroId, address), message)
+		}
+
+		return nil
+	}
+}
+
+// NewAnswerBeaconUseCase returns a function that adds the sender of a
+// discovery beacon to our peers, and answers it with a peer message
+// carrying our own signed peer record. Our own beacons, heard back from
+// the broadcast, are ignored.
+func NewAnswerBeaconUseCase(
+	getHostId func() (entity.Id, error),
+	savePeer func(entity.Peer),
+	createOwnPeerRecord func() (entity.SignedPeer, error),
+	createPeerMessage func(entity.SignedPeer) (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func(string, entity.Message) error {
+
+	return func(senderAddress string, message entity.Message) error {
+		if hostId, err := getHostId(); err != nil {
+			return err
+		} else if message.GetSender() == hostId {
+			return nil
+		}
+
+		peer := entity.NewPeer(message.GetSender(), senderAddress)
+		log.Information("Discovered peer %s at %s", peer.GetId(), senderAddress)
+		savePeer(peer)
+
+		if record, err := createOwnPeerRecord(); err != nil {
+			return err
+		} else if reply, err := createPeerMessage(record); err != nil {
+			return err
+		} else {
+			return sendMessage(peer, reply)
+		}
+	}
+}
+
+func NewSendHailCommandUseCase(
+	getFanout func(entity.MessageType) int,
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	createHailMessage func() (entity.Message, error),
+	getDeviceIds func() ([]entity.Id, error),
+	getDevice func(entity.Id) (entity.Device, error),
+	createOwnPeerRecord func() (entity.SignedPeer, error),
+	createSyncMessage func(entity.Device) (entity.Message, error),
+	createPeerMessage func(entity.SignedPeer) (entity.Message, error),
+	sendHail func(entity.Peer, entity.Message) error,
+	sendMessages func(entity.Peer, []entity.Message) error,
+) func() error {
+
+	return func() error {
+		hail, err := createHailMessage()
+		if err != nil {
+			return err
+		}
+
+		peers, err := getRandomPeers(hail.GetId(), getFanout(hail.GetType()))
+		if err != nil {
+			return err
+		}
+
+		deviceIds, err := getDeviceIds()
+		if err != nil {
+			deviceIds = []entity.Id{}
+		}
+
+		// The hail goes first, in a datagram of its own, so that the
+		// receiver knows who we are by the time it reads our sync
+		// messages. Our own peer record follows, for the receiver to
+		// share with hosts hailing it.
+		messages := []entity.Message{}
+		if record, err := createOwnPeerRecord(); err != nil {
+			log.Warning("Failed creating our own peer record, not sharing it")
+		} else if message, err := createPeerMessage(record); err == nil {
+			messages = append(messages, message)
+		}
+		for _, id := range deviceIds {
+			if device, err := getDevice(id); err == nil {
+				if message, err := createSyncMessage(device); err == nil {
+					messages = append(messages, message)
+				}
+			}
+		}
+
+		for _, peer := range peers {
+			if err := sendHail(peer, hail); err != nil {
+				continue
+			}
+			sendMessages(peer, messages)
+		}
+
+		return nil
+	}
+}
+
+func NewSendFarewellEventUseCase(
+	getFanout func(entity.MessageType) int,
+	getRandomPeers func(entity.Id, int) ([]entity.Peer, error),
+	createFarewellMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) func() error {
+
+	return func() error {
+		message, err := createFarewellMessage()
+		if err != nil {
+			return err
+		}
+
+		peers, err := getRandomPeers(message.GetId(), getFanout(message.GetType()))
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range peers {
+			sendMessage(peer, message)
+		}
+
+		return nil
+	}
+}
+
+// activatePeer takes the given peer into our active view, telling the peer
+// dropped to make room for it, if any, that it's no longer active.
+func activatePeer(
+	peer entity.Peer,
+	activate func(entity.Peer) entity.Peer,
+	createDisconnectMessage func() (entity.Message, error),
+	sendMessage func(entity.Peer, entity.Message) error,
+) error {
+	dropped := activate(peer)
+	if dropped == nil {
+		return nil
+	}
+
+	log.Debug("Dropped %s from our active view to make room for %s", dropped.GetId(), peer.GetId())
+	if message, err := createDisconnectMessage(); err != nil {
+		return err
+	} else {
+		return sendMessage(dropped, message)
+	}
+}
+
+func withoutPeer(peers []entity.SignedPeer, peerId entity.Id) []entity.SignedPeer {
+	result := make([]entity.SignedPeer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.GetId() != peerId {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+// verifiedPeerRecords returns the given peer records that can be verified,
+// in the order given.
+func verifiedPeerRecords(records []entity.SignedPeer, verifyPeerRecord func(entity.SignedPeer) error) []entity.SignedPeer {
+	result := make([]entity.SignedPeer, 0, len(records))
+	for _, record := range records {
+		if err := verifyPeerRecord(record); err != nil {
+			log.Debug("Failed verifying record of peer %s, ignoring", record.GetId())
+		} else {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// getPeerRecords returns the records we have of the given peers, in the
+// order given. Peers we have no record of are left out.
+func getPeerRecords(peers []entity.Peer, getPeerRecord func(entity.Id) (entity.SignedPeer, error)) []entity.SignedPeer {
+	result := make([]entity.SignedPeer, 0, len(peers))
+	for _, peer := range peers {
+		if record, err := getPeerRecord(peer.GetId()); err == nil {
+			result = append(result, record)
+		}
+	}
+	return result
+}
@@ -4,8 +4,11 @@ import (
 	"echsylon/fudpucker/entity"
 	"encoding/json"
 	"strconv"
+	"time"
 )
 
+const maxPatchWaitSeconds = 60
+
 func NewGetHostInfoRequestHandler(
 	getHostInfo func() (entity.Host, error),
 ) func(map[string][]string, []byte) ([]byte, int) {
@@ -69,7 +72,8 @@ func NewGetDeviceRequestHandler(
 }
 
 func NewPatchStateRequestHandler(
-	updateState func(entity.Id, entity.DeviceState) error,
+	updateState func(entity.Id, entity.DeviceState) (entity.Id, error),
+	awaitPatch func(entity.Id, time.Duration) (entity.Patch, error),
 ) func(map[string][]string, []byte) ([]byte, int) {
 
 	return func(args map[string][]string, content []byte) ([]byte /*result*/, int /*status*/) {
@@ -89,10 +93,45 @@ func NewPatchStateRequestHandler(
 			deviceState = entity.DeviceState(value)
 		}
 
-		if err := updateState(deviceId, deviceState); err != nil {
-			return nil, 500
+		var timeout time.Duration
+		if values, ok := args["wait"]; !ok || len(values) == 0 {
+			timeout = 0
+		} else if value, err := strconv.Atoi(values[0]); err != nil || value < 0 || value > maxPatchWaitSeconds {
+			return nil, 400
 		} else {
-			return nil, 200
+			timeout = time.Duration(value) * time.Second
+		}
+
+		patchId, err := updateState(deviceId, deviceState)
+		if err != nil {
+			return nil, 500
+		} else if patchId == entity.ZeroId {
+			return nil, 200 // our own device, already updated
+		} else if timeout == 0 {
+			if json, err := idToJson(patchId); err != nil {
+				return nil, 500
+			} else {
+				return json, 200
+			}
+		}
+
+		patch, err := awaitPatch(patchId, timeout)
+		if err != nil {
+			return nil, 504 // gateway timeout, the owner never replied
+		}
+
+		json, err := patchToJson(patch)
+		if err != nil {
+			return nil, 500
+		}
+
+		switch patch.GetStatus() {
+		case entity.PatchStatusAccepted:
+			return json, 200
+		case entity.PatchStatusRejected, entity.PatchStatusSuperseded:
+			return json, 409 // conflict
+		default:
+			return json, 504
 		}
 	}
 }
@@ -180,6 +219,20 @@ func NewAddPeerRequestHandler(
 	}
 }
 
+func NewGetPatchesRequestHandler(
+	getPatches func() []entity.Patch,
+) func(map[string][]string, []byte) ([]byte, int) {
+
+	return func(args map[string][]string, content []byte) ([]byte /*result*/, int /*status*/) {
+		patches := getPatches()
+		if json, err := patchesToJson(patches); err != nil {
+			return nil, 500
+		} else {
+			return json, 200
+		}
+	}
+}
+
 func NewJoinNetworkRequestHandler(
 	joinNetwork func() error,
 ) func(map[string][]string, []byte) ([]byte, int) {
@@ -242,7 +295,9 @@ func hostToJson(host entity.Host) ([]byte, error) {
 	data := make(map[string]any)
 	data["id"] = host.GetId().String()
 	data["address"] = host.GetLocalAddress()
-	//data["broadcastAddress"] = host.GetBroadcastAddress()
+	if multicast := host.GetMulticastAddress(); multicast != "" {
+		data["multicastAddress"] = multicast
+	}
 	return json.Marshal(data)
 }
 
@@ -263,3 +318,30 @@ func peersToJson(peers []entity.Peer) ([]byte, error) {
 	}
 	return json.Marshal(data)
 }
+
+func patchToJson(patch entity.Patch) ([]byte, error) {
+	return json.Marshal(patchToMap(patch))
+}
+
+func patchesToJson(patches []entity.Patch) ([]byte, error) {
+	data := make([]map[string]any, len(patches))
+	for index, patch := range patches {
+		data[index] = patchToMap(patch)
+	}
+	return json.Marshal(data)
+}
+
+func patchToMap(patch entity.Patch) map[string]any {
+	data := make(map[string]any)
+	data["id"] = patch.GetId().String()
+	data["device"] = patch.GetDeviceId().String()
+	data["state"] = patch.GetState()
+	data["attempts"] = patch.GetAttempts()
+	data["status"] = patch.GetStatus().String()
+	if patch.GetStatus() == entity.PatchStatusAccepted {
+		data["version"] = patch.GetVersion()
+	} else if patch.GetStatus() == entity.PatchStatusRejected {
+		data["reason"] = patch.GetReason()
+	}
+	return data
+}
@@ -15,6 +15,8 @@ func NewGetApiDocUseCase() func() (map[string]string, error) {
 		data["GET /device"] = "Get all devices your peer currently knows about."
 		data["GET /device/{id}"] = "Get the last synched state for the given device."
 		data["GET /info"] = "Display your peer info."
+		data["PATCH /device/{id}"] = "Change the state of a device, params: \"state\"=[0|1] (off/on), \"wait\"=[0-60] (seconds to wait for the owner's reply)"
+		data["GET /patch"] = "Get the delivery status of state changes requested on devices you don't own."
 		data["GET /peer"] = "Get all peers you currently see."
 		data["POST /device"] = "Create a new device, params: \"type\"=1 (light), \"state\"=[0|1] (off/on)"
 		data["POST /network"] = "Join the network, start syncing state."
@@ -28,11 +30,13 @@ func NewGetApiDocUseCase() func() (map[string]string, error) {
 func NewShutdownUseCase(
 	clearPeerCache func(),
 	clearMessageCache func(),
+	clearPatchQueue func(),
 	shutDownServices context.CancelFunc,
 ) func() error {
 	return func() error {
 		clearPeerCache()
 		clearMessageCache()
+		clearPatchQueue()
 		shutDownServices()
 		return nil
 	}